@@ -0,0 +1,31 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func handleCollectorStatus(collectorSvc CollectorService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, collectorSvc.Status())
+	}
+}
+
+func handleContainerCollectorStatus(collectorSvc CollectorService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := collectorSvc.ContainerStatus(r.PathValue("name"))
+		if err != nil {
+			var notFoundErr *log.ContainerNotFoundError
+			if errors.As(err, &notFoundErr) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, status)
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func handleListContainers(containerSvc ContainerService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		containers, err := containerSvc.ListContainers(r.Context(), log.ContainerFilter{
+			NamePrefix: q.Get("prefix"),
+			State:      q.Get("status"),
+			Labels:     q["label"],
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, containers)
+	}
+}
+
+func handleGetContainer(containerSvc ContainerService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		container, err := containerSvc.GetContainer(r.Context(), r.PathValue("name"))
+		if err != nil {
+			var notFoundErr *log.ContainerNotFoundError
+			if errors.As(err, &notFoundErr) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, container)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
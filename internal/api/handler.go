@@ -14,13 +14,58 @@ type DockerLogService interface {
 	//
 	// Returns [*log.Error] with code [log.ErrorCodeContainerNotFound] if the container doesn't exist.
 	GetContainerLogs(ctx context.Context, query log.Query) (io.ReadCloser, error)
+
+	// GetMergedContainerLogs returns the filtered log streams of several containers
+	// merged into a single stream ordered by timestamp.
+	//
+	// Returns [*log.ContainerNotFoundError] if one of the containers doesn't exist.
+	GetMergedContainerLogs(
+		ctx context.Context,
+		containerNames []string,
+		query log.Query,
+	) (io.ReadCloser, error)
+}
+
+// ContainerService defines the interface for retrieving information about containers.
+type ContainerService interface {
+	// ListContainers returns the containers known to the proxy, live or archived,
+	// satisfying the filter.
+	ListContainers(ctx context.Context, filter log.ContainerFilter) ([]log.ContainerSummary, error)
+
+	// GetContainer returns the details of the specified container, live or archived.
+	//
+	// Returns [*log.ContainerNotFoundError] if the container doesn't exist.
+	GetContainer(ctx context.Context, containerNameOrID string) (log.ContainerDetails, error)
+}
+
+// CollectorService defines the interface for retrieving the status of the log collection.
+type CollectorService interface {
+	// Status returns the status of the collection of the logs of every container.
+	Status() []log.CollectorStatus
+
+	// ContainerStatus returns the status of the collection of the container's logs.
+	//
+	// Returns [*log.ContainerNotFoundError] if the logs of the container are not collected.
+	ContainerStatus(containerNameOrID string) (log.CollectorStatus, error)
 }
 
 // NewHandler returns an [http.Handler] configured with the logs API endpoints.
 // It sets up proper routing and integrates with the provided services.
-func NewHandler(ctx context.Context, addr string, dockerLogSvc DockerLogService) http.Handler {
+func NewHandler(
+	ctx context.Context,
+	addr string,
+	dockerLogSvc DockerLogService,
+	containerSvc ContainerService,
+	collectorSvc CollectorService,
+) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /healthz", handleHealthz())
+	mux.HandleFunc("GET /logs", handleMergedLogs(dockerLogSvc, containerSvc))
 	mux.HandleFunc("GET /logs/{name}", handleLogs(dockerLogSvc))
+	mux.HandleFunc("GET /ws/logs/{name}", handleLogsWebSocket(dockerLogSvc))
+	mux.HandleFunc("GET /containers", handleListContainers(containerSvc))
+	mux.HandleFunc("GET /containers/{name}", handleGetContainer(containerSvc))
+	mux.HandleFunc("GET /collector/status", handleCollectorStatus(collectorSvc))
+	mux.HandleFunc("GET /collector/status/{name}", handleContainerCollectorStatus(collectorSvc))
 	return mux
 }
@@ -1,52 +1,366 @@
 package api
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/matthieugusmini/docker-logproxy/internal/log"
 )
 
+// contentTypeByFormat maps the supported log formats to their media type.
+var contentTypeByFormat = map[log.Format]string{
+	log.FormatText:   "text/plain",
+	log.FormatNDJSON: "application/x-ndjson",
+	log.FormatJSON:   "application/json",
+}
+
 func handleLogs(dockerLogSvc DockerLogService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		containerName := r.PathValue("name")
+		query, err := parseLogsQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		serveLogs(w, r, query, dockerLogSvc.GetContainerLogs)
+	}
+}
+
+func handleMergedLogs(dockerLogSvc DockerLogService, containerSvc ContainerService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseLogsQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		q := r.URL.Query()
-		// stderr is included by default. It is excluded only if explicitly turned off.
-		includeStderr := q.Get("stderr") != "0"
-		includeStdout := q.Get("stdout") == "1"
-		if !includeStderr && !includeStdout {
-			w.Header().Set("Content-Type", "text/plain")
-			w.WriteHeader(http.StatusOK)
+		containerNames := q["name"]
+		labels := q["label"]
+		if len(containerNames) == 0 && len(labels) == 0 {
+			http.Error(w, "missing name or label parameter", http.StatusBadRequest)
 			return
 		}
 
-		follow := q.Get("follow") == "1"
+		if len(labels) > 0 {
+			containers, err := containerSvc.ListContainers(
+				r.Context(),
+				log.ContainerFilter{Labels: labels},
+			)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, ctr := range containers {
+				if !slices.Contains(containerNames, ctr.Name) {
+					containerNames = append(containerNames, ctr.Name)
+				}
+			}
+			if len(containerNames) == 0 {
+				http.Error(w, "no container matches the labels", http.StatusNotFound)
+				return
+			}
+		}
 
-		logs, err := dockerLogSvc.GetContainerLogs(
-			r.Context(),
-			log.Query{
-				ContainerName: containerName,
-				IncludeStdout: includeStdout,
-				IncludeStderr: includeStderr,
-				Follow:        follow,
-			},
-		)
-		if err != nil {
-			var notFoundErr *log.ContainerNotFoundError
-			if errors.As(err, &notFoundErr) {
-				http.Error(w, err.Error(), http.StatusNotFound)
+		serveLogs(w, r, query, func(ctx context.Context, query log.Query) (io.ReadCloser, error) {
+			return dockerLogSvc.GetMergedContainerLogs(ctx, containerNames, query)
+		})
+	}
+}
+
+// serveLogs writes the logs opened with openLogs to the response, either as
+// Server-Sent Events if the client accepts them or in the requested format.
+func serveLogs(
+	w http.ResponseWriter,
+	r *http.Request,
+	query log.Query,
+	openLogs func(ctx context.Context, query log.Query) (io.ReadCloser, error),
+) {
+	contentType := contentTypeByFormat[query.Format]
+
+	// Server-Sent Events carry the structured records.
+	isEventStream := acceptsEventStream(r)
+	var lastEventID *eventID
+	if isEventStream {
+		contentType = eventStreamContentType
+		query.Format = log.FormatNDJSON
+
+		// The client is reconnecting, so resume right after the last event it received.
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			id, err := parseEventID(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			lastEventID = &id
+			if id.ts.After(query.Since) {
+				query.Since = id.ts
+			}
+			query.Tail = nil
+		}
+	}
+
+	if !query.IncludeStderr && !query.IncludeStdout {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		if query.Format == log.FormatJSON {
+			_, _ = io.WriteString(w, "[]\n")
+		}
+		return
+	}
+
+	logs, err := openLogs(r.Context(), query)
+	if err != nil {
+		var (
+			notFoundErr    *log.ContainerNotFoundError
+			runNotFoundErr *log.RunNotFoundError
+		)
+		if errors.As(err, &notFoundErr) || errors.As(err, &runNotFoundErr) {
+			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		defer logs.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer logs.Close()
+
+	if isEventStream {
+		streamEvents(r.Context(), w, logs, lastEventID)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_, _ = io.Copy(newResponseStreamer(w), logs)
+}
+
+// parseLogsQuery builds the [log.Query] described by the request path and query parameters.
+// The returned error is meant to be sent back to the client.
+func parseLogsQuery(r *http.Request) (log.Query, error) {
+	q := r.URL.Query()
+
+	now := time.Now()
+	since, err := parseTime(q.Get("since"), now)
+	if err != nil {
+		return log.Query{}, fmt.Errorf("invalid since parameter: %w", err)
+	}
+	until, err := parseTime(q.Get("until"), now)
+	if err != nil {
+		return log.Query{}, fmt.Errorf("invalid until parameter: %w", err)
+	}
+
+	tail, err := parseTail(q.Get("tail"))
+	if err != nil {
+		return log.Query{}, fmt.Errorf("invalid tail parameter: %w", err)
+	}
+
+	format, err := negotiateFormat(r)
+	if err != nil {
+		return log.Query{}, fmt.Errorf("invalid format parameter: %w", err)
+	}
+
+	var regex *regexp.Regexp
+	if v := q.Get("regex"); v != "" {
+		regex, err = regexp.Compile(v)
+		if err != nil {
+			return log.Query{}, fmt.Errorf("invalid regex parameter: %w", err)
+		}
+	}
+
+	contextLines, err := parseNonNegativeInt(q.Get("context"))
+	if err != nil {
+		return log.Query{}, fmt.Errorf("invalid context parameter: %w", err)
+	}
+
+	run, err := parseRun(q.Get("run"))
+	if err != nil {
+		return log.Query{}, fmt.Errorf("invalid run parameter: %w", err)
+	}
+
+	minLevel, maxLevel, err := parseLevelFilter(q)
+	if err != nil {
+		return log.Query{}, fmt.Errorf("invalid level parameter: %w", err)
+	}
+
+	return log.Query{
+		ContainerName: r.PathValue("name"),
+		// stderr is included by default. It is excluded only if explicitly turned off.
+		IncludeStderr: q.Get("stderr") != "0",
+		IncludeStdout: q.Get("stdout") == "1",
+		Follow:        q.Get("follow") == "1",
+		Wait:          q.Get("wait") == "1",
+		Persist:       q.Get("persist") == "1",
+		Since:         since,
+		Until:         until,
+		Tail:          tail,
+		Format:        format,
+		Grep:          q.Get("grep"),
+		Regex:         regex,
+		Invert:        q.Get("invert") == "1",
+		Context:       contextLines,
+		Run:           run,
+		Fields:        parseFieldFilters(q),
+		MinLevel:      minLevel,
+		MaxLevel:      maxLevel,
+	}, nil
+}
+
+// parseFieldFilters returns the values of the fields given as field.<name>=<value>
+// query parameters, or nil if there are none.
+func parseFieldFilters(q url.Values) map[string]string {
+	var fields map[string]string
+	for key := range q {
+		if name, ok := strings.CutPrefix(key, "field."); ok && name != "" {
+			if fields == nil {
+				fields = make(map[string]string)
+			}
+			fields[name] = q.Get(key)
+		}
+	}
+	return fields
+}
+
+// parseLevelFilter returns the range of levels selected by the level query parameter,
+// given as level=<level>, level>=<level>, level<=<level>, level><level> or
+// level<<level>. A zero bound means that the range is not bounded on this side.
+func parseLevelFilter(q url.Values) (minLevel, maxLevel log.Level, err error) {
+	for key, values := range q {
+		op, ok := strings.CutPrefix(key, "level")
+		if !ok {
+			continue
+		}
+
+		// level>=warn is parsed as the key "level>" with the value "warn",
+		// while level>warn is parsed as the key "level>warn" without value.
+		value := values[0]
+		if len(op) > 1 && value == "" {
+			op, value = op[:1], op[1:]
+		} else if op != "" {
+			op += "="
+		}
+
+		if !slices.Contains([]string{"", ">=", "<=", ">", "<"}, op) {
+			// Another parameter starting with level.
+			continue
+		}
+
+		level, err := log.ParseLevel(value)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch op {
+		case "":
+			minLevel, maxLevel = level, level
+		case ">=":
+			minLevel = level
+		case "<=":
+			maxLevel = level
+		case ">":
+			minLevel = level + 1
+		case "<":
+			if level == log.LevelTrace {
+				return 0, 0, fmt.Errorf("no level is below %s", level)
+			}
+			maxLevel = level - 1
+		}
+	}
+	return minLevel, maxLevel, nil
+}
+
+// negotiateFormat determines the log format from the format query parameter or,
+// if absent, from the Accept header. It defaults to [log.FormatText].
+func negotiateFormat(r *http.Request) (log.Format, error) {
+	if value := r.URL.Query().Get("format"); value != "" {
+		format := log.Format(value)
+		if _, ok := contentTypeByFormat[format]; !ok {
+			return "", fmt.Errorf("unsupported format %q", value)
+		}
+		return format, nil
+	}
+
+	for _, accept := range r.Header.Values("Accept") {
+		for mediaRange := range strings.SplitSeq(accept, ",") {
+			mediaType, _, _ := strings.Cut(mediaRange, ";")
+			for format, contentType := range contentTypeByFormat {
+				if strings.TrimSpace(mediaType) == contentType {
+					return format, nil
+				}
+			}
+		}
+	}
+
+	return log.FormatText, nil
+}
+
+// parseTime parses a point in time given either as an RFC3339 timestamp
+// or as a duration relative to now (e.g. "15m" means 15 minutes ago).
+// It returns the zero time if value is empty.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 timestamp nor a duration", value)
+	}
+	return now.Add(-d.Abs()), nil
+}
+
+// parseTail parses the number of lines to return from the end of the logs.
+// It returns nil if value is empty or "all", meaning all the logs.
+func parseTail(value string) (*int, error) {
+	if value == "" || value == "all" {
+		return nil, nil
+	}
+	tail, err := parseNonNegativeInt(value)
+	if err != nil {
+		return nil, err
+	}
+	return &tail, nil
+}
+
+// parseRun parses the index of the run to return the logs of. It returns nil if
+// value is empty or "all", meaning all the runs, and -1 for "latest".
+func parseRun(value string) (*int, error) {
+	switch value {
+	case "", "all":
+		return nil, nil
+	case "latest":
+		latest := -1
+		return &latest, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither latest, all nor a run index", value)
+	}
+	return &i, nil
+}
+
+// parseNonNegativeInt parses a non-negative integer. It returns 0 if value is empty.
+func parseNonNegativeInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
 
-		w.Header().Set("Content-Type", "text/plain")
-		_, _ = io.Copy(newResponseStreamer(w), logs)
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative integer", value)
 	}
+	return n, nil
 }
 
 // responseStreamer wraps http.ResponseWriter to enable immediate flushing.
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+// sseKeepAliveInterval is the interval at which a comment is sent to the client
+// to keep the connection alive when there are no new logs.
+var sseKeepAliveInterval = 15 * time.Second
+
+const eventStreamContentType = "text/event-stream"
+
+// acceptsEventStream reports whether the client requested a Server-Sent Events stream.
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for mediaRange := range strings.SplitSeq(accept, ",") {
+			mediaType, _, _ := strings.Cut(mediaRange, ";")
+			if strings.TrimSpace(mediaType) == eventStreamContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eventID identifies a log record sent as a Server-Sent Event.
+//
+// Records are identified by their timestamp and their position among the records
+// sharing the same timestamp, so that a client can resume the stream from the
+// last event it received.
+type eventID struct {
+	ts  time.Time
+	seq int
+}
+
+// parseEventID parses an event ID formatted by [eventID.String].
+func parseEventID(s string) (eventID, error) {
+	tsStr, seqStr, hasSeq := strings.Cut(s, ".")
+	nanos, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return eventID{}, fmt.Errorf("invalid event ID %q", s)
+	}
+
+	var seq int
+	if hasSeq {
+		seq, err = strconv.Atoi(seqStr)
+		if err != nil || seq < 0 {
+			return eventID{}, fmt.Errorf("invalid event ID %q", s)
+		}
+	}
+
+	return eventID{ts: time.Unix(0, nanos), seq: seq}, nil
+}
+
+func (id eventID) String() string {
+	if id.seq == 0 {
+		return strconv.FormatInt(id.ts.UnixNano(), 10)
+	}
+	return fmt.Sprintf("%d.%d", id.ts.UnixNano(), id.seq)
+}
+
+// next returns the ID of the record emitted at ts following the record identified by id.
+func (id eventID) next(ts time.Time) eventID {
+	if ts.Equal(id.ts) {
+		return eventID{ts: ts, seq: id.seq + 1}
+	}
+	return eventID{ts: ts}
+}
+
+// after reports whether id identifies a record following the record identified by other.
+func (id eventID) after(other eventID) bool {
+	return id.ts.After(other.ts) || (id.ts.Equal(other.ts) && id.seq > other.seq)
+}
+
+// streamEvents writes each record of the NDJSON log stream as a Server-Sent Event
+// until the stream ends or the client disconnects. The stream type is used as event
+// type and the record itself is sent as JSON data.
+//
+// If lastEventID is not nil, the records up to and including this event are skipped.
+func streamEvents(
+	ctx context.Context,
+	w http.ResponseWriter,
+	logs io.Reader,
+	lastEventID *eventID,
+) {
+	w.Header().Set("Content-Type", eventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rs := newResponseStreamer(w)
+	// Send the headers right away so the client knows the stream is open.
+	_ = rs.rc.Flush()
+
+	records := make(chan log.Record)
+	go func() {
+		defer close(records)
+
+		dec := json.NewDecoder(logs)
+		for {
+			var rec log.Record
+			if err := dec.Decode(&rec); err != nil {
+				return
+			}
+
+			select {
+			case records <- rec:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+
+	var id eventID
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if _, err := io.WriteString(rs, ": keepalive\n\n"); err != nil {
+				return
+			}
+
+		case rec, ok := <-records:
+			if !ok {
+				return
+			}
+
+			id = id.next(rec.Timestamp)
+			if lastEventID != nil && !id.after(*lastEventID) {
+				// Already received by the client before reconnecting.
+				continue
+			}
+
+			data, err := json.Marshal(&rec)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(rs, "id: %s\nevent: %s\ndata: %s\n\n", id, rec.Stream, data)
+			if err != nil {
+				return
+			}
+			// Don't send a keepalive right after an event.
+			ticker.Reset(sseKeepAliveInterval)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/api"
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestLogsEventStream(t *testing.T) {
+	testTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	svc := &fakeLogService{
+		containers: map[string][]log.Record{
+			"foo": {
+				{Timestamp: testTime, Stream: log.StreamTypeStderr, Log: "a\n"},
+				{Timestamp: testTime, Stream: log.StreamTypeStderr, Log: "b\n"},
+				{Timestamp: testTime, Stream: log.StreamTypeStderr, Log: "c\n"},
+				{Timestamp: testTime.Add(time.Second), Stream: log.StreamTypeStderr, Log: "d\n"},
+			},
+		},
+	}
+	srv := httptest.NewServer(api.NewHandler(context.Background(), "", svc, nil, nil))
+	defer srv.Close()
+
+	ts := testTime.UnixNano()
+	next := testTime.Add(time.Second).UnixNano()
+
+	testCases := []struct {
+		name        string
+		lastEventID string
+		expectedIDs []string
+		expectedLog []string
+	}{
+		{
+			name: "without last event ID",
+			expectedIDs: []string{
+				fmt.Sprint(ts), fmt.Sprintf("%d.1", ts), fmt.Sprintf("%d.2", ts), fmt.Sprint(next),
+			},
+			expectedLog: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:        "resumes after the first record of a timestamp",
+			lastEventID: fmt.Sprint(ts),
+			expectedIDs: []string{
+				fmt.Sprintf("%d.1", ts), fmt.Sprintf("%d.2", ts), fmt.Sprint(next),
+			},
+			expectedLog: []string{"b", "c", "d"},
+		},
+		{
+			name:        "resumes after a record sharing its timestamp",
+			lastEventID: fmt.Sprintf("%d.1", ts),
+			expectedIDs: []string{fmt.Sprintf("%d.2", ts), fmt.Sprint(next)},
+			expectedLog: []string{"c", "d"},
+		},
+		{
+			name:        "resumes after the last record",
+			lastEventID: fmt.Sprint(next),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := getEventStream(t, srv.URL+"/logs/foo", tc.lastEventID)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("expected content type %q, got %q", "text/event-stream", got)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read events: %v", err)
+			}
+			ids, logs := parseEvents(t, string(body))
+			if !slices.Equal(ids, tc.expectedIDs) {
+				t.Errorf("expected IDs %q, got %q", tc.expectedIDs, ids)
+			}
+			if !slices.Equal(logs, tc.expectedLog) {
+				t.Errorf("expected logs %q, got %q", tc.expectedLog, logs)
+			}
+		})
+	}
+
+	for _, lastEventID := range []string{"yesterday", "1704110400000000000.x", "1.-1"} {
+		t.Run("rejects malformed last event ID "+lastEventID, func(t *testing.T) {
+			resp := getEventStream(t, srv.URL+"/logs/foo", lastEventID)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func getEventStream(t *testing.T, url, lastEventID string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	return resp
+}
+
+// parseEvents returns the IDs of the events and the log text of their records.
+func parseEvents(t *testing.T, body string) (ids, logs []string) {
+	t.Helper()
+
+	for event := range strings.SplitSeq(strings.TrimSpace(body), "\n\n") {
+		if event == "" {
+			continue
+		}
+		for line := range strings.SplitSeq(event, "\n") {
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				ids = append(ids, value)
+			case "data":
+				_, output, ok := strings.Cut(value, `"output":"`)
+				if !ok {
+					t.Fatalf("unexpected event data %s", value)
+				}
+				output = output[:strings.IndexByte(output, '"')]
+				logs = append(logs, strings.TrimSuffix(output, `\n`))
+			}
+		}
+	}
+	return ids, logs
+}
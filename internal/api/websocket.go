@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+	"github.com/matthieugusmini/docker-logproxy/internal/websocket"
+)
+
+// Types of the control messages sent by WebSocket clients.
+const (
+	// wsControlPause stops sending logs until the stream is resumed.
+	wsControlPause = "pause"
+	// wsControlResume sends the logs emitted since the stream was paused and continues.
+	wsControlResume = "resume"
+	// wsControlFilter changes the streams (stdout, stderr) included in the logs.
+	wsControlFilter = "filter"
+	// wsControlSwitch switches to the logs of another container.
+	wsControlSwitch = "switch"
+)
+
+// Types of the status messages sent to WebSocket clients.
+const (
+	// wsStatusEnd notifies that the log stream ended (e.g. the container exited).
+	wsStatusEnd = "end"
+	// wsStatusError notifies that an error occurred. The connection remains open.
+	wsStatusError = "error"
+)
+
+// wsControlMessage is a message sent by a WebSocket client to change
+// the active log query without dropping the connection.
+type wsControlMessage struct {
+	Type      string `json:"type"`
+	Container string `json:"container,omitempty"`
+	Stdout    *bool  `json:"stdout,omitempty"`
+	Stderr    *bool  `json:"stderr,omitempty"`
+}
+
+// wsStatusMessage is a message sent to a WebSocket client to notify
+// it of a change in the log stream.
+type wsStatusMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message,omitempty"`
+}
+
+func handleLogsWebSocket(dockerLogSvc DockerLogService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseLogsQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Format = log.FormatNDJSON
+
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			var handshakeErr *websocket.HandshakeError
+			if errors.As(err, &handshakeErr) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		defer conn.Close()
+
+		session := &wsLogSession{
+			conn:         conn,
+			dockerLogSvc: dockerLogSvc,
+			query:        query,
+		}
+		session.run(r.Context())
+	}
+}
+
+// wsLogSession streams the logs matching a query over a WebSocket connection
+// and applies the control messages sent by the client.
+type wsLogSession struct {
+	conn         *websocket.Conn
+	dockerLogSvc DockerLogService
+	query        log.Query
+	paused       bool
+	// lastID identifies the last record sent to the client, like the ID of a
+	// Server-Sent Event. It is used to restart the stream where it stopped when
+	// the query changes.
+	lastID eventID
+}
+
+func (s *wsLogSession) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	controls := make(chan wsControlMessage)
+	go func() {
+		// Reading fails once the client closes the connection.
+		defer cancel()
+		s.readControls(ctx, controls)
+	}()
+
+	var (
+		records      <-chan log.Record
+		cancelStream context.CancelFunc = func() {}
+		// id identifies the last record received from the stream.
+		id eventID
+	)
+	restart := func() {
+		cancelStream()
+		records, id = nil, eventID{}
+		if s.paused {
+			return
+		}
+
+		var streamCtx context.Context
+		streamCtx, cancelStream = context.WithCancel(ctx)
+		var err error
+		records, err = s.openStream(streamCtx)
+		if err != nil {
+			s.writeStatus(wsStatusError, err.Error())
+		}
+	}
+	defer func() { cancelStream() }()
+
+	restart()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-controls:
+			if err := s.apply(msg); err != nil {
+				s.writeStatus(wsStatusError, err.Error())
+				continue
+			}
+			restart()
+
+		case rec, ok := <-records:
+			if !ok {
+				records = nil
+				s.writeStatus(wsStatusEnd, "")
+				continue
+			}
+
+			id = id.next(rec.Timestamp)
+			if !s.lastID.ts.IsZero() && !id.after(s.lastID) {
+				// Already sent before the stream restarted.
+				continue
+			}
+
+			data, err := json.Marshal(&rec)
+			if err != nil {
+				return
+			}
+			if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+			s.lastID = id
+		}
+	}
+}
+
+// readControls decodes the control messages sent by the client until the connection is closed.
+func (s *wsLogSession) readControls(ctx context.Context, controls chan<- wsControlMessage) {
+	for {
+		msgType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType != websocket.TextMessage {
+			continue
+		}
+
+		var msg wsControlMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.writeStatus(wsStatusError, fmt.Sprintf("invalid control message: %v", err))
+			continue
+		}
+
+		select {
+		case controls <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// apply updates the session according to the control message.
+func (s *wsLogSession) apply(msg wsControlMessage) error {
+	switch msg.Type {
+	case wsControlPause:
+		s.paused = true
+
+	case wsControlResume:
+		s.paused = false
+
+	case wsControlFilter:
+		if msg.Stdout != nil {
+			s.query.IncludeStdout = *msg.Stdout
+		}
+		if msg.Stderr != nil {
+			s.query.IncludeStderr = *msg.Stderr
+		}
+
+	case wsControlSwitch:
+		if msg.Container == "" {
+			return errors.New("invalid control message: missing container")
+		}
+		s.query.ContainerName = msg.Container
+		// Start over with the logs of the new container.
+		s.lastID = eventID{}
+
+	default:
+		return fmt.Errorf("invalid control message: unknown type %q", msg.Type)
+	}
+
+	return nil
+}
+
+// openStream starts streaming the records matching the current query. If records
+// were already sent, the stream restarts at the timestamp of the last one, so that
+// the records sharing it are not missed. The records already sent are skipped by run.
+func (s *wsLogSession) openStream(ctx context.Context) (<-chan log.Record, error) {
+	query := s.query
+	if !s.lastID.ts.IsZero() {
+		query.Since = s.lastID.ts
+		query.Tail = nil
+	}
+
+	if !query.IncludeStdout && !query.IncludeStderr {
+		records := make(chan log.Record)
+		close(records)
+		return records, nil
+	}
+
+	logs, err := s.dockerLogSvc.GetContainerLogs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(chan log.Record)
+	go func() {
+		defer logs.Close()
+		defer close(records)
+
+		dec := json.NewDecoder(logs)
+		for {
+			var rec log.Record
+			if err := dec.Decode(&rec); err != nil {
+				if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+					s.writeStatus(wsStatusError, err.Error())
+				}
+				return
+			}
+
+			select {
+			case records <- rec:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return records, nil
+}
+
+func (s *wsLogSession) writeStatus(statusType, message string) {
+	data, err := json.Marshal(wsStatusMessage{Type: statusType, Message: message})
+	if err != nil {
+		return
+	}
+	_ = s.conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,183 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/api"
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+	"github.com/matthieugusmini/docker-logproxy/internal/websocket"
+)
+
+func TestLogsWebSocket(t *testing.T) {
+	testTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	svc := &fakeLogService{
+		containers: map[string][]log.Record{
+			"foo": {
+				{Timestamp: testTime, Stream: log.StreamTypeStdout, Log: "foo out\n"},
+				{Timestamp: testTime.Add(time.Second), Stream: log.StreamTypeStderr, Log: "foo err\n"},
+			},
+			"bar": {
+				{Timestamp: testTime, Stream: log.StreamTypeStderr, Log: "bar err\n"},
+			},
+		},
+	}
+	srv := httptest.NewServer(api.NewHandler(context.Background(), "", svc, nil, nil))
+	defer srv.Close()
+
+	conn, err := websocket.Dial(
+		t.Context(),
+		"ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/logs/foo?stdout=1&stderr=0",
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	expectMessages(t, conn,
+		`{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"foo out\n"}`,
+		`{"type":"end"}`,
+	)
+
+	// Toggling stderr on restarts the stream after the last record received.
+	sendControl(t, conn, `{"type":"filter","stderr":true}`)
+	expectMessages(t, conn,
+		`{"timestamp":"2024-01-01T12:00:01Z","stream":"stderr","output":"foo err\n"}`,
+		`{"type":"end"}`,
+	)
+
+	sendControl(t, conn, `{"type":"switch","container":"bar"}`)
+	expectMessages(t, conn,
+		`{"timestamp":"2024-01-01T12:00:00Z","stream":"stderr","output":"bar err\n"}`,
+		`{"type":"end"}`,
+	)
+
+	sendControl(t, conn, `{"type":"switch","container":"unknown"}`)
+	expectMessages(t, conn, `{"type":"error","message":"container unknown not found"}`)
+
+	sendControl(t, conn, `{"type":"rewind"}`)
+	expectMessages(t, conn,
+		`{"type":"error","message":"invalid control message: unknown type \"rewind\""}`,
+	)
+}
+
+func TestLogsWebSocket_Resume(t *testing.T) {
+	testTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	svc := &fakeLogService{
+		containers: map[string][]log.Record{
+			"foo": {
+				{Timestamp: testTime, Stream: log.StreamTypeStdout, Log: "line 1\n"},
+				{Timestamp: testTime, Stream: log.StreamTypeStdout, Log: "line 2\n"},
+			},
+		},
+	}
+	srv := httptest.NewServer(api.NewHandler(context.Background(), "", svc, nil, nil))
+	defer srv.Close()
+
+	conn, err := websocket.Dial(
+		t.Context(),
+		"ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/logs/foo?stdout=1",
+	)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	expectMessages(t, conn,
+		`{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"line 1\n"}`,
+		`{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"line 2\n"}`,
+		`{"type":"end"}`,
+	)
+
+	// More records are emitted at the same time while the stream is paused.
+	sendControl(t, conn, `{"type":"pause"}`)
+	svc.append("foo",
+		log.Record{Timestamp: testTime, Stream: log.StreamTypeStdout, Log: "line 3\n"},
+		log.Record{
+			Timestamp: testTime.Add(time.Second),
+			Stream:    log.StreamTypeStdout,
+			Log:       "line 4\n",
+		},
+	)
+
+	sendControl(t, conn, `{"type":"resume"}`)
+	expectMessages(t, conn,
+		`{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"line 3\n"}`,
+		`{"timestamp":"2024-01-01T12:00:01Z","stream":"stdout","output":"line 4\n"}`,
+		`{"type":"end"}`,
+	)
+}
+
+func sendControl(t *testing.T, conn *websocket.Conn, msg string) {
+	t.Helper()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("failed to send control message: %v", err)
+	}
+}
+
+func expectMessages(t *testing.T, conn *websocket.Conn, want ...string) {
+	t.Helper()
+
+	for _, w := range want {
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if string(got) != w {
+			t.Errorf("expected message %s, got %s", w, got)
+		}
+	}
+}
+
+// fakeLogService returns the records of the containers satisfying the query as NDJSON.
+type fakeLogService struct {
+	mu         sync.Mutex
+	containers map[string][]log.Record
+}
+
+// append adds records to the logs of the container.
+func (f *fakeLogService) append(containerName string, recs ...log.Record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers[containerName] = append(f.containers[containerName], recs...)
+}
+
+func (f *fakeLogService) GetContainerLogs(
+	ctx context.Context,
+	query log.Query,
+) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	logs, ok := f.containers[query.ContainerName]
+	if !ok {
+		return nil, &log.ContainerNotFoundError{Name: query.ContainerName}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range logs {
+		if query.Includes(rec) {
+			if err := enc.Encode(rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return io.NopCloser(&buf), nil
+}
+
+func (f *fakeLogService) GetMergedContainerLogs(
+	ctx context.Context,
+	containerNames []string,
+	query log.Query,
+) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
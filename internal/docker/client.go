@@ -7,11 +7,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/containerd/errdefs"
 	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
 	"github.com/moby/moby/api/types/events"
 	"github.com/moby/moby/api/types/filters"
 	"github.com/moby/moby/client"
@@ -22,11 +27,19 @@ import (
 // Client is an adapter for the Docker Engine API client to our domain.
 type Client struct {
 	dockerClient *client.Client
+	logger       *slog.Logger
+
+	// invalidLabelsReported holds the IDs of the containers whose invalid labels
+	// were already reported, so that they are logged only once.
+	invalidLabelsReported sync.Map
 }
 
 // NewClient returns a new [Client] wrapping the given Docker Engine API client.
-func NewClient(dockerClient *client.Client) *Client {
-	return &Client{dockerClient}
+func NewClient(dockerClient *client.Client, logger *slog.Logger) *Client {
+	return &Client{
+		dockerClient: dockerClient,
+		logger:       logger,
+	}
 }
 
 // ListContainers fetches the list of all containers in Docker (docker ps -a).
@@ -38,29 +51,87 @@ func (c *Client) ListContainers(ctx context.Context) ([]log.Container, error) {
 
 	res := make([]log.Container, len(containers))
 	for i, ctr := range containers {
-		// Retrieve the container canonical name.
+		// Retrieve the container canonical name and details.
 		ctrInfo, err := c.dockerClient.ContainerInspect(ctx, ctr.ID)
 		if err != nil {
 			return nil, fmt.Errorf("inspect Docker container %s: %w", ctr.ID, err)
 		}
 
+		res[i] = c.containerFromInspect(ctrInfo)
+	}
+
+	return res, nil
+}
+
+// InspectContainer returns the details of the specified container.
+// If the container cannot be found it returns a [*log.ContainerNotFoundError].
+func (c *Client) InspectContainer(ctx context.Context, containerNameOrID string) (log.Container, error) {
+	ctrInfo, err := c.dockerClient.ContainerInspect(ctx, containerNameOrID)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return log.Container{}, &log.ContainerNotFoundError{
+				Name: containerNameOrID,
+				Err:  err,
+			}
+		}
+		return log.Container{}, fmt.Errorf("inspect Docker container: %w", err)
+	}
+
+	return c.containerFromInspect(ctrInfo), nil
+}
+
+func (c *Client) containerFromInspect(info container.InspectResponse) log.Container {
+	ctr := log.Container{
+		ID: info.ID,
 		// For historical reasons, container names are stored as paths.
-		containerName := strings.TrimPrefix(ctrInfo.Name, "/")
+		Name:      strings.TrimPrefix(info.Name, "/"),
+		CreatedAt: parseTime(info.Created),
+	}
+	if info.Config != nil {
+		ctr.TTY = info.Config.Tty
+		ctr.Image = info.Config.Image
+		ctr.Labels = info.Config.Labels
+	}
+	if info.State != nil {
+		ctr.State = string(info.State.Status)
+		ctr.StartedAt = parseTime(info.State.StartedAt)
+		ctr.FinishedAt = parseTime(info.State.FinishedAt)
+		ctr.ExitCode = info.State.ExitCode
+	}
 
-		res[i] = log.Container{
-			ID:   ctrInfo.ID,
-			Name: containerName,
-			TTY:  ctrInfo.Config.Tty,
+	// Invalid labels must not prevent the collection of the container logs.
+	settings, err := log.ParseContainerSettings(ctr.Labels)
+	if err != nil {
+		if _, reported := c.invalidLabelsReported.LoadOrStore(ctr.ID, true); !reported {
+			c.logger.Warn(
+				"Ignoring invalid container labels",
+				slog.Any("error", err),
+				slog.String("containerName", ctr.Name),
+			)
 		}
 	}
+	ctr.Settings = settings
 
-	return res, nil
+	return ctr
+}
+
+// parseTime parses a timestamp returned by the Docker Engine API.
+// Docker uses "0001-01-01T00:00:00Z" for unset timestamps, which
+// parses to the zero time as well.
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
 }
 
 // WatchContainers returns a stream of container lifecycle events (started, deleted)
 // that the caller can consume to be notified of container state changes.
+// If since is not zero, the events which occurred since that time are replayed first.
 func (c *Client) WatchContainers(
 	ctx context.Context,
+	since time.Time,
 ) (<-chan log.ContainerEvent, <-chan error) {
 	eventCh := make(chan log.ContainerEvent)
 	errCh := make(chan error, 1)
@@ -71,6 +142,7 @@ func (c *Client) WatchContainers(
 		filters.Arg("event", "destroy"),
 	)
 	messages, errs := c.dockerClient.Events(ctx, client.EventsListOptions{
+		Since:   formatTimestamp(since),
 		Filters: filters,
 	})
 
@@ -99,20 +171,22 @@ func (c *Client) WatchContainers(
 					continue
 				}
 
-				var tty bool
+				// Removed containers cannot be inspected anymore.
+				ctr := log.Container{
+					ID:    msg.Actor.ID,
+					Name:  msg.Actor.Attributes["name"],
+					Image: msg.Actor.Attributes["image"],
+				}
 				if info, err := c.dockerClient.ContainerInspect(ctx, msg.Actor.ID); err == nil { // NO ERROR
-					if info.Config != nil {
-						tty = info.Config.Tty
-					}
+					ctr = c.containerFromInspect(info)
+				} else if eventType == log.EventTypeRemoved {
+					c.invalidLabelsReported.Delete(msg.Actor.ID)
 				}
 
 				event := log.ContainerEvent{
-					Type: eventType,
-					Container: log.Container{
-						ID:   msg.Actor.ID,
-						Name: msg.Actor.Attributes["name"],
-						TTY:  tty,
-					},
+					Type:      eventType,
+					Container: ctr,
+					Time:      time.Unix(0, msg.TimeNano),
 				}
 
 				select {
@@ -141,6 +215,7 @@ func (c *Client) WatchContainers(
 }
 
 // StreamContainerLogs returns a filtered stream of logs from the specified Docker container.
+// The secrets matched by the container's [log.LabelRedact] label are redacted from the logs.
 // If the container cannot be found it returns a [*log.ContainerNotFoundError].
 func (c *Client) StreamContainerLogs(ctx context.Context, query log.Query) (io.ReadCloser, error) {
 	r, err := c.dockerClient.ContainerLogs(ctx, query.ContainerName, client.ContainerLogsOptions{
@@ -148,6 +223,9 @@ func (c *Client) StreamContainerLogs(ctx context.Context, query log.Query) (io.R
 		ShowStderr: query.IncludeStderr,
 		Timestamps: true,
 		Follow:     query.Follow,
+		Since:      formatTimestamp(query.Since),
+		Until:      formatTimestamp(query.Until),
+		Tail:       formatTail(query.Tail),
 	})
 	if err != nil {
 		if errdefs.IsNotFound(err) {
@@ -160,10 +238,13 @@ func (c *Client) StreamContainerLogs(ctx context.Context, query log.Query) (io.R
 	}
 
 	// If it is a TTY container, the log stream doesn't need to be demultiplexed.
-	isTTY, err := c.isTTY(ctx, query.ContainerName)
+	ctrInfo, err := c.dockerClient.ContainerInspect(ctx, query.ContainerName)
 	if err != nil {
-		return nil, fmt.Errorf("check if tty container: %w", err)
+		r.Close()
+		return nil, fmt.Errorf("inspect Docker container: %w", err)
 	}
+	ctr := c.containerFromInspect(ctrInfo)
+	redact := ctr.Settings.Redact
 
 	pr, pw := io.Pipe()
 
@@ -175,8 +256,8 @@ func (c *Client) StreamContainerLogs(ctx context.Context, query log.Query) (io.R
 		defer pw.Close()
 
 		var err error
-		if isTTY {
-			outW := newNDJSONWriter(pw, log.StreamTypeStdout)
+		if ctr.TTY {
+			outW := newNDJSONWriter(pw, log.StreamTypeStdout, redact)
 			_, err = io.Copy(outW, r)
 			if err != nil {
 				_ = pw.CloseWithError(err)
@@ -190,8 +271,8 @@ func (c *Client) StreamContainerLogs(ctx context.Context, query log.Query) (io.R
 			return
 		}
 
-		outW := newNDJSONWriter(pw, log.StreamTypeStdout)
-		errW := newNDJSONWriter(pw, log.StreamTypeStderr)
+		outW := newNDJSONWriter(pw, log.StreamTypeStdout, redact)
+		errW := newNDJSONWriter(pw, log.StreamTypeStderr, redact)
 		_, err = stdcopy.StdCopy(outW, errW, r)
 		if err != nil {
 			_ = pw.CloseWithError(err)
@@ -207,31 +288,39 @@ func (c *Client) StreamContainerLogs(ctx context.Context, query log.Query) (io.R
 	return pr, nil
 }
 
-func (c *Client) isTTY(ctx context.Context, containerName string) (bool, error) {
-	containerInfo, err := c.dockerClient.ContainerInspect(ctx, containerName)
-	if err != nil {
-		return false, fmt.Errorf("inspect Docker container: %w", err)
+// formatTimestamp formats t as a Unix timestamp with nanosecond precision
+// as expected by the Docker Engine API. It returns an empty string if t is zero.
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
 
-	if containerInfo.Config == nil {
-		return false, fmt.Errorf("container %s has no config", containerName)
+// formatTail formats the number of lines to show from the end of the logs
+// as expected by the Docker Engine API.
+func formatTail(tail *int) string {
+	if tail == nil {
+		return "all"
 	}
-
-	return containerInfo.Config.Tty, nil
+	return strconv.Itoa(*tail)
 }
 
 type ndjsonWriter struct {
 	stream  log.StreamType
 	encoder *json.Encoder
 	buf     bytes.Buffer
+	// redact, if not nil, matches the text to redact from the logs.
+	redact *regexp.Regexp
 }
 
-func newNDJSONWriter(w io.Writer, stream log.StreamType) *ndjsonWriter {
+func newNDJSONWriter(w io.Writer, stream log.StreamType, redact *regexp.Regexp) *ndjsonWriter {
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false)
 	return &ndjsonWriter{
 		stream:  stream,
 		encoder: enc,
+		redact:  redact,
 	}
 }
 
@@ -275,10 +364,15 @@ func (w *ndjsonWriter) emit(line []byte) error {
 		}
 	}
 
+	text := string(line)
+	if w.redact != nil {
+		text = w.redact.ReplaceAllLiteralString(text, log.RedactedText)
+	}
+
 	rec := log.Record{
 		Timestamp: ts,
 		Stream:    w.stream,
-		Log:       string(line),
+		Log:       text,
 	}
 	return w.encoder.Encode(&rec)
 }
@@ -0,0 +1,179 @@
+package filesystem
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// compressedExt is the extension appended to the name of the compressed segments.
+const compressedExt = ".gz"
+
+// segmentHeader is stored in the comment of the gzip header of the compressed segments
+// so that their time range is known without decompressing them.
+type segmentHeader struct {
+	First time.Time `json:"first,omitzero"`
+	Last  time.Time `json:"last,omitzero"`
+}
+
+func parseSegmentHeader(h gzip.Header) (first, last time.Time, err error) {
+	var sh segmentHeader
+	if err := json.Unmarshal([]byte(h.Comment), &sh); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("decode compressed segment header: %w", err)
+	}
+	return sh.First, sh.Last, nil
+}
+
+// compressSegment replaces the sealed segment with its gzip-compressed version.
+// The compressed segment keeps the modification time of the segment.
+// It does nothing if the segment is already being compressed.
+func (ls *LogStorage) compressSegment(seg segment) error {
+	if _, ok := ls.compressing.LoadOrStore(seg.path, struct{}{}); ok {
+		return nil
+	}
+	defer ls.compressing.Delete(seg.path)
+
+	f, err := os.Open(seg.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// The segment has been removed in the meantime.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("open log segment: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat log segment: %w", err)
+	}
+	first, last, err := segmentFile{File: f}.timeRange()
+	if err != nil {
+		return err
+	}
+	header, err := json.Marshal(segmentHeader{First: first, Last: last})
+	if err != nil {
+		return fmt.Errorf("encode compressed segment header: %w", err)
+	}
+
+	compressedPath := seg.path + compressedExt
+	tmpPath := compressedPath + ".tmp"
+	if err := writeCompressed(tmpPath, f, gzip.Header{
+		Name:    filepath.Base(seg.path),
+		ModTime: info.ModTime(),
+		Comment: string(header),
+	}); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("set compressed segment modification time: %w", err)
+	}
+
+	ls.segmentsMu.Lock()
+	defer ls.segmentsMu.Unlock()
+
+	// The readers which opened the segment keep reading the uncompressed one.
+	if _, err := os.Stat(seg.path); errors.Is(err, os.ErrNotExist) {
+		os.Remove(tmpPath)
+		return nil
+	}
+	if err := os.Rename(tmpPath, compressedPath); err != nil {
+		return fmt.Errorf("rename compressed segment: %w", err)
+	}
+	// The compressed segments are not indexed.
+	if err := removeSegmentFiles(seg.path); err != nil {
+		return fmt.Errorf("remove uncompressed segment: %w", err)
+	}
+
+	return nil
+}
+
+func writeCompressed(path string, r io.Reader, header gzip.Header) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return fmt.Errorf("create compressed segment: %w", err)
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	zw.Header = header
+	if _, err := io.Copy(zw, r); err != nil {
+		return fmt.Errorf("compress log segment: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("compress log segment: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("close compressed segment: %w", err)
+	}
+	return nil
+}
+
+// compressSealedSegments compresses the sealed segments of the container which are not
+// compressed yet, e.g. because compressing them after the rotation failed.
+// It returns the number of segments compressed.
+func (ls *LogStorage) compressSealedSegments(containerID string) (int, error) {
+	ls.segmentsMu.RLock()
+	segments, err := ls.sealedSegments(containerID)
+	ls.segmentsMu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, seg := range segments {
+		if seg.compressed {
+			continue
+		}
+		if err := ls.compressSegment(seg); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// sealRemovedContainer seals the active segment of a removed container so that
+// it can be compressed. It returns false if the active segment is empty or being written.
+func (ls *LogStorage) sealRemovedContainer(containerID string) (bool, error) {
+	ls.segmentsMu.Lock()
+	defer ls.segmentsMu.Unlock()
+
+	if ls.isBeingWritten(containerID) {
+		return false, nil
+	}
+
+	activePath := ls.logFilePath(containerID)
+	active, err := os.Open(activePath)
+	if err != nil {
+		return false, fmt.Errorf("open log file: %w", err)
+	}
+	info, err := active.Stat()
+	if err != nil {
+		active.Close()
+		return false, fmt.Errorf("stat log file: %w", err)
+	}
+	if info.Size() == 0 {
+		active.Close()
+		return false, nil
+	}
+
+	_, f, err := ls.rotateActiveSegment(containerID, active)
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+
+	// Keep the modification time of the logs for the retention limits.
+	if err := os.Chtimes(activePath, info.ModTime(), info.ModTime()); err != nil {
+		return false, fmt.Errorf("set log file modification time: %w", err)
+	}
+
+	return true, nil
+}
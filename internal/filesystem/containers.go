@@ -0,0 +1,214 @@
+package filesystem
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+// ListStoredContainers returns the containers whose logs are stored along with
+// the size and time range of their logs.
+func (ls *LogStorage) ListStoredContainers() ([]log.StoredContainer, error) {
+	var (
+		res []log.StoredContainer
+		err error
+	)
+	ls.metadataByID.Range(func(_, v any) bool {
+		stored, statErr := ls.storedContainer(v.(metadata))
+		if errors.Is(statErr, os.ErrNotExist) {
+			// The container directory has been removed in the meantime.
+			return true
+		} else if statErr != nil {
+			err = statErr
+			return false
+		}
+
+		res = append(res, stored)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetStoredContainer returns the specified container along with the size and
+// time range of its logs. The containerNameOrID parameter accepts either a
+// container name or ID.
+//
+// Returns [*log.ContainerNotFoundError] if the container cannot be found.
+func (ls *LogStorage) GetStoredContainer(containerNameOrID string) (log.StoredContainer, error) {
+	md, err := ls.lookupMetadata(containerNameOrID)
+	if err != nil {
+		return log.StoredContainer{}, err
+	}
+
+	stored, err := ls.storedContainer(md)
+	if errors.Is(err, os.ErrNotExist) {
+		return log.StoredContainer{}, &log.ContainerNotFoundError{
+			Name: containerNameOrID,
+			Err:  err,
+		}
+	} else if err != nil {
+		return log.StoredContainer{}, err
+	}
+
+	return stored, nil
+}
+
+// ListRuns returns the runs of the container recorded while collecting its logs,
+// from the oldest to the latest. The containerNameOrID parameter accepts either
+// a container name or ID.
+//
+// Returns [*log.ContainerNotFoundError] if the container cannot be found.
+func (ls *LogStorage) ListRuns(containerNameOrID string) ([]log.Run, error) {
+	md, err := ls.lookupMetadata(containerNameOrID)
+	if err != nil {
+		return nil, err
+	}
+	return md.Runs, nil
+}
+
+// lookupMetadata returns the metadata of the container specified by name or ID.
+func (ls *LogStorage) lookupMetadata(containerNameOrID string) (metadata, error) {
+	v, found := ls.metadataByID.Load(containerNameOrID)
+	if !found {
+		id, found := ls.containerIDByName.Load(containerNameOrID)
+		if found {
+			v, found = ls.metadataByID.Load(id)
+		}
+		if !found {
+			return metadata{}, &log.ContainerNotFoundError{Name: containerNameOrID}
+		}
+	}
+	return v.(metadata), nil
+}
+
+func (ls *LogStorage) storedContainer(md metadata) (log.StoredContainer, error) {
+	files, err := ls.openSegments(md.ID)
+	if err != nil {
+		return log.StoredContainer{}, err
+	}
+	defer closeFiles(files)
+
+	var size int64
+	for _, f := range files {
+		info, err := f.Stat()
+		if err != nil {
+			return log.StoredContainer{}, fmt.Errorf("stat log file: %w", err)
+		}
+		size += info.Size()
+	}
+
+	first, last, err := logTimeRange(files)
+	if err != nil {
+		return log.StoredContainer{}, err
+	}
+
+	return log.StoredContainer{
+		Container:  md.Container,
+		LogSize:    size,
+		FirstLogAt: first,
+		LastLogAt:  last,
+		Runs:       md.Runs,
+	}, nil
+}
+
+// logTimeRange returns the timestamps of the first and last records of the log segments.
+func logTimeRange(files []segmentFile) (first, last time.Time, err error) {
+	for _, f := range files {
+		first, _, err = f.timeRange()
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if !first.IsZero() {
+			break
+		}
+	}
+
+	last, err = lastRecordTime(files)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return first, last, nil
+}
+
+// firstRecordTime returns the timestamp of the first valid record read from r,
+// or the zero time if there is none.
+func firstRecordTime(r io.Reader) (time.Time, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxRecordSize)
+	for sc.Scan() {
+		var rec log.Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err == nil {
+			return rec.Timestamp, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("read log file: %w", err)
+	}
+	return time.Time{}, nil
+}
+
+// lastRecordTime returns the timestamp of the last valid record of the log segments,
+// or the zero time if there is none. Compressed segments are not decompressed.
+func lastRecordTime(files []segmentFile) (time.Time, error) {
+	for _, f := range slices.Backward(files) {
+		if f.compressed {
+			_, last, err := f.timeRange()
+			if err != nil || !last.IsZero() {
+				return last, err
+			}
+			continue
+		}
+
+		sr, err := f.section()
+		if err != nil {
+			return time.Time{}, err
+		}
+		data, err := tailFile(sr, 1, func(line []byte) bool {
+			var rec log.Record
+			return json.Unmarshal(line, &rec) == nil
+		})
+		if err != nil {
+			return time.Time{}, fmt.Errorf("tail log file: %w", err)
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		var rec log.Record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return time.Time{}, fmt.Errorf("decode log record: %w", err)
+		}
+		return rec.Timestamp, nil
+	}
+
+	return time.Time{}, nil
+}
+
+// countRecordsAt returns the number of valid records of the NDJSON stream emitted at t.
+func countRecordsAt(r io.Reader, t time.Time) (int, error) {
+	var n int
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxRecordSize)
+	for sc.Scan() {
+		var rec log.Record
+		if json.Unmarshal(sc.Bytes(), &rec) == nil && rec.Timestamp.Equal(t) {
+			n++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("read file: %w", err)
+	}
+	return n, nil
+}
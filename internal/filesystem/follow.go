@@ -0,0 +1,247 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+// followPollInterval is the interval at which a followed container is checked for new logs.
+const followPollInterval = 250 * time.Millisecond
+
+// followReader reads the stored logs of a container and then the records appended to
+// them while they are being written, following the rotations of the active segment.
+// It reaches the end of the logs once they are not written anymore or it is closed.
+//
+// If untilClosed is set, it keeps waiting for the records appended to the logs until it is
+// closed instead, e.g. while the container is stopped and may start again. If catchUp is
+// set, it does not wait for them but returns [io.EOF] each time it reads all the logs
+// written so far, reading the records appended meanwhile once read again.
+type followReader struct {
+	ls          *LogStorage
+	containerID string
+	untilClosed bool
+	catchUp     bool
+
+	// r reads the logs preceding the active segment which are not read yet, if any.
+	r io.Reader
+	// sealed are the segments sealed after the active segment was opened, if it was
+	// rotated several times meanwhile, which are not read yet.
+	sealed []segmentFile
+	// active is the active segment when it was opened, read from offset.
+	active segmentFile
+	offset int64
+	// pos is the position following the last byte read from the segments.
+	pos log.Position
+	// rotated indicates whether the active segment has been sealed since it was opened.
+	rotated bool
+	// stopping indicates whether the logs were not written anymore the last
+	// time the end of the active segment was reached.
+	stopping bool
+
+	// mu guards files and closed.
+	mu sync.Mutex
+	// files are the open segments.
+	files  []segmentFile
+	closed bool
+	done   chan struct{}
+}
+
+// newFollowReader returns a [followReader] reading r and then the active segment from
+// offset. It takes ownership of the files, the last of which must be the active segment.
+func newFollowReader(
+	ls *LogStorage,
+	containerID string,
+	r io.Reader,
+	files []segmentFile,
+	offset int64,
+	untilClosed bool,
+) *followReader {
+	return &followReader{
+		ls:          ls,
+		containerID: containerID,
+		untilClosed: untilClosed,
+		r:           r,
+		active:      files[len(files)-1],
+		offset:      offset,
+		pos:         log.Position{Segment: int64(files[len(files)-1].seq), Offset: offset},
+		files:       files,
+		done:        make(chan struct{}),
+	}
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		if r.r == nil && len(r.sealed) > 0 {
+			seg := r.sealed[0]
+			sr, err := seg.reader()
+			if err != nil {
+				return 0, r.readErr(err)
+			}
+			r.r = sr
+			r.pos = log.Position{Segment: int64(seg.seq)}
+			r.sealed = r.sealed[1:]
+		}
+		if r.r != nil {
+			n, err := r.r.Read(p)
+			r.pos.Offset += int64(n)
+			if errors.Is(err, io.EOF) {
+				r.r = nil
+			} else if err != nil {
+				return n, r.readErr(err)
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		n, err := r.active.ReadAt(p, r.offset)
+		r.offset += int64(n)
+		r.pos = log.Position{Segment: int64(r.active.seq), Offset: r.offset}
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, r.readErr(err)
+		}
+
+		// All the logs written so far have been read.
+		if r.rotated {
+			if err := r.openNextSegments(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		rotated, writing, err := r.checkActiveSegment()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case rotated:
+			// Read the end of the sealed segment first.
+			r.rotated = true
+			continue
+		case !writing && r.stopping:
+			return 0, io.EOF
+		case r.catchUp:
+			return 0, io.EOF
+		}
+		// Read the logs written before the writer was closed, if any.
+		r.stopping = !writing && !r.untilClosed
+		if r.stopping {
+			continue
+		}
+
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		case <-time.After(followPollInterval):
+		}
+	}
+}
+
+// Position returns the position following the last byte read from the segments.
+// It is only known once the logs preceding the active segment when opened are read.
+func (r *followReader) Position() log.Position {
+	return r.pos
+}
+
+// readErr returns err, or [io.EOF] if the error results from closing the reader.
+func (r *followReader) readErr(err error) error {
+	select {
+	case <-r.done:
+		return io.EOF
+	default:
+		return err
+	}
+}
+
+// checkActiveSegment reports whether the active segment opened has been sealed
+// and whether the container logs are still being written.
+func (r *followReader) checkActiveSegment() (rotated, writing bool, err error) {
+	r.ls.segmentsMu.RLock()
+	defer r.ls.segmentsMu.RUnlock()
+
+	path := r.ls.logFilePath(r.containerID)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		// The container logs have been removed.
+		return false, false, nil
+	} else if err != nil {
+		return false, false, fmt.Errorf("stat log file: %w", err)
+	}
+
+	return !isOpenedFrom(r.active.File, path), r.ls.isBeingWritten(r.containerID), nil
+}
+
+// openNextSegments replaces the segments read with the segments sealed after the
+// active one, if it was rotated several times meanwhile, and the new active segment.
+func (r *followReader) openNextSegments() error {
+	r.ls.segmentsMu.RLock()
+	defer r.ls.segmentsMu.RUnlock()
+
+	segments, err := r.ls.sealedSegments(r.containerID)
+	if err != nil {
+		return err
+	}
+	// The sequence numbers are not reused, so the segments sealed after the active one
+	// have greater ones, even if the segments sealed before were removed meanwhile.
+	var missed []segment
+	for _, seg := range segments {
+		if seg.seq > r.active.seq {
+			missed = append(missed, seg)
+		}
+	}
+
+	files, err := openSealedSegments(missed)
+	if err != nil {
+		return err
+	}
+	active, err := os.Open(r.ls.logFilePath(r.containerID))
+	if err != nil {
+		closeFiles(files)
+		return fmt.Errorf("open log file: %w", err)
+	}
+	files = append(files, segmentFile{
+		File:   active,
+		seq:    r.ls.nextSeq(r.containerID, segments),
+		active: true,
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		closeFiles(files)
+		return io.EOF
+	}
+	closeFiles(r.files)
+	r.files = files
+
+	r.sealed = files[:len(files)-1]
+	r.active = files[len(files)-1]
+	r.offset = 0
+	r.rotated = false
+	return nil
+}
+
+func (r *followReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+
+	var errs []error
+	for _, f := range r.files {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
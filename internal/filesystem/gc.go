@@ -0,0 +1,421 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+// defaultGCInterval is the default interval between two garbage collections.
+const defaultGCInterval = 10 * time.Minute
+
+// RetentionOptions define when the stored logs are deleted by the [GarbageCollector].
+// The zero value of a limit disables it.
+type RetentionOptions struct {
+	// MaxAge is the maximum time the logs of a container are kept after the last write.
+	MaxAge time.Duration
+
+	// MaxAgeAfterRemoval is the maximum time the logs of a container are kept
+	// after the container was removed from Docker.
+	MaxAgeAfterRemoval time.Duration
+
+	// MaxTotalSize is the total size in bytes of the stored logs. Once exceeded,
+	// the oldest log segments of all the containers are deleted first.
+	MaxTotalSize int64
+
+	// Interval is the interval between two garbage collections.
+	// Defaults to 10 minutes.
+	Interval time.Duration
+
+	// DryRun only logs the logs which would be deleted, without deleting them.
+	DryRun bool
+}
+
+// GarbageCollector periodically deletes the stored logs exceeding the retention limits.
+// It also deletes the logs older than the retention period set by the container labels.
+type GarbageCollector struct {
+	storage *LogStorage
+	logger  *slog.Logger
+	options RetentionOptions
+}
+
+// NewGarbageCollector creates a new [GarbageCollector] of the logs stored in the storage.
+func NewGarbageCollector(
+	storage *LogStorage,
+	logger *slog.Logger,
+	opts RetentionOptions,
+) *GarbageCollector {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultGCInterval
+	}
+	return &GarbageCollector{
+		storage: storage,
+		logger:  logger,
+		options: opts,
+	}
+}
+
+// Run collects the garbage right away and then periodically until the context is canceled.
+func (gc *GarbageCollector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(gc.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := gc.Collect(time.Now()); err != nil {
+			// Retry at the next collection.
+			gc.logger.Error("Failed to collect stored logs garbage", slog.Any("error", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// storedFile is a log segment considered for deletion.
+type storedFile struct {
+	container metadata
+	path      string
+	size      int64
+	modTime   time.Time
+	// active indicates whether it is the segment the logs are appended to.
+	active bool
+}
+
+// Collect deletes the stored logs exceeding the retention limits at the given time.
+// It also compresses the segments which are not compressed yet, as configured by
+// [LogStorageOptions.Compress] and [LogStorageOptions.CompressRemoved].
+//
+// The logs of a container are deleted entirely, including its metadata, when they
+// expired or when the disk budget requires to delete the segment being written.
+// The logs of the containers being collected are never deleted entirely.
+func (gc *GarbageCollector) Collect(now time.Time) error {
+	var containers []metadata
+	gc.storage.metadataByID.Range(func(_, v any) bool {
+		containers = append(containers, v.(metadata))
+		return true
+	})
+
+	var (
+		files []storedFile
+		errs  []error
+	)
+	for _, md := range containers {
+		segments, err := gc.storage.listSegmentFiles(md)
+		if errors.Is(err, os.ErrNotExist) {
+			// The container directory has been removed in the meantime.
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		remaining, err := gc.collectContainer(md, segments, now)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if len(remaining) > 0 {
+			compressed, err := gc.compressContainer(md)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if compressed {
+				// The compressed segments are smaller and renamed.
+				remaining, err = gc.storage.listSegmentFiles(md)
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		files = append(files, remaining...)
+	}
+
+	if err := gc.enforceDiskBudget(files); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// collectContainer deletes the expired logs of the container and returns its remaining segments.
+func (gc *GarbageCollector) collectContainer(
+	md metadata,
+	segments []storedFile,
+	now time.Time,
+) ([]storedFile, error) {
+	var lastWrite time.Time
+	for _, f := range segments {
+		if f.modTime.After(lastWrite) {
+			lastWrite = f.modTime
+		}
+	}
+
+	switch {
+	case gc.options.MaxAgeAfterRemoval > 0 && !md.RemovedAt.IsZero() &&
+		now.Sub(md.RemovedAt) > gc.options.MaxAgeAfterRemoval:
+		return gc.removeContainer(md, segments, "removed from Docker "+
+			now.Sub(md.RemovedAt).Round(time.Second).String()+" ago")
+
+	case gc.options.MaxAge > 0 && now.Sub(lastWrite) > gc.options.MaxAge:
+		return gc.removeContainer(md, segments, "last written "+
+			now.Sub(lastWrite).Round(time.Second).String()+" ago")
+	}
+
+	// The container labels may set a shorter retention for its logs.
+	retention := md.Settings.Retention
+	if retention <= 0 {
+		return segments, nil
+	}
+	if now.Sub(lastWrite) > retention {
+		return gc.removeContainer(md, segments, "retention period of "+retention.String()+" elapsed")
+	}
+
+	var remaining []storedFile
+	for _, f := range segments {
+		if f.active || now.Sub(f.modTime) <= retention {
+			remaining = append(remaining, f)
+			continue
+		}
+		if err := gc.removeSegment(f, "retention period of "+retention.String()+" elapsed"); err != nil {
+			return append(remaining, f), err
+		}
+	}
+	return remaining, nil
+}
+
+// compressContainer compresses the sealed segments of the container which are not compressed
+// yet and, if enabled, the logs of the container once removed from Docker.
+// It reports whether any segment was compressed.
+func (gc *GarbageCollector) compressContainer(md metadata) (bool, error) {
+	opts := gc.storage.options
+	removed := opts.CompressRemoved && !md.RemovedAt.IsZero()
+	if !opts.Compress && !removed {
+		return false, nil
+	}
+
+	if removed {
+		if ok, err := gc.storage.sealRemovedContainer(md.ID); err != nil {
+			return false, fmt.Errorf("seal logs of removed container %s: %w", md.Name, err)
+		} else if ok {
+			gc.logger.Info(
+				"Compressing logs of removed container",
+				slog.String("containerName", md.Name),
+				slog.String("containerId", md.ID),
+			)
+		}
+	}
+
+	n, err := gc.storage.compressSealedSegments(md.ID)
+	if err != nil {
+		return n > 0, fmt.Errorf("compress log segments of container %s: %w", md.Name, err)
+	}
+	return n > 0, nil
+}
+
+// enforceDiskBudget deletes the oldest segments until the total size of the stored
+// logs fits the disk budget.
+func (gc *GarbageCollector) enforceDiskBudget(files []storedFile) error {
+	if gc.options.MaxTotalSize <= 0 {
+		return nil
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	slices.SortFunc(files, func(a, b storedFile) int { return a.modTime.Compare(b.modTime) })
+
+	// Paths of the segments deleted so far, which are not counted anymore.
+	deleted := make(map[string]bool)
+	for _, f := range files {
+		if total <= gc.options.MaxTotalSize {
+			break
+		}
+		if deleted[f.path] {
+			continue
+		}
+
+		if !f.active {
+			if err := gc.removeSegment(f, "disk budget exceeded"); err != nil {
+				return err
+			}
+			deleted[f.path] = true
+			total -= f.size
+			continue
+		}
+
+		// Deleting the segment being written means deleting all the container logs.
+		var segments []storedFile
+		for _, other := range files {
+			if other.container.ID == f.container.ID && !deleted[other.path] {
+				segments = append(segments, other)
+			}
+		}
+		remaining, err := gc.removeContainer(f.container, segments, "disk budget exceeded")
+		if err != nil {
+			return err
+		}
+		if remaining == nil {
+			for _, other := range segments {
+				deleted[other.path] = true
+				total -= other.size
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeContainer deletes all the logs of the container, unless they are being collected.
+// It returns the remaining segments of the container.
+func (gc *GarbageCollector) removeContainer(
+	md metadata,
+	segments []storedFile,
+	reason string,
+) ([]storedFile, error) {
+	var size int64
+	for _, f := range segments {
+		size += f.size
+	}
+	attrs := []any{
+		slog.String("containerName", md.Name),
+		slog.String("containerId", md.ID),
+		slog.String("reason", reason),
+		slog.Int64("size", size),
+	}
+
+	if gc.options.DryRun {
+		gc.logger.Info("Dry run: would remove stored container logs", attrs...)
+		return nil, nil
+	}
+
+	removed, err := gc.storage.removeContainer(md)
+	if err != nil {
+		return segments, fmt.Errorf("remove logs of container %s: %w", md.Name, err)
+	}
+	if !removed {
+		gc.logger.Debug("Not removing the logs of a container being collected", attrs...)
+		return segments, nil
+	}
+
+	gc.logger.Info("Removed stored container logs", attrs...)
+	return nil, nil
+}
+
+// removeSegment deletes a sealed segment.
+func (gc *GarbageCollector) removeSegment(f storedFile, reason string) error {
+	attrs := []any{
+		slog.String("containerName", f.container.Name),
+		slog.String("containerId", f.container.ID),
+		slog.String("path", f.path),
+		slog.String("reason", reason),
+		slog.Int64("size", f.size),
+	}
+
+	if gc.options.DryRun {
+		gc.logger.Info("Dry run: would remove log segment", attrs...)
+		return nil
+	}
+
+	if err := gc.storage.removeSegment(f.path); err != nil {
+		return fmt.Errorf("remove log segment of container %s: %w", f.container.Name, err)
+	}
+
+	gc.logger.Info("Removed log segment", attrs...)
+	return nil
+}
+
+// listSegmentFiles returns the segments of the container from the oldest to the active one.
+func (ls *LogStorage) listSegmentFiles(md metadata) ([]storedFile, error) {
+	ls.segmentsMu.RLock()
+	defer ls.segmentsMu.RUnlock()
+
+	segments, err := ls.sealedSegments(md.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []storedFile
+	stat := func(path string, active bool) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, storedFile{
+			container: md,
+			path:      path,
+			size:      info.Size(),
+			modTime:   info.ModTime(),
+			active:    active,
+		})
+		return nil
+	}
+	for _, seg := range segments {
+		if err := stat(seg.path, false); err != nil {
+			return nil, fmt.Errorf("stat log segment: %w", err)
+		}
+	}
+	if err := stat(ls.logFilePath(md.ID), true); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("stat log file: %w", err)
+	}
+
+	return files, nil
+}
+
+// removeSegment deletes a sealed segment.
+func (ls *LogStorage) removeSegment(path string) error {
+	ls.segmentsMu.Lock()
+	defer ls.segmentsMu.Unlock()
+
+	if err := removeSegmentFiles(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeContainer deletes the logs and metadata of the container, and forgets it.
+// It returns false without deleting anything if the container logs are being written.
+func (ls *LogStorage) removeContainer(md metadata) (bool, error) {
+	ls.segmentsMu.Lock()
+	defer ls.segmentsMu.Unlock()
+
+	if ls.isBeingWritten(md.ID) {
+		return false, nil
+	}
+
+	if err := os.RemoveAll(ls.containerDirPath(md.ID)); err != nil {
+		return false, err
+	}
+	// The sequence number of its last segment is kept in lastSeqs, in case the logs
+	// were being followed and the container is collected again.
+
+	ls.metadataMu.Lock()
+	defer ls.metadataMu.Unlock()
+
+	ls.metadataByID.Delete(md.ID)
+	if ls.containerIDByName.CompareAndDelete(md.Name, md.ID) {
+		// The name now refers to the latest other container stored with it, if any.
+		var latest *metadata
+		ls.metadataByID.Range(func(_, v any) bool {
+			other := v.(metadata)
+			if other.Name == md.Name && (latest == nil || other.CreatedAt.After(latest.CreatedAt)) {
+				latest = &other
+			}
+			return true
+		})
+		if latest != nil {
+			ls.containerIDByName.Store(latest.Name, latest.ID)
+		}
+	}
+
+	return true, nil
+}
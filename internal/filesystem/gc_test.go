@@ -0,0 +1,369 @@
+package filesystem_test
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/filesystem"
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestGarbageCollector_Collect(t *testing.T) {
+	now := time.Now()
+	logger := slog.New(slog.DiscardHandler)
+	record := `{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"hello\n"}` + "\n"
+
+	t.Run("removes containers not written for too long", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		old := log.Container{ID: "old123", Name: "old"}
+		recent := log.Container{ID: "new456", Name: "recent"}
+		writeLogs(t, storage, old, record)
+		writeLogs(t, storage, recent, record)
+		setModTime(t, root, old.ID, now.Add(-48*time.Hour))
+
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+			MaxAge: 24 * time.Hour,
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertRemoved(t, storage, root, old)
+		assertStored(t, storage, root, recent)
+	})
+
+	t.Run("keeps containers being collected", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		ctr := log.Container{ID: "abc123", Name: "foo"}
+		w, err := storage.Create(ctr)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		defer w.Close()
+		setModTime(t, root, ctr.ID, now.Add(-48*time.Hour))
+
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+			MaxAge: 24 * time.Hour,
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertStored(t, storage, root, ctr)
+	})
+
+	t.Run("removes containers removed from Docker for too long", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		removed := log.Container{ID: "abc123", Name: "removed"}
+		recentlyRemoved := log.Container{ID: "def456", Name: "recently-removed"}
+		writeLogs(t, storage, removed, record)
+		writeLogs(t, storage, recentlyRemoved, record)
+		if err := storage.MarkRemoved(removed.ID, now.Add(-2*time.Hour)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := storage.MarkRemoved(recentlyRemoved.ID, now.Add(-time.Minute)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The removal time is kept across restarts.
+		reloaded := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		if err := reloaded.LoadExistingMappings(); err != nil {
+			t.Fatalf("failed to load mappings: %v", err)
+		}
+
+		gc := filesystem.NewGarbageCollector(reloaded, logger, filesystem.RetentionOptions{
+			MaxAgeAfterRemoval: time.Hour,
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertRemoved(t, reloaded, root, removed)
+		assertStored(t, reloaded, root, recentlyRemoved)
+	})
+
+	t.Run("removes containers removed while the proxy was stopped", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		removed := log.Container{ID: "abc123", Name: "removed"}
+		existing := log.Container{ID: "def456", Name: "existing"}
+		recentlyRemoved := log.Container{ID: "ghi789", Name: "recently-removed"}
+		writeLogs(t, storage, removed, record)
+		writeLogs(t, storage, existing, record)
+		writeLogs(t, storage, recentlyRemoved, record)
+		setModTime(t, root, removed.ID, now.Add(-2*time.Hour))
+		setModTime(t, root, existing.ID, now.Add(-2*time.Hour))
+
+		reloaded := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		if err := reloaded.LoadExistingMappings(); err != nil {
+			t.Fatalf("failed to load mappings: %v", err)
+		}
+		// The removal time is the time of the last write.
+		if err := reloaded.MarkRemovedExcept([]string{existing.ID}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		gc := filesystem.NewGarbageCollector(reloaded, logger, filesystem.RetentionOptions{
+			MaxAgeAfterRemoval: time.Hour,
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertRemoved(t, reloaded, root, removed)
+		assertStored(t, reloaded, root, existing)
+		assertStored(t, reloaded, root, recentlyRemoved)
+	})
+
+	t.Run("compresses the logs of removed containers", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{
+			CompressRemoved: true,
+		})
+		removed := log.Container{ID: "abc123", Name: "removed"}
+		running := log.Container{ID: "def456", Name: "running"}
+		writeLogs(t, storage, removed, record)
+		writeLogs(t, storage, running, record)
+		if err := storage.MarkRemoved(removed.ID, now.Add(-time.Minute)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, tc := range []struct {
+			ctr  log.Container
+			want int
+		}{
+			{ctr: removed, want: 1},
+			{ctr: running, want: 0},
+		} {
+			compressed, err := filepath.Glob(filepath.Join(root, tc.ctr.ID, "*.gz"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(compressed) != tc.want {
+				t.Errorf("expected %d compressed segments for %s, got %v",
+					tc.want, tc.ctr.Name, compressed)
+			}
+			if got := readStoredLogs(t, storage, tc.ctr.Name); got != record {
+				t.Errorf("expected %q, got %q", record, got)
+			}
+		}
+	})
+
+	t.Run("evicts the oldest segments beyond the disk budget", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{
+			MaxSegmentSize: int64(len(record)),
+		})
+		oldest := log.Container{ID: "abc123", Name: "oldest"}
+		newest := log.Container{ID: "def456", Name: "newest"}
+		writeLogs(t, storage, oldest, record)
+		writeLogs(t, storage, newest, record+record)
+		setModTime(t, root, oldest.ID, now.Add(-2*time.Hour))
+		setModTime(t, root, newest.ID, now.Add(-time.Hour))
+
+		// Only the 2 records of the newest container fit.
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+			MaxTotalSize: int64(2 * len(record)),
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if got := readStoredLogs(t, storage, oldest.Name); got != "" {
+			t.Errorf("expected the logs of the oldest container to be evicted, got %q", got)
+		}
+		if got := readStoredLogs(t, storage, newest.Name); got != record+record {
+			t.Errorf("expected %q, got %q", record+record, got)
+		}
+	})
+
+	t.Run("removes the oldest containers beyond the disk budget", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		oldest := log.Container{ID: "abc123", Name: "oldest"}
+		newest := log.Container{ID: "def456", Name: "newest"}
+		writeLogs(t, storage, oldest, record)
+		writeLogs(t, storage, newest, record)
+		setModTime(t, root, oldest.ID, now.Add(-2*time.Hour))
+
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+			MaxTotalSize: int64(len(record)),
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertRemoved(t, storage, root, oldest)
+		assertStored(t, storage, root, newest)
+	})
+
+	t.Run("counts the segments of the removed containers once", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{
+			MaxSegmentSize: int64(len(record)),
+		})
+		oldest := log.Container{ID: "abc123", Name: "oldest"}
+		newest := log.Container{ID: "def456", Name: "newest"}
+		second := strings.ReplaceAll(record, "hello", "world")
+		writeLogs(t, storage, oldest, record+record)
+		writeLogs(t, storage, newest, record+second)
+		// The segments of each container share their modification time.
+		setModTime(t, root, oldest.ID, now.Add(-2*time.Hour))
+		setModTime(t, root, newest.ID, now.Add(-time.Hour))
+
+		// Only the last record of the newest container fits.
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+			MaxTotalSize: int64(len(record)),
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertRemoved(t, storage, root, oldest)
+		if got := readStoredLogs(t, storage, newest.Name); got != second {
+			t.Errorf("expected %q, got %q", second, got)
+		}
+	})
+
+	t.Run("removes the segments older than the container retention", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{
+			MaxSegmentSize: int64(len(record)),
+		})
+		ctr := log.Container{
+			ID:     "abc123",
+			Name:   "foo",
+			Labels: map[string]string{"logproxy.retention": "1h"},
+		}
+		ctr.Settings, _ = log.ParseContainerSettings(ctr.Labels)
+		// The records must be recent, otherwise the storage does not return them.
+		recent := strings.Replace(record, "2024-01-01T12:00:00Z", now.UTC().Format(time.RFC3339), 1)
+		writeLogs(t, storage, ctr, recent)
+		setModTime(t, root, ctr.ID, now.Add(-2*time.Hour))
+		writeLogs(t, storage, ctr, strings.ReplaceAll(recent, "hello", "world"))
+
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		want := strings.ReplaceAll(recent, "hello", "world")
+		if got := readStoredLogs(t, storage, ctr.Name); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("restores the name of an older container", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		first := log.Container{ID: "abc123", Name: "foo", CreatedAt: now.Add(-time.Hour)}
+		second := log.Container{ID: "def456", Name: "foo", CreatedAt: now}
+		writeLogs(t, storage, first, record)
+		writeLogs(t, storage, second, record)
+		if err := storage.MarkRemoved(second.ID, now.Add(-2*time.Hour)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+			MaxAgeAfterRemoval: time.Hour,
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		stored, err := storage.GetStoredContainer("foo")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stored.ID != first.ID {
+			t.Errorf("expected foo to refer to %s, got %s", first.ID, stored.ID)
+		}
+	})
+
+	t.Run("dry run removes nothing", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+		ctr := log.Container{ID: "abc123", Name: "foo"}
+		writeLogs(t, storage, ctr, record)
+		setModTime(t, root, ctr.ID, now.Add(-48*time.Hour))
+
+		gc := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+			MaxAge:       time.Hour,
+			MaxTotalSize: 1,
+			DryRun:       true,
+		})
+		if err := gc.Collect(now); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertStored(t, storage, root, ctr)
+	})
+}
+
+// setModTime sets the modification time of all the log files of the container.
+func setModTime(t *testing.T, root, containerID string, modTime time.Time) {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(root, containerID, "*.log"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, path := range paths {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("failed to set modification time: %v", err)
+		}
+	}
+}
+
+func readStoredLogs(t *testing.T, storage *filesystem.LogStorage, containerName string) string {
+	t.Helper()
+
+	rc, err := storage.Open(log.Query{ContainerName: containerName})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read logs: %v", err)
+	}
+	return string(data)
+}
+
+func assertRemoved(t *testing.T, storage *filesystem.LogStorage, root string, ctr log.Container) {
+	t.Helper()
+
+	if _, err := os.Stat(filepath.Join(root, ctr.ID)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %s directory to be removed, got %v", ctr.Name, err)
+	}
+	var notFoundErr *log.ContainerNotFoundError
+	if _, err := storage.GetStoredContainer(ctr.Name); !errors.As(err, &notFoundErr) {
+		t.Errorf("expected %s to be forgotten, got %v", ctr.Name, err)
+	}
+}
+
+func assertStored(t *testing.T, storage *filesystem.LogStorage, root string, ctr log.Container) {
+	t.Helper()
+
+	if _, err := os.Stat(filepath.Join(root, ctr.ID)); err != nil {
+		t.Errorf("expected %s directory to be kept, got %v", ctr.Name, err)
+	}
+	if _, err := storage.GetStoredContainer(ctr.Name); err != nil {
+		t.Errorf("expected %s to be known, got %v", ctr.Name, err)
+	}
+}
@@ -0,0 +1,323 @@
+package filesystem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+// Each uncompressed segment "[segment].log" has a sparse index "[segment].log.idx" mapping
+// the timestamp of some of its records to their offset, so that readers can seek to a point
+// in time without decoding the records preceding it. The index of the active segment is
+// written along with the logs and renamed with it when it is sealed.
+//
+// The index is a sequence of fixed-size entries made of the timestamp in nanoseconds
+// since the Unix epoch and the offset of the record, both encoded as big-endian int64.
+
+const (
+	// indexExt is the extension appended to the name of a segment to get its index.
+	indexExt = ".idx"
+
+	// indexRecordInterval is the number of records after which a record is indexed.
+	indexRecordInterval = 1000
+
+	// indexByteInterval is the number of bytes after which a record is indexed.
+	indexByteInterval = 64 * 1024
+
+	indexEntrySize = 16
+)
+
+// indexEntry maps the timestamp of a record to its offset in the segment.
+type indexEntry struct {
+	timestamp int64
+	offset    int64
+}
+
+func indexPath(segmentPath string) string {
+	return segmentPath + indexExt
+}
+
+func appendIndexEntry(b []byte, e indexEntry) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(e.timestamp))
+	return binary.BigEndian.AppendUint64(b, uint64(e.offset))
+}
+
+// readIndex reads the index of a segment. An entry partially written is ignored.
+func readIndex(path string) ([]indexEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]indexEntry, 0, len(data)/indexEntrySize)
+	for len(data) >= indexEntrySize {
+		entries = append(entries, indexEntry{
+			timestamp: int64(binary.BigEndian.Uint64(data)),
+			offset:    int64(binary.BigEndian.Uint64(data[8:])),
+		})
+		data = data[indexEntrySize:]
+	}
+	return entries, nil
+}
+
+// writeIndex replaces the index of a segment with the given entries.
+func writeIndex(path string, entries []indexEntry) error {
+	data := make([]byte, 0, len(entries)*indexEntrySize)
+	for _, e := range entries {
+		data = appendIndexEntry(data, e)
+	}
+
+	// Readers may rebuild the same index concurrently.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename index: %w", err)
+	}
+	return nil
+}
+
+// buildIndex indexes the records read from r.
+func buildIndex(r io.Reader) ([]indexEntry, error) {
+	var (
+		ix      indexer
+		entries []indexEntry
+	)
+	ix.reset(0, nil)
+
+	buf := make([]byte, tailChunkSize)
+	for {
+		n, err := r.Read(buf)
+		entries = append(entries, ix.observe(buf[:n])...)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read log file: %w", err)
+		}
+	}
+}
+
+// seekIndex returns the offset from which the records emitted at or after t
+// are found, as the records are stored in chronological order.
+func seekIndex(entries []indexEntry, t time.Time) int64 {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].timestamp >= t.UnixNano()
+	})
+	if i == 0 {
+		return 0
+	}
+	return entries[i-1].offset
+}
+
+// endIndex returns the offset from which all the records are emitted after t,
+// or zero if it is unknown.
+func endIndex(entries []indexEntry, t time.Time) int64 {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].timestamp > t.UnixNano()
+	})
+	if i == len(entries) {
+		return 0
+	}
+	return entries[i].offset
+}
+
+// indexer selects the records to index in the data appended to a segment.
+type indexer struct {
+	// offset is the offset of the next data appended to the segment.
+	offset int64
+	// recordStart is the offset of the record being appended.
+	recordStart int64
+	// last is the last indexed record, if any.
+	last *indexEntry
+	// records is the number of records appended since the last indexed one.
+	records int
+	// indexing indicates whether the record being appended, buffered in line, is indexed.
+	indexing bool
+	line     []byte
+}
+
+// reset prepares the indexer to observe the data appended to a segment of the given
+// size, made of complete records, whose last indexed record is last.
+func (ix *indexer) reset(size int64, last *indexEntry) {
+	*ix = indexer{offset: size, recordStart: size, last: last}
+}
+
+// observe processes the data p appended to the segment and returns the entries
+// of the indexed records completed by p.
+func (ix *indexer) observe(p []byte) []indexEntry {
+	var entries []indexEntry
+	for len(p) > 0 {
+		if ix.offset == ix.recordStart && !ix.indexing {
+			ix.indexing = ix.last == nil ||
+				ix.records >= indexRecordInterval ||
+				ix.recordStart-ix.last.offset >= indexByteInterval
+			ix.line = ix.line[:0]
+		}
+
+		n := len(p)
+		i := bytes.IndexByte(p, '\n')
+		if i >= 0 {
+			n = i + 1
+		}
+		if ix.indexing {
+			ix.line = append(ix.line, p[:n]...)
+		}
+		ix.offset += int64(n)
+		p = p[n:]
+		if i < 0 {
+			break
+		}
+
+		// The record is complete.
+		ix.records++
+		if ix.indexing {
+			ix.indexing = false
+			var rec log.Record
+			if err := json.Unmarshal(ix.line, &rec); err == nil && !rec.Timestamp.IsZero() {
+				e := indexEntry{timestamp: rec.Timestamp.UnixNano(), offset: ix.recordStart}
+				entries = append(entries, e)
+				ix.last = &e
+				ix.records = 0
+			}
+		}
+		ix.recordStart = ix.offset
+	}
+	return entries
+}
+
+// indexWriter maintains the index of the active segment while it is written.
+type indexWriter struct {
+	f  *os.File
+	ix indexer
+}
+
+// openIndexWriter opens the index of the active segment of the given size for appending,
+// rebuilding it if it is missing or does not match the segment.
+func openIndexWriter(segmentPath string, size int64) (*indexWriter, error) {
+	path := indexPath(segmentPath)
+	entries, err := readIndex(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read index: %w", err)
+	}
+	if errors.Is(err, os.ErrNotExist) ||
+		(len(entries) == 0 && size > 0) ||
+		(len(entries) > 0 && entries[len(entries)-1].offset >= size) {
+		f, err := os.Open(segmentPath)
+		if err != nil {
+			return nil, fmt.Errorf("open log file: %w", err)
+		}
+		entries, err = buildIndex(io.LimitReader(f, size))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("build index: %w", err)
+		}
+		if err := writeIndex(path, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("open index: %w", err)
+	}
+	w := &indexWriter{f: f}
+	var last *indexEntry
+	if len(entries) > 0 {
+		last = &entries[len(entries)-1]
+	}
+	w.ix.reset(size, last)
+	return w, nil
+}
+
+// observe indexes the records in the data p appended to the segment.
+// It does nothing if w is nil, when the index could not be opened.
+func (w *indexWriter) observe(p []byte) error {
+	if w == nil {
+		return nil
+	}
+
+	var data []byte
+	for _, e := range w.ix.observe(p) {
+		data = appendIndexEntry(data, e)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := w.f.Write(data); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	return nil
+}
+
+func (w *indexWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.f.Close()
+}
+
+// loadIndex returns the index of the segment, rebuilding it if it is missing and the
+// segment is sealed, or nil if the segment has no usable index.
+func (ls *LogStorage) loadIndex(f segmentFile) ([]indexEntry, error) {
+	if f.compressed {
+		return nil, nil
+	}
+
+	// The index is renamed along with the segment, which may have been sealed since
+	// it was opened, so it is read only if the segment is still found at this path.
+	path := indexPath(f.Name())
+	ls.segmentsMu.RLock()
+	if !isOpenedFrom(f.File, f.Name()) {
+		ls.segmentsMu.RUnlock()
+		return nil, nil
+	}
+	entries, err := readIndex(path)
+	ls.segmentsMu.RUnlock()
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return entries, err
+	}
+	if f.active {
+		// The index of the active segment is rebuilt by its writer.
+		return nil, nil
+	}
+
+	entries, err = buildIndex(io.NewSectionReader(f, 0, 1<<63-1))
+	if err != nil {
+		return nil, fmt.Errorf("build index: %w", err)
+	}
+
+	ls.segmentsMu.RLock()
+	defer ls.segmentsMu.RUnlock()
+	if !isOpenedFrom(f.File, f.Name()) {
+		return entries, nil
+	}
+	return entries, writeIndex(path, entries)
+}
+
+// isOpenedFrom reports whether f is the file found at path.
+func isOpenedFrom(f *os.File, path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	openInfo, err := f.Stat()
+	return err == nil && os.SameFile(info, openInfo)
+}
@@ -0,0 +1,108 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIndexer(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeOf := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	var (
+		data    bytes.Buffer
+		offsets []int64
+	)
+	const recordCount = 3000
+	for i := range recordCount {
+		offsets = append(offsets, int64(data.Len()))
+		fmt.Fprintf(&data, `{"timestamp":%q,"stream":"stdout","output":"line %d\n"}`+"\n",
+			timeOf(i).Format(time.RFC3339), i)
+	}
+
+	// The records indexed every indexRecordInterval records or indexByteInterval bytes.
+	indexed := []int{0}
+	for i := range recordCount {
+		last := indexed[len(indexed)-1]
+		if i-last >= indexRecordInterval || offsets[i]-offsets[last] >= indexByteInterval {
+			indexed = append(indexed, i)
+		}
+	}
+	if len(indexed) < 3 {
+		t.Fatalf("expected several indexed records, got %v", indexed)
+	}
+	var want []indexEntry
+	for _, i := range indexed {
+		want = append(want, indexEntry{timestamp: timeOf(i).UnixNano(), offset: offsets[i]})
+	}
+
+	// Write the records in chunks splitting them.
+	var (
+		ix      indexer
+		entries []indexEntry
+	)
+	ix.reset(0, nil)
+	for p := data.Bytes(); len(p) > 0; {
+		n := min(37, len(p))
+		entries = append(entries, ix.observe(p[:n])...)
+		p = p[n:]
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("expected entries %v, got %v", want, entries)
+	}
+
+	built, err := buildIndex(bytes.NewReader(data.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(built, want) {
+		t.Errorf("expected rebuilt entries %v, got %v", want, built)
+	}
+
+	t.Run("seek", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			t    time.Time
+			want int64
+		}{
+			{name: "before the first record", t: timeOf(-1), want: 0},
+			{name: "indexed record", t: timeOf(indexed[1]), want: 0},
+			{name: "between indexed records", t: timeOf(indexed[1] + 1), want: offsets[indexed[1]]},
+			{
+				name: "after the last record",
+				t:    timeOf(recordCount),
+				want: offsets[indexed[len(indexed)-1]],
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				if got := seekIndex(entries, tc.t); got != tc.want {
+					t.Errorf("expected offset %d, got %d", tc.want, got)
+				}
+			})
+		}
+	})
+
+	t.Run("end", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			t    time.Time
+			want int64
+		}{
+			{name: "before the first record", t: timeOf(-1), want: 0},
+			{name: "indexed record", t: timeOf(indexed[1]), want: offsets[indexed[2]]},
+			{name: "between indexed records", t: timeOf(indexed[1] + 1), want: offsets[indexed[2]]},
+			{name: "after the last indexed record", t: timeOf(recordCount - 1), want: 0},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				if got := endIndex(entries, tc.t); got != tc.want {
+					t.Errorf("expected offset %d, got %d", tc.want, got)
+				}
+			})
+		}
+	})
+}
@@ -1,12 +1,16 @@
 package filesystem
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/matthieugusmini/docker-logproxy/internal/log"
 )
@@ -14,92 +18,405 @@ import (
 // LogStorage provides filesystem-based storage for Docker container logs.
 type LogStorage struct {
 	root              string
+	options           LogStorageOptions
 	containerIDByName sync.Map
+	// metadataByID holds the [metadata] of the containers.
+	metadataByID sync.Map
+	// metadataMu serializes the metadata updates.
+	metadataMu sync.Mutex
+	// segmentsMu guards the set of segment files of the containers: they are opened
+	// with the read lock held while rotating or removing them requires the write lock.
+	segmentsMu sync.RWMutex
+	// lastSeqs are the sequence numbers of the last segments sealed of each container ID,
+	// so that they are not reused once the sealed segments are removed. They number the
+	// segments in the [log.Position] of the records. They are guarded by segmentsMu.
+	lastSeqs map[string]int
+	// compressing holds the paths of the segments being compressed.
+	compressing sync.Map
+
+	// writersMu guards openWriters.
+	writersMu sync.Mutex
+	// openWriters is the number of writers open for each container ID.
+	openWriters map[string]int
+}
+
+// LogStorageOptions are optional parameters used to configure
+// the behavior of the [LogStorage].
+type LogStorageOptions struct {
+	// MaxSegmentSize, if positive, is the size in bytes from which the log file of
+	// a container is rotated to a new segment. Records are never split across
+	// segments, so a segment can exceed it by up to one record.
+	MaxSegmentSize int64
+
+	// MaxSegments, if positive, is the maximum number of segments kept per container,
+	// including the one being written. The oldest segments are removed first.
+	MaxSegments int
+
+	// Compress enables the gzip compression of the segments once rotated.
+	// They are compressed in the background, not to slow down the writes.
+	Compress bool
+
+	// CompressRemoved enables the gzip compression of the logs of the containers
+	// removed from Docker. They are compressed by the [GarbageCollector].
+	CompressRemoved bool
+}
+
+// metadata is the content of the "metadata.json" file of a container.
+type metadata struct {
+	log.Container
+
+	// Runs are the runs of the container whose logs were collected.
+	Runs []log.Run `json:"runs,omitempty"`
+
+	// RemovedAt is the time at which the container was removed from Docker, if known.
+	RemovedAt time.Time `json:"removedAt,omitzero"`
 }
 
 // NewLogStorage creates a new [LogStorage] instance that stores log files
 // in the specified root directory.
 //
 // You can call [LoadExistingMappings] after creation to rebuild the name->ID mapping from old containers.
-func NewLogStorage(root string) *LogStorage {
+func NewLogStorage(root string, opts LogStorageOptions) *LogStorage {
 	return &LogStorage{
-		root: root,
+		root:        root,
+		options:     opts,
+		lastSeqs:    make(map[string]int),
+		openWriters: make(map[string]int),
 	}
 }
 
-// Create creates a new log file for the specified container and returns
-// an [io.WriteCloser] for writing log data.
+// Create opens the log file of the specified container in append mode and returns
+// a [log.LogWriter] for writing log data.
 //
 // It creates a container-specific directory at "[logDir]/[containerID]/"
 // if it does not exist already, writes container metadata to "metadata.json",
-// and creates a log file "[containerID]-json.log".
-func (ls *LogStorage) Create(container log.Container) (io.WriteCloser, error) {
+// and creates the log file "[containerID]-json.log" if it does not exist already.
+// Existing logs are preserved so that the collection can resume after a restart,
+// except for a partially written record at the end of the file.
+//
+// If [LogStorageOptions.MaxSegmentSize] is set, the writer transparently rotates
+// the log file to a new segment once it is full.
+func (ls *LogStorage) Create(container log.Container) (log.LogWriter, error) {
+	// Prevent the garbage collector from removing the container logs being created.
+	ls.segmentsMu.RLock()
+	defer ls.segmentsMu.RUnlock()
+
 	containerDir := ls.containerDirPath(container.ID)
 	if err := os.MkdirAll(containerDir, os.ModePerm); err != nil {
 		return nil, fmt.Errorf("make container directory: %w", err)
 	}
 
 	// We use this metadata to resolve container name using the container id.
-	metadataPath := ls.metadataFilePath(container.ID)
-	metadataFile, err := os.Create(metadataPath)
-	if err != nil {
-		return nil, fmt.Errorf("create metadata file: %w", err)
+	if err := ls.writeMetadata(container); err != nil {
+		return nil, err
 	}
-	defer metadataFile.Close()
 
-	if err := json.NewEncoder(metadataFile).Encode(container); err != nil {
-		return nil, fmt.Errorf("encode container metadata: %w", err)
+	logPath := ls.logFilePath(container.ID)
+	if err := truncatePartialLine(logPath); err != nil {
+		return nil, fmt.Errorf("repair log file: %w", err)
 	}
 
-	// Keep an in-memory mapping for faster lookup.
-	ls.containerIDByName.Store(container.Name, container.ID)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+	info, err := logFile.Stat()
+	if err != nil {
+		logFile.Close()
+		return nil, fmt.Errorf("stat log file: %w", err)
+	}
 
-	logPath := ls.logFilePath(container.ID)
-	logFile, err := os.Create(logPath)
+	index, err := openIndexWriter(logPath, info.Size())
 	if err != nil {
-		return nil, fmt.Errorf("create log file: %w", err)
+		logFile.Close()
+		return nil, err
 	}
 
-	return logFile, nil
+	segments, err := ls.sealedSegments(container.ID)
+	if err != nil {
+		index.Close()
+		logFile.Close()
+		return nil, err
+	}
+
+	ls.acquireWriter(container.ID)
+	return &segmentWriter{
+		ls:          ls,
+		containerID: container.ID,
+		f:           logFile,
+		index:       index,
+		size:        info.Size(),
+		seq:         ls.nextSeq(container.ID, segments),
+	}, nil
 }
 
-// Open opens the log file for the specified container and returns
-// an [io.ReadCloser] for reading log data. The containerNameOrID
-// parameter accepts either a container name or ID.
+// LastTimestamp returns the timestamp of the last record stored for the container and
+// the number of records stored with this timestamp, or the zero time if no logs are
+// stored yet.
+func (ls *LogStorage) LastTimestamp(containerID string) (time.Time, int, error) {
+	files, err := ls.openSegments(containerID)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, 0, nil
+	} else if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	last, err := lastRecordTime(files)
+	if err != nil || last.IsZero() {
+		closeFiles(files)
+		return last, 0, err
+	}
+
+	// Only the records from the last timestamp on are read.
+	files, err = ls.seekSegments(files, last, time.Time{})
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	defer closeFiles(files)
+	r, err := newSegmentsReader(files)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	n, err := countRecordsAt(r, last)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return last, n, nil
+}
+
+// Open opens the log file for the container specified in the query and returns
+// an [io.ReadCloser] for reading log data. The query container name accepts
+// either a container name or ID.
+//
+// The segments of the log file are read one after the other, in order, and decompressed
+// if needed. They are opened at once so that a rotation does not affect the returned reader.
+//
+// If [log.Query.Since] or [log.Query.Until] are set, the segments whose records are all
+// outside of the time range are skipped and the index of the segments is used to seek
+// to its bounds. The records preceding [log.Query.Since] are not returned.
+//
+// If [log.Query.Tail] is set, only the last matching records are returned and
+// the log file is read backwards so that it does not need to be scanned entirely.
+//
+// If [log.Query.Follow] is set without [log.Query.Until], the reader then waits for the
+// records appended to the logs. If they are being written, it reaches the end once they are
+// not written anymore, like the log stream of a running container ends when it stops.
+// Otherwise the container is not running and the reader polls the logs until it is closed,
+// picking up the records written if the collection starts again.
+//
+// The records older than the retention period of the container, set by its
+// [log.LabelRetention] label, are not returned.
 //
 // Returns [*log.ContainerNotFoundError] if the container cannot be found.
-func (ls *LogStorage) Open(containerNameOrID string) (io.ReadCloser, error) {
-	// 1. Consider containerNameOrID is a container ID and try to directly
-	// open the log file.
-	logPath := ls.logFilePath(containerNameOrID)
-	if f, err := os.Open(logPath); err == nil {
-		return f, nil
-	} else if !os.IsNotExist(err) {
-		return nil, fmt.Errorf("open log file: %w", err)
+func (ls *LogStorage) Open(query log.Query) (io.ReadCloser, error) {
+	containerID, err := ls.resolveContainerID(query.ContainerName)
+	if err != nil {
+		return nil, err
 	}
 
-	// 2. Now assume it's a container name and try resolving to ID
-	// via in-memory mapping.
-	v, found := ls.containerIDByName.Load(containerNameOrID)
-	if !found {
+	files, err := ls.openSegments(containerID)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil, &log.ContainerNotFoundError{
-			Name: containerNameOrID,
+			Name: query.ContainerName,
+			Err:  err,
 		}
+	} else if err != nil {
+		return nil, err
 	}
-	containerID := v.(string)
 
-	logPath = ls.logFilePath(containerID)
-	f, err := os.Open(logPath)
-	if os.IsNotExist(err) {
-		return nil, &log.ContainerNotFoundError{
-			Name: containerNameOrID,
+	cutoff := ls.retentionCutoff(containerID, time.Now())
+	if cutoff.After(query.Since) {
+		query.Since = cutoff
+	}
+
+	follow := query.Follow && query.Until.IsZero()
+	untilClosed := !ls.isBeingWritten(containerID)
+
+	files, err = ls.seekSegments(files, query.Since, query.Until)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Tail != nil {
+		if follow {
+			return ls.followAfterTail(containerID, files, query, untilClosed)
+		}
+		defer closeFiles(files)
+
+		data, err := tailSegments(files, *query.Tail, matchRecord(query))
+		if err != nil {
+			return nil, fmt.Errorf("tail log file: %w", err)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	var rc io.ReadCloser
+	if follow {
+		last := len(files) - 1
+		r, err := newSegmentsReader(files[:last])
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		rc = newFollowReader(ls, containerID, r, files, files[last].start, untilClosed)
+	} else {
+		r, err := newSegmentsReader(files)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		rc = r
+	}
+	if query.Since.IsZero() {
+		return rc, nil
+	}
+	return skipRecordsBefore(rc, query.Since), nil
+}
+
+// matchRecord returns a function reporting whether a line holds a record included by the query.
+func matchRecord(query log.Query) func(line []byte) bool {
+	return func(line []byte) bool {
+		var rec log.Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// Skip corrupted lines.
+			return false
+		}
+		return query.Includes(rec)
+	}
+}
+
+// followAfterTail returns a reader of the last records of the segments matching the
+// query, followed by the records appended to the active segment, the last of files.
+func (ls *LogStorage) followAfterTail(
+	containerID string,
+	files []segmentFile,
+	query log.Query,
+	untilClosed bool,
+) (io.ReadCloser, error) {
+	// The records appended from now on follow the tail.
+	active := &files[len(files)-1]
+	info, err := active.Stat()
+	if err != nil {
+		closeFiles(files)
+		return nil, fmt.Errorf("stat log file: %w", err)
+	}
+	active.end = info.Size()
+
+	data, err := tailSegments(files, *query.Tail, matchRecord(query))
+	if err != nil {
+		closeFiles(files)
+		return nil, fmt.Errorf("tail log file: %w", err)
+	}
+	closeFiles(files[:len(files)-1])
+
+	files = files[len(files)-1:]
+	r := bytes.NewReader(data)
+	return newFollowReader(ls, containerID, r, files, active.end, untilClosed), nil
+}
+
+// OpenHistory returns a reader for the logs of the container specified in the query
+// stored so far, like [LogStorage.Open] does without following them, and a reader of
+// the records stored after them, starting with the record being written if any.
+//
+// If [log.Query.Follow] is set, the second reader waits for the records appended to the
+// logs like [LogStorage.Open] does. Otherwise it returns [io.EOF] each time it reads all
+// the records stored so far. [log.Query.Until] is not supported.
+//
+// Returns [*log.ContainerNotFoundError] if the container cannot be found.
+func (ls *LogStorage) OpenHistory(
+	query log.Query,
+) (io.ReadCloser, log.StoredLogReader, error) {
+	containerID, err := ls.resolveContainerID(query.ContainerName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := ls.openSegments(containerID)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, &log.ContainerNotFoundError{
+			Name: query.ContainerName,
 			Err:  err,
 		}
 	} else if err != nil {
-		return nil, fmt.Errorf("open log file: %w", err)
+		return nil, nil, err
+	}
+
+	cutoff := ls.retentionCutoff(containerID, time.Now())
+	if cutoff.After(query.Since) {
+		query.Since = cutoff
+	}
+
+	untilClosed := !ls.isBeingWritten(containerID)
+
+	files, err = ls.seekSegments(files, query.Since, time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The history ends with the last complete record of the active segment.
+	last := len(files) - 1
+	active := &files[last]
+	info, err := active.Stat()
+	if err != nil {
+		closeFiles(files)
+		return nil, nil, fmt.Errorf("stat log file: %w", err)
+	}
+	active.end, err = recordsEnd(active, info.Size())
+	if err != nil {
+		closeFiles(files)
+		return nil, nil, err
+	}
+	history := files
+	if active.end == 0 {
+		// The active segment would be read without end.
+		history = files[:last]
+	}
+
+	live := newFollowReader(ls, containerID, nil, files[last:], active.end, untilClosed)
+	live.catchUp = !query.Follow
+
+	if query.Tail != nil {
+		data, err := tailSegments(history, *query.Tail, matchRecord(query))
+		closeFiles(files[:last])
+		if err != nil {
+			live.Close()
+			return nil, nil, fmt.Errorf("tail log file: %w", err)
+		}
+		return io.NopCloser(bytes.NewReader(data)), live, nil
+	}
+
+	r, err := newSegmentsReader(history)
+	if err != nil {
+		closeFiles(files[:last])
+		live.Close()
+		return nil, nil, err
+	}
+	// The active segment is closed by the reader of the records stored afterwards.
+	r.files = files[:last]
+	if query.Since.IsZero() {
+		return r, live, nil
+	}
+	return skipRecordsBefore(r, query.Since), live, nil
+}
+
+// resolveContainerID returns the ID of the container specified by name or ID.
+func (ls *LogStorage) resolveContainerID(containerNameOrID string) (string, error) {
+	// 1. Consider containerNameOrID is a container ID and check its log file exists.
+	if _, err := os.Stat(ls.logFilePath(containerNameOrID)); err == nil {
+		return containerNameOrID, nil
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("stat log file: %w", err)
 	}
 
-	return f, nil
+	// 2. Now assume it's a container name and try resolving to ID
+	// via in-memory mapping.
+	v, found := ls.containerIDByName.Load(containerNameOrID)
+	if !found {
+		return "", &log.ContainerNotFoundError{
+			Name: containerNameOrID,
+		}
+	}
+	return v.(string), nil
 }
 
 // LoadExistingMappings scans the logs root directory for existing
@@ -130,20 +447,192 @@ func (ls *LogStorage) LoadExistingMappings() error {
 			continue
 		}
 
-		var container log.Container
-		if err := json.NewDecoder(f).Decode(&container); err != nil {
+		var md metadata
+		if err := json.NewDecoder(f).Decode(&md); err != nil {
 			f.Close()
 			// Corrupted container log directory
 			continue
 		}
 		f.Close()
 
-		ls.containerIDByName.Store(container.Name, container.ID)
+		// The settings are not stored but read from the labels again.
+		md.Settings, _ = log.ParseContainerSettings(md.Labels)
+
+		ls.containerIDByName.Store(md.Name, md.ID)
+		ls.metadataByID.Store(md.ID, md)
+	}
+
+	return nil
+}
+
+// UpdateMetadata replaces the stored metadata of the container.
+// The container logs must have been created with [LogStorage.Create] beforehand.
+func (ls *LogStorage) UpdateMetadata(container log.Container) error {
+	if _, err := os.Stat(ls.containerDirPath(container.ID)); err != nil {
+		return fmt.Errorf("stat container directory: %w", err)
+	}
+	return ls.writeMetadata(container)
+}
+
+// MarkRemoved records the time at which the container was removed from Docker.
+// It does nothing if no logs are stored for the container.
+func (ls *LogStorage) MarkRemoved(containerID string, removedAt time.Time) error {
+	ls.metadataMu.Lock()
+	defer ls.metadataMu.Unlock()
+
+	v, ok := ls.metadataByID.Load(containerID)
+	if !ok {
+		return nil
+	}
+	md := v.(metadata)
+	md.RemovedAt = removedAt
+	return ls.storeMetadata(md)
+}
+
+// MarkRemovedExcept marks the containers whose logs are stored as removed from Docker,
+// except the given ones and those already marked or being written, e.g. because they
+// were removed while the proxy was stopped. As the time of their removal is unknown,
+// it is the time at which their logs were last written.
+func (ls *LogStorage) MarkRemovedExcept(containerIDs []string) error {
+	var missing []metadata
+	ls.metadataByID.Range(func(_, v any) bool {
+		md := v.(metadata)
+		if md.RemovedAt.IsZero() && !slices.Contains(containerIDs, md.ID) &&
+			!ls.isBeingWritten(md.ID) {
+			missing = append(missing, md)
+		}
+		return true
+	})
+
+	var errs []error
+	for _, md := range missing {
+		files, err := ls.listSegmentFiles(md)
+		if errors.Is(err, os.ErrNotExist) {
+			// The container directory has been removed in the meantime.
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var lastWrite time.Time
+		for _, f := range files {
+			if f.modTime.After(lastWrite) {
+				lastWrite = f.modTime
+			}
+		}
+		if err := ls.MarkRemoved(md.ID, lastWrite); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeMetadata atomically writes the container metadata to "metadata.json",
+// recording its current run, and updates the in-memory mappings.
+func (ls *LogStorage) writeMetadata(container log.Container) error {
+	ls.metadataMu.Lock()
+	defer ls.metadataMu.Unlock()
+
+	md := metadata{Container: container}
+	if v, ok := ls.metadataByID.Load(container.ID); ok {
+		md.Runs = slices.Clone(v.(metadata).Runs)
+		md.RemovedAt = v.(metadata).RemovedAt
+	}
+	md.Runs = updateRuns(md.Runs, container)
+
+	return ls.storeMetadata(md)
+}
+
+// storeMetadata atomically writes the metadata to "metadata.json" and updates
+// the in-memory mappings. The caller must hold metadataMu.
+func (ls *LogStorage) storeMetadata(md metadata) error {
+	container := md.Container
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		return fmt.Errorf("encode container metadata: %w", err)
+	}
+
+	// Write to a temporary file first so that readers never see a partially written file.
+	metadataPath := ls.metadataFilePath(container.ID)
+	tmpPath := metadataPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write metadata file: %w", err)
 	}
+	if err := os.Rename(tmpPath, metadataPath); err != nil {
+		return fmt.Errorf("rename metadata file: %w", err)
+	}
+
+	// Keep an in-memory mapping for faster lookup.
+	ls.containerIDByName.Store(container.Name, container.ID)
+	ls.metadataByID.Store(container.ID, md)
 
 	return nil
 }
 
+// acquireWriter records that a writer is open for the container.
+func (ls *LogStorage) acquireWriter(containerID string) {
+	ls.writersMu.Lock()
+	defer ls.writersMu.Unlock()
+	ls.openWriters[containerID]++
+}
+
+// releaseWriter records that a writer of the container was closed.
+func (ls *LogStorage) releaseWriter(containerID string) {
+	ls.writersMu.Lock()
+	defer ls.writersMu.Unlock()
+	if ls.openWriters[containerID]--; ls.openWriters[containerID] <= 0 {
+		delete(ls.openWriters, containerID)
+	}
+}
+
+// IsCollecting reports whether the logs of the container specified in the query are
+// being written, including all the streams it requests, so that following them with
+// [LogStorage.Open] is equivalent to following the container logs in Docker.
+func (ls *LogStorage) IsCollecting(query log.Query) bool {
+	containerID, err := ls.resolveContainerID(query.ContainerName)
+	if err != nil || !ls.isBeingWritten(containerID) {
+		return false
+	}
+
+	v, ok := ls.metadataByID.Load(containerID)
+	if !ok {
+		return false
+	}
+	settings := v.(metadata).Settings
+	return (!query.IncludeStdout || settings.IncludesStream(log.StreamTypeStdout)) &&
+		(!query.IncludeStderr || settings.IncludesStream(log.StreamTypeStderr))
+}
+
+// isBeingWritten reports whether a writer is open for the container.
+func (ls *LogStorage) isBeingWritten(containerID string) bool {
+	ls.writersMu.Lock()
+	defer ls.writersMu.Unlock()
+	return ls.openWriters[containerID] > 0
+}
+
+// updateRuns returns the runs updated with the current run of the container:
+// a new run is appended if the container started again and the last run is
+// marked as finished if the container exited.
+func updateRuns(runs []log.Run, container log.Container) []log.Run {
+	if container.StartedAt.IsZero() {
+		return runs
+	}
+	if len(runs) == 0 || container.StartedAt.After(runs[len(runs)-1].StartedAt) {
+		runs = append(runs, log.Run{StartedAt: container.StartedAt})
+	}
+
+	// Docker keeps the finish time of the previous run until the container exits again.
+	last := &runs[len(runs)-1]
+	if last.StartedAt.Equal(container.StartedAt) && container.FinishedAt.After(container.StartedAt) {
+		last.FinishedAt = container.FinishedAt
+		last.ExitCode = container.ExitCode
+	}
+
+	return runs
+}
+
 func (ls *LogStorage) containerDirPath(containerID string) string {
 	return filepath.Join(ls.root, containerID)
 }
@@ -152,6 +641,7 @@ func (ls *LogStorage) metadataFilePath(containerID string) string {
 	return filepath.Join(ls.containerDirPath(containerID), "metadata.json")
 }
 
+// logFilePath returns the path of the active segment of the container logs.
 func (ls *LogStorage) logFilePath(containerID string) string {
 	return filepath.Join(ls.containerDirPath(containerID), containerID+"-json.log")
 }
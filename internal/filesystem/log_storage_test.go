@@ -0,0 +1,808 @@
+package filesystem_test
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/filesystem"
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestLogStorage_Create(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "foo"}
+	first := `{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"first\n"}` + "\n"
+	second := `{"timestamp":"2024-01-01T12:00:01Z","stream":"stdout","output":"second\n"}` + "\n"
+	logPath := func(root string) string {
+		return filepath.Join(root, container.ID, container.ID+"-json.log")
+	}
+
+	t.Run("appends to existing logs", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+
+		writeLogs(t, storage, container, first)
+		writeLogs(t, storage, container, second)
+
+		got, err := os.ReadFile(logPath(root))
+		if err != nil {
+			t.Fatalf("failed to read log file: %v", err)
+		}
+		if want := first + second; string(got) != want {
+			t.Errorf("expected %q, got %q", want, string(got))
+		}
+	})
+
+	t.Run("drops partially written record", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+
+		writeLogs(t, storage, container, first+`{"timestamp":"2024-01-01T12:00:01Z","str`)
+
+		last, _, err := storage.LastTimestamp(container.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC); !last.Equal(want) {
+			t.Errorf("expected last timestamp %v, got %v", want, last)
+		}
+
+		writeLogs(t, storage, container, second)
+
+		got, err := os.ReadFile(logPath(root))
+		if err != nil {
+			t.Fatalf("failed to read log file: %v", err)
+		}
+		if want := first + second; string(got) != want {
+			t.Errorf("expected %q, got %q", want, string(got))
+		}
+	})
+}
+
+func TestLogStorage_LastTimestamp(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "foo"}
+	records := make([]string, 4)
+	for i := range records {
+		// The last 3 records share their timestamp.
+		ts := time.Date(2024, 1, 1, 12, 0, min(i, 1), 0, time.UTC).Format(time.RFC3339)
+		records[i] = `{"timestamp":"` + ts + `","stream":"stdout","output":"line ` +
+			strconv.Itoa(i) + `\n"}` + "\n"
+	}
+	// Each segment holds 2 records.
+	storage := filesystem.NewLogStorage(t.TempDir(), filesystem.LogStorageOptions{
+		MaxSegmentSize: int64(2 * len(records[0])),
+	})
+
+	last, n, err := storage.LastTimestamp(container.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !last.IsZero() || n != 0 {
+		t.Errorf("expected zero time for a container without logs, got %v (%d)", last, n)
+	}
+
+	writeLogs(t, storage, container, strings.Join(records, ""))
+	last, n, err = storage.LastTimestamp(container.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := time.Date(2024, 1, 1, 12, 0, 1, 0, time.UTC); !last.Equal(want) {
+		t.Errorf("expected last timestamp %v, got %v", want, last)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 records at the last timestamp, got %d", n)
+	}
+}
+
+// ptr returns a pointer to v.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func writeLogs(t *testing.T, storage *filesystem.LogStorage, container log.Container, data string) {
+	t.Helper()
+
+	w, err := storage.Create(container)
+	if err != nil {
+		t.Fatalf("failed to create log file: %v", err)
+	}
+	defer w.Close()
+
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("failed to write logs: %v", err)
+	}
+}
+
+func TestLogStorage_ListRuns(t *testing.T) {
+	root := t.TempDir()
+	storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+	firstStart := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	firstEnd := firstStart.Add(time.Minute)
+	secondStart := firstStart.Add(2 * time.Minute)
+
+	container := log.Container{ID: "abc123", Name: "foo", StartedAt: firstStart}
+	writeLogs(t, storage, container, "")
+
+	// The container crashes.
+	container.FinishedAt = firstEnd
+	container.ExitCode = 1
+	if err := storage.UpdateMetadata(container); err != nil {
+		t.Fatalf("failed to update metadata: %v", err)
+	}
+
+	// The container restarts. Docker keeps the finish time of the previous run.
+	container.StartedAt = secondStart
+	writeLogs(t, storage, container, "")
+
+	want := []log.Run{
+		{StartedAt: firstStart, FinishedAt: firstEnd, ExitCode: 1},
+		{StartedAt: secondStart},
+	}
+	runs, err := storage.ListRuns("foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("expected %+v, got %+v", want, runs)
+	}
+
+	// The runs are restored after a restart of the proxy.
+	restarted := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+	if err := restarted.LoadExistingMappings(); err != nil {
+		t.Fatalf("failed to load mappings: %v", err)
+	}
+	runs, err = restarted.ListRuns("foo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(runs, want) {
+		t.Errorf("expected %+v, got %+v", want, runs)
+	}
+}
+
+func TestLogStorage_Open_Retention(t *testing.T) {
+	root := t.TempDir()
+	storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+
+	now := time.Now().UTC()
+	record := func(ts time.Time, output string) string {
+		return `{"timestamp":"` + ts.Format(time.RFC3339Nano) +
+			`","stream":"stdout","output":"` + output + `\n"}` + "\n"
+	}
+	expired := record(now.Add(-48*time.Hour), "expired")
+	kept := record(now.Add(-time.Hour), "kept")
+
+	container := log.Container{
+		ID:     "abc123",
+		Name:   "foo",
+		Labels: map[string]string{"logproxy.retention": "1d"},
+	}
+	container.Settings, _ = log.ParseContainerSettings(container.Labels)
+	writeLogs(t, storage, container, expired+kept)
+
+	// The settings are read from the stored labels after a restart.
+	reloaded := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+	if err := reloaded.LoadExistingMappings(); err != nil {
+		t.Fatalf("failed to load mappings: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		query log.Query
+	}{
+		{name: "all logs", query: log.Query{ContainerName: "foo"}},
+		{name: "tail", query: log.Query{ContainerName: "foo", IncludeStdout: true, Tail: ptr(2)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, err := reloaded.Open(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if string(got) != kept {
+				t.Errorf("expected %q, got %q", kept, string(got))
+			}
+		})
+	}
+}
+
+func TestLogStorage_Rotation(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "foo"}
+	records := make([]string, 6)
+	for i := range records {
+		ts := time.Date(2024, 1, 1, 12, 0, i, 0, time.UTC).Format(time.RFC3339)
+		records[i] = `{"timestamp":"` + ts + `","stream":"stdout","output":"line ` +
+			strconv.Itoa(i) + `\n"}` + "\n"
+	}
+	// Each segment holds 2 records.
+	opts := filesystem.LogStorageOptions{MaxSegmentSize: int64(2 * len(records[0]))}
+
+	readAll := func(t *testing.T, storage *filesystem.LogStorage, query log.Query) string {
+		t.Helper()
+
+		rc, err := storage.Open(query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer rc.Close()
+
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		return string(got)
+	}
+
+	t.Run("stitches the segments together", func(t *testing.T) {
+		root := t.TempDir()
+		storage := filesystem.NewLogStorage(root, opts)
+
+		// A single write spanning several segments.
+		writeLogs(t, storage, container, strings.Join(records[:5], ""))
+		writeLogs(t, storage, container, records[5])
+
+		segments, err := filepath.Glob(filepath.Join(root, container.ID, "*.log"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// 3 full segments and the active one, which is empty.
+		if len(segments) != 4 {
+			t.Errorf("expected 4 segments, got %v", segments)
+		}
+
+		want := strings.Join(records, "")
+		if got := readAll(t, storage, log.Query{ContainerName: "foo"}); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+
+		query := log.Query{ContainerName: "foo", IncludeStdout: true, Tail: ptr(3)}
+		want = strings.Join(records[3:], "")
+		if got := readAll(t, storage, query); got != want {
+			t.Errorf("expected tail %q, got %q", want, got)
+		}
+
+		query.Tail = ptr(0)
+		if got := readAll(t, storage, query); got != "" {
+			t.Errorf("expected no logs for a zero tail, got %q", got)
+		}
+
+		last, _, err := storage.LastTimestamp(container.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := time.Date(2024, 1, 1, 12, 0, 5, 0, time.UTC); !last.Equal(want) {
+			t.Errorf("expected last timestamp %v, got %v", want, last)
+		}
+	})
+
+	t.Run("removes the oldest segments", func(t *testing.T) {
+		root := t.TempDir()
+		opts := opts
+		opts.MaxSegments = 2
+		storage := filesystem.NewLogStorage(root, opts)
+
+		writeLogs(t, storage, container, strings.Join(records, ""))
+
+		// The last 2 records filled a segment which was rotated, so the active one is empty.
+		want := strings.Join(records[4:], "")
+		if got := readAll(t, storage, log.Query{ContainerName: "foo"}); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("does not affect open readers", func(t *testing.T) {
+		root := t.TempDir()
+		opts := opts
+		opts.MaxSegments = 1
+		storage := filesystem.NewLogStorage(root, opts)
+
+		w, err := storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		defer w.Close()
+		if _, err := io.WriteString(w, records[0]); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+
+		rc, err := storage.Open(log.Query{ContainerName: "foo"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer rc.Close()
+
+		// The segment being read is rotated and removed.
+		if _, err := io.WriteString(w, records[1]+records[2]); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		if want := records[0] + records[1]; string(got) != want {
+			t.Errorf("expected %q, got %q", want, string(got))
+		}
+	})
+}
+
+func TestLogStorage_OpenHistory(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "foo"}
+	records := make([]string, 7)
+	for i := range records {
+		ts := time.Date(2024, 1, 1, 12, 0, i, 0, time.UTC).Format(time.RFC3339)
+		records[i] = `{"timestamp":"` + ts + `","stream":"stdout","output":"line ` +
+			strconv.Itoa(i) + `\n"}` + "\n"
+	}
+	// Each segment holds 2 records.
+	opts := filesystem.LogStorageOptions{MaxSegmentSize: int64(2 * len(records[0]))}
+	query := log.Query{ContainerName: "foo", IncludeStdout: true}
+
+	t.Run("reads the records stored afterwards by position", func(t *testing.T) {
+		storage := filesystem.NewLogStorage(t.TempDir(), opts)
+		w, err := storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		defer w.Close()
+		if _, err := io.WriteString(w, strings.Join(records[:3], "")); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+
+		history, stored, err := storage.OpenHistory(query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer history.Close()
+		defer stored.Close()
+
+		got, err := io.ReadAll(history)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		if want := strings.Join(records[:3], ""); string(got) != want {
+			t.Errorf("expected %q, got %q", want, string(got))
+		}
+		if got, want := stored.Position(), w.Position(); got != want {
+			t.Errorf("expected position %v, got %v", want, got)
+		}
+
+		// The records are appended across several rotations.
+		var want []log.Position
+		for _, rec := range records[3:] {
+			if _, err := io.WriteString(w, rec); err != nil {
+				t.Fatalf("failed to write logs: %v", err)
+			}
+			want = append(want, w.Position())
+		}
+
+		// The records are read one at a time, up to the last one written.
+		var positions []log.Position
+		buf := make([]byte, len(records[0]))
+		for {
+			n, err := stored.Read(buf)
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if string(buf[:n]) != records[3+len(positions)] {
+				t.Fatalf("expected %q, got %q", records[3+len(positions)], string(buf[:n]))
+			}
+			positions = append(positions, stored.Position())
+		}
+		if !reflect.DeepEqual(positions, want) {
+			t.Errorf("expected positions %v, got %v", want, positions)
+		}
+	})
+
+	t.Run("leaves the record being written to the reader of the next ones", func(t *testing.T) {
+		storage := filesystem.NewLogStorage(t.TempDir(), opts)
+		w, err := storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		defer w.Close()
+		if _, err := io.WriteString(w, records[0]+records[1][:10]); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+
+		history, stored, err := storage.OpenHistory(query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer history.Close()
+		defer stored.Close()
+
+		got, err := io.ReadAll(history)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		if string(got) != records[0] {
+			t.Errorf("expected %q, got %q", records[0], string(got))
+		}
+
+		if _, err := io.WriteString(w, records[1][10:]); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+		got, err = io.ReadAll(stored)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		if string(got) != records[1] {
+			t.Errorf("expected %q, got %q", records[1], string(got))
+		}
+	})
+}
+
+func TestLogStorage_Compression(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "foo"}
+	records := make([]string, 6)
+	for i := range records {
+		ts := time.Date(2024, 1, 1, 12, 0, i, 0, time.UTC).Format(time.RFC3339)
+		records[i] = `{"timestamp":"` + ts + `","stream":"stdout","output":"line ` +
+			strconv.Itoa(i) + `\n"}` + "\n"
+	}
+	// Each segment holds 2 records.
+	opts := filesystem.LogStorageOptions{
+		MaxSegmentSize: int64(2 * len(records[0])),
+		Compress:       true,
+	}
+
+	root := t.TempDir()
+	storage := filesystem.NewLogStorage(root, opts)
+	writeLogs(t, storage, container, strings.Join(records[:5], ""))
+
+	compressed, err := filepath.Glob(filepath.Join(root, container.ID, "*.log.gz"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(compressed) != 2 {
+		t.Errorf("expected 2 compressed segments, got %v", compressed)
+	}
+
+	readAll := func(query log.Query) string {
+		t.Helper()
+
+		rc, err := storage.Open(query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer rc.Close()
+
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		return string(got)
+	}
+
+	want := strings.Join(records[:5], "")
+	if got := readAll(log.Query{ContainerName: "foo"}); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	want = strings.Join(records[2:5], "")
+	tail := log.Query{ContainerName: "foo", IncludeStdout: true, Tail: ptr(3)}
+	if got := readAll(tail); got != want {
+		t.Errorf("expected tail %q, got %q", want, got)
+	}
+
+	// The first segment only holds older records so it is skipped.
+	since := time.Date(2024, 1, 1, 12, 0, 2, 0, time.UTC)
+	want = strings.Join(records[2:5], "")
+	if got := readAll(log.Query{ContainerName: "foo", Since: since}); got != want {
+		t.Errorf("expected logs since %v %q, got %q", since, want, got)
+	}
+
+	// Create the active segment once the last one was rotated.
+	writeLogs(t, storage, container, records[5])
+	last, _, err := storage.LastTimestamp(container.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := time.Date(2024, 1, 1, 12, 0, 5, 0, time.UTC); !last.Equal(want) {
+		t.Errorf("expected last timestamp %v, got %v", want, last)
+	}
+}
+
+func TestLogStorage_Index(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "foo"}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var records []string
+	for i := range 5000 {
+		ts := start.Add(time.Duration(i) * time.Second).Format(time.RFC3339)
+		records = append(records, `{"timestamp":"`+ts+`","stream":"stdout","output":"line `+
+			strconv.Itoa(i)+`\n"}`+"\n")
+	}
+	since := start.Add(2500 * time.Second)
+	until := start.Add(3999 * time.Second)
+
+	root := t.TempDir()
+	storage := filesystem.NewLogStorage(root, filesystem.LogStorageOptions{})
+	writeLogs(t, storage, container, strings.Join(records, ""))
+
+	indexPath := filepath.Join(root, container.ID, container.ID+"-json.log.idx")
+	assertQueries := func(t *testing.T) {
+		t.Helper()
+
+		testCases := []struct {
+			name  string
+			query log.Query
+			want  string
+		}{
+			{
+				name:  "since",
+				query: log.Query{ContainerName: "foo", Since: since},
+				want:  strings.Join(records[2500:], ""),
+			},
+			{
+				name:  "since and until",
+				query: log.Query{ContainerName: "foo", Since: since, Until: until},
+				// Records after until may be returned, up to the next indexed one.
+				want: strings.Join(records[2500:4000], ""),
+			},
+			{
+				name: "tail until",
+				query: log.Query{
+					ContainerName: "foo",
+					IncludeStdout: true,
+					Until:         until,
+					Tail:          ptr(2),
+				},
+				want: strings.Join(records[3998:4000], ""),
+			},
+		}
+		for _, tc := range testCases {
+			rc, err := storage.Open(tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if !strings.HasPrefix(string(got), tc.want) {
+				t.Errorf("%s: expected logs starting with %q, got %q", tc.name, tc.want[:100], got)
+			}
+		}
+	}
+
+	t.Run("is written with the logs", func(t *testing.T) {
+		info, err := os.Stat(indexPath)
+		if err != nil {
+			t.Fatalf("failed to stat index: %v", err)
+		}
+		if info.Size() == 0 {
+			t.Error("expected index entries")
+		}
+
+		assertQueries(t)
+	})
+
+	t.Run("is rebuilt if missing", func(t *testing.T) {
+		if err := os.Remove(indexPath); err != nil {
+			t.Fatalf("failed to remove index: %v", err)
+		}
+
+		// The collection resumes.
+		w, err := storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		w.Close()
+
+		if _, err := os.Stat(indexPath); err != nil {
+			t.Fatalf("expected index to be rebuilt: %v", err)
+		}
+		assertQueries(t)
+	})
+}
+
+func TestLogStorage_Follow(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "foo"}
+	records := make([]string, 9)
+	for i := range records {
+		ts := time.Date(2024, 1, 1, 12, 0, i, 0, time.UTC).Format(time.RFC3339)
+		records[i] = `{"timestamp":"` + ts + `","stream":"stdout","output":"line ` +
+			strconv.Itoa(i) + `\n"}` + "\n"
+	}
+	// Each segment holds 2 records.
+	opts := filesystem.LogStorageOptions{MaxSegmentSize: int64(2 * len(records[0]))}
+
+	// readAsync reads rc until its end and sends the logs read.
+	readAsync := func(rc io.Reader) <-chan string {
+		ch := make(chan string, 1)
+		go func() {
+			got, _ := io.ReadAll(rc)
+			ch <- string(got)
+		}()
+		return ch
+	}
+
+	testCases := []struct {
+		name string
+		tail *int
+		want string
+	}{
+		{name: "all logs", want: strings.Join(records, "")},
+		{name: "tail", tail: ptr(2), want: strings.Join(records[1:], "")},
+		{name: "new logs only", tail: ptr(0), want: strings.Join(records[3:], "")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := filesystem.NewLogStorage(t.TempDir(), opts)
+			w, err := storage.Create(container)
+			if err != nil {
+				t.Fatalf("failed to create log file: %v", err)
+			}
+			if _, err := io.WriteString(w, strings.Join(records[:3], "")); err != nil {
+				t.Fatalf("failed to write logs: %v", err)
+			}
+
+			query := log.Query{ContainerName: "foo", IncludeStdout: true, Follow: true, Tail: tc.tail}
+			if !storage.IsCollecting(query) {
+				t.Error("expected the container logs to be collected")
+			}
+			rc, err := storage.Open(query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+			logs := readAsync(rc)
+
+			// The records are appended across several rotations.
+			for _, rec := range records[3:] {
+				if _, err := io.WriteString(w, rec); err != nil {
+					t.Fatalf("failed to write logs: %v", err)
+				}
+			}
+			// The logs end once the collection stops.
+			w.Close()
+
+			select {
+			case got := <-logs:
+				if got != tc.want {
+					t.Errorf("expected %q, got %q", tc.want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the end of the logs")
+			}
+		})
+	}
+
+	t.Run("waits for the collection to start again", func(t *testing.T) {
+		storage := filesystem.NewLogStorage(t.TempDir(), opts)
+		w, err := storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		if _, err := io.WriteString(w, records[0]); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+		// The container stopped.
+		w.Close()
+
+		rc, err := storage.Open(log.Query{ContainerName: "foo", Follow: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer rc.Close()
+
+		want := strings.Join(records[:5], "")
+		logs := make(chan string, 1)
+		go func() {
+			buf := make([]byte, len(want))
+			n, _ := io.ReadFull(rc, buf)
+			logs <- string(buf[:n])
+		}()
+
+		// The container started again, its logs are appended across several rotations.
+		w, err = storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		for _, rec := range records[1:5] {
+			if _, err := io.WriteString(w, rec); err != nil {
+				t.Fatalf("failed to write logs: %v", err)
+			}
+		}
+		w.Close()
+
+		select {
+		case got := <-logs:
+			if got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the logs")
+		}
+	})
+
+	t.Run("stops when closed", func(t *testing.T) {
+		storage := filesystem.NewLogStorage(t.TempDir(), opts)
+		w, err := storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		defer w.Close()
+		if _, err := io.WriteString(w, records[0]); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+
+		rc, err := storage.Open(log.Query{ContainerName: "foo", Follow: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		logs := readAsync(rc)
+		rc.Close()
+
+		select {
+		case got := <-logs:
+			if !strings.HasPrefix(records[0], got) {
+				t.Errorf("expected at most %q, got %q", records[0], got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the end of the logs")
+		}
+	})
+
+	t.Run("follows the rotations once the sealed segments are removed", func(t *testing.T) {
+		storage := filesystem.NewLogStorage(t.TempDir(), opts)
+		w, err := storage.Create(container)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		if _, err := io.WriteString(w, strings.Join(records[:3], "")); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+
+		rc, err := storage.Open(log.Query{ContainerName: "foo", Follow: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer rc.Close()
+		buf := make([]byte, len(strings.Join(records[:3], "")))
+		if _, err := io.ReadFull(rc, buf); err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+
+		// The disk budget only leaves the segment being written.
+		gc := filesystem.NewGarbageCollector(
+			storage,
+			slog.New(slog.DiscardHandler),
+			filesystem.RetentionOptions{MaxTotalSize: 1},
+		)
+		if err := gc.Collect(time.Now()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The records are appended across several rotations before being read.
+		if _, err := io.WriteString(w, strings.Join(records[3:], "")); err != nil {
+			t.Fatalf("failed to write logs: %v", err)
+		}
+		w.Close()
+
+		select {
+		case got := <-readAsync(rc):
+			if want := strings.Join(records[3:], ""); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the end of the logs")
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+// retentionCutoff returns the time before which the logs of the container have
+// expired according to its retention settings, or the zero time if they never expire.
+func (ls *LogStorage) retentionCutoff(containerID string, now time.Time) time.Time {
+	v, ok := ls.metadataByID.Load(containerID)
+	if !ok {
+		return time.Time{}
+	}
+	retention := v.(metadata).Settings.Retention
+	if retention <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-retention)
+}
+
+// skipRecordsBefore returns a reader of the records of rc emitted at or after t.
+// As the records are stored in chronological order, only the expired records
+// at the beginning of the logs are scanned, on the first read so that a followed
+// stream is not waited for. Closing the reader closes rc.
+func skipRecordsBefore(rc io.ReadCloser, t time.Time) io.ReadCloser {
+	return &skipReader{rc: rc, t: t}
+}
+
+// skipReader skips the records emitted before t on the first read.
+type skipReader struct {
+	rc io.ReadCloser
+	t  time.Time
+	// r reads the records once skipped.
+	r io.Reader
+}
+
+func (r *skipReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		if err := r.skip(); err != nil {
+			return 0, err
+		}
+	}
+	return r.r.Read(p)
+}
+
+func (r *skipReader) skip() error {
+	br := bufio.NewReaderSize(r.rc, tailChunkSize)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec log.Record
+			if json.Unmarshal(bytes.TrimSpace(line), &rec) == nil && !rec.Timestamp.Before(r.t) {
+				r.r = io.MultiReader(bytes.NewReader(line), br)
+				return nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			r.r = bytes.NewReader(nil)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read log file: %w", err)
+		}
+	}
+}
+
+func (r *skipReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,505 @@
+package filesystem
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+// The logs of a container are split into segments: the active segment "[containerID]-json.log"
+// the logs are appended to and the sealed segments "[containerID]-json.[seq].log" it was
+// rotated to once full, numbered in the order they were sealed. Sequence numbers are not
+// reused, even once the sealed segments are removed. Sealed segments may be compressed to
+// "[containerID]-json.[seq].log.gz".
+//
+// A segment is sealed by renaming it, along with its index, so the readers which opened it
+// keep reading it.
+
+// segment is a sealed log segment.
+type segment struct {
+	seq  int
+	path string
+	// compressed indicates whether the segment is gzip-compressed.
+	compressed bool
+}
+
+// sealedSegments returns the sealed segments of the container from the oldest to the latest.
+func (ls *LogStorage) sealedSegments(containerID string) ([]segment, error) {
+	entries, err := os.ReadDir(ls.containerDirPath(containerID))
+	if err != nil {
+		return nil, fmt.Errorf("read container directory: %w", err)
+	}
+
+	prefix := containerID + "-json."
+	bySeq := make(map[int]segment)
+	for _, entry := range entries {
+		name := entry.Name()
+		v, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+		v, compressed := strings.CutSuffix(v, compressedExt)
+		v, ok = strings.CutSuffix(v, ".log")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+
+		// The uncompressed segment is left over if compressing it was interrupted.
+		if seg, ok := bySeq[seq]; ok && seg.compressed {
+			continue
+		}
+		bySeq[seq] = segment{
+			seq:        seq,
+			path:       filepath.Join(ls.containerDirPath(containerID), name),
+			compressed: compressed,
+		}
+	}
+
+	segments := slices.Collect(maps.Values(bySeq))
+	slices.SortFunc(segments, func(a, b segment) int { return a.seq - b.seq })
+	return segments, nil
+}
+
+func (ls *LogStorage) sealedSegmentPath(containerID string, seq int) string {
+	return filepath.Join(
+		ls.containerDirPath(containerID),
+		containerID+"-json."+strconv.Itoa(seq)+".log",
+	)
+}
+
+// segmentFile is an open log segment.
+type segmentFile struct {
+	*os.File
+	// seq is the sequence number of the segment or, for the active segment,
+	// the one it gets once sealed.
+	seq int
+	// active indicates whether the segment was the active one when opened.
+	active bool
+	// compressed indicates whether the segment is gzip-compressed.
+	compressed bool
+	// start and end, if positive, are the offsets of the uncompressed segment
+	// between which its records are read.
+	start, end int64
+}
+
+// openSegments opens all the segments of the container from the oldest to the active one.
+//
+// It returns an error wrapping [os.ErrNotExist] if the container has no active segment.
+func (ls *LogStorage) openSegments(containerID string) ([]segmentFile, error) {
+	// Prevent the segments from being rotated or removed while they are being opened.
+	ls.segmentsMu.RLock()
+	defer ls.segmentsMu.RUnlock()
+
+	active, err := os.Open(ls.logFilePath(containerID))
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+
+	segments, err := ls.sealedSegments(containerID)
+	if err != nil {
+		active.Close()
+		return nil, err
+	}
+
+	files, err := openSealedSegments(segments)
+	if err != nil {
+		active.Close()
+		return nil, err
+	}
+
+	return append(files, segmentFile{
+		File:   active,
+		seq:    ls.nextSeq(containerID, segments),
+		active: true,
+	}), nil
+}
+
+func openSealedSegments(segments []segment) ([]segmentFile, error) {
+	files := make([]segmentFile, 0, len(segments)+1)
+	for _, seg := range segments {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("open log segment: %w", err)
+		}
+		files = append(files, segmentFile{File: f, seq: seg.seq, compressed: seg.compressed})
+	}
+	return files, nil
+}
+
+// nextSeq returns the sequence number of the next segment of the container sealed after
+// the given sealed segments, which follows all the ones issued so far even if they were
+// removed. The caller must hold segmentsMu.
+func (ls *LogStorage) nextSeq(containerID string, segments []segment) int {
+	seq := ls.lastSeqs[containerID]
+	if len(segments) > 0 {
+		// The sealed segments may have been written before a restart.
+		seq = max(seq, segments[len(segments)-1].seq)
+	}
+	return seq + 1
+}
+
+// reader returns a reader of the records of the segment, decompressing them if needed.
+// Unless the end of the segment is set, the records appended to it meanwhile are read.
+func (f segmentFile) reader() (io.Reader, error) {
+	if !f.compressed {
+		n := int64(1<<63-1) - f.start
+		if f.end > 0 {
+			n = max(f.end-f.start, 0)
+		}
+		return io.NewSectionReader(f, f.start, n), nil
+	}
+
+	zr, err := gzip.NewReader(io.NewSectionReader(f, 0, 1<<63-1))
+	if err != nil {
+		return nil, fmt.Errorf("read compressed log segment: %w", err)
+	}
+	return zr, nil
+}
+
+// section returns the part of the uncompressed segment holding its records,
+// up to its current size unless its end is set.
+func (f segmentFile) section() (*io.SectionReader, error) {
+	end := f.end
+	if end <= 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("stat file: %w", err)
+		}
+		end = info.Size()
+	}
+	return io.NewSectionReader(f, f.start, max(end-f.start, 0)), nil
+}
+
+// timeRange returns the timestamps of the first and last records of the segment,
+// or zero times if it has none. Compressed segments are not decompressed.
+func (f segmentFile) timeRange() (first, last time.Time, err error) {
+	if f.compressed {
+		zr, err := gzip.NewReader(io.NewSectionReader(f, 0, 1<<63-1))
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("read compressed log segment: %w", err)
+		}
+		return parseSegmentHeader(zr.Header)
+	}
+
+	first, err = firstRecordTime(io.NewSectionReader(f, 0, 1<<63-1))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	last, err = lastRecordTime([]segmentFile{f})
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return first, last, nil
+}
+
+func closeFiles(files []segmentFile) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// seekSegments restricts the segments to the records emitted between since and until,
+// if not zero. The sealed segments whose records are all older than since and the
+// segments whose records are all newer than until are closed and removed from files,
+// and the remaining segments are bounded with their index.
+func (ls *LogStorage) seekSegments(
+	files []segmentFile,
+	since, until time.Time,
+) ([]segmentFile, error) {
+	fail := func(err error) ([]segmentFile, error) {
+		closeFiles(files)
+		return nil, err
+	}
+
+	if !since.IsZero() {
+		for len(files) > 1 {
+			_, last, err := files[0].timeRange()
+			if err != nil {
+				return fail(err)
+			}
+			if !last.Before(since) {
+				break
+			}
+			files[0].Close()
+			files = files[1:]
+		}
+
+		entries, err := ls.loadIndex(files[0])
+		if err != nil {
+			return fail(err)
+		}
+		files[0].start = seekIndex(entries, since)
+	}
+
+	if !until.IsZero() {
+		for len(files) > 0 {
+			last := len(files) - 1
+			first, _, err := files[last].timeRange()
+			if err != nil {
+				return fail(err)
+			}
+			if !first.IsZero() && !first.After(until) {
+				break
+			}
+			files[last].Close()
+			files = files[:last]
+		}
+		if len(files) == 0 {
+			return files, nil
+		}
+
+		last := &files[len(files)-1]
+		entries, err := ls.loadIndex(*last)
+		if err != nil {
+			return fail(err)
+		}
+		last.end = endIndex(entries, until)
+	}
+
+	return files, nil
+}
+
+// segmentsReader reads the segments of a container one after the other.
+type segmentsReader struct {
+	io.Reader
+	files []segmentFile
+}
+
+func newSegmentsReader(files []segmentFile) (*segmentsReader, error) {
+	readers := make([]io.Reader, len(files))
+	for i, f := range files {
+		r, err := f.reader()
+		if err != nil {
+			return nil, err
+		}
+		readers[i] = r
+	}
+	return &segmentsReader{
+		Reader: io.MultiReader(readers...),
+		files:  files,
+	}, nil
+}
+
+func (r *segmentsReader) Close() error {
+	var errs []error
+	for _, f := range r.files {
+		errs = append(errs, f.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// tailSegments returns the last n lines of the segments, from the oldest to the active
+// one, for which match returns true. Only the end of the uncompressed segments is read
+// and the compressed segments are only decompressed if their records are needed.
+func tailSegments(files []segmentFile, n int, match func(line []byte) bool) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	var chunks [][]byte
+	for _, f := range slices.Backward(files) {
+		var (
+			data []byte
+			err  error
+		)
+		if f.compressed {
+			r, rerr := f.reader()
+			if rerr != nil {
+				return nil, rerr
+			}
+			data, err = tailReader(r, n, match)
+		} else {
+			sr, serr := f.section()
+			if serr != nil {
+				return nil, serr
+			}
+			data, err = tailFile(sr, n, match)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, data)
+
+		n -= bytes.Count(data, []byte{'\n'})
+		if n <= 0 {
+			break
+		}
+	}
+
+	slices.Reverse(chunks)
+	return bytes.Join(chunks, nil), nil
+}
+
+// segmentWriter appends logs to the active segment of a container and rotates it
+// once it reaches the maximum segment size.
+type segmentWriter struct {
+	ls          *LogStorage
+	containerID string
+	f           *os.File
+	index       *indexWriter
+	// size is the size of the active segment.
+	size int64
+	// seq is the sequence number the active segment gets once sealed.
+	seq int
+	// pos is the position following the last byte written.
+	pos log.Position
+	// compressions are the compressions of the sealed segments in progress.
+	compressions sync.WaitGroup
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk, rotate := p, false
+		if maxSize := w.ls.options.MaxSegmentSize; maxSize > 0 {
+			// Rotate at the end of the record reaching the maximum size so that
+			// records are never split across segments.
+			offset := min(max(maxSize-w.size-1, 0), int64(len(p)))
+			if i := bytes.IndexByte(p[offset:], '\n'); i >= 0 {
+				chunk, rotate = p[:offset+int64(i)+1], true
+			}
+		}
+
+		n, err := w.f.Write(chunk)
+		written += n
+		w.size += int64(n)
+		w.pos = log.Position{Segment: int64(w.seq), Offset: w.size}
+		// A missing index entry only makes seeking in the segment less precise.
+		_ = w.index.observe(chunk[:n])
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+
+		if rotate {
+			if err := w.rotate(); err != nil {
+				return written, fmt.Errorf("rotate log file: %w", err)
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// rotate seals the active segment, removing the oldest sealed segments exceeding
+// the maximum number of segments, and starts a new active segment.
+func (w *segmentWriter) rotate() error {
+	if err := w.index.Close(); err != nil {
+		return fmt.Errorf("close index: %w", err)
+	}
+
+	w.ls.segmentsMu.Lock()
+	sealed, f, err := w.ls.rotateActiveSegment(w.containerID, w.f)
+	w.ls.segmentsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	w.f, w.size, w.seq = f, 0, sealed.seq+1
+
+	w.index, err = openIndexWriter(w.ls.logFilePath(w.containerID), 0)
+	if err != nil {
+		return err
+	}
+
+	if w.ls.options.Compress {
+		// Do not hold up the collection of the logs while compressing.
+		// The garbage collector compresses the segment later if this fails.
+		w.compressions.Go(func() {
+			_ = w.ls.compressSegment(sealed)
+		})
+	}
+
+	return nil
+}
+
+// rotateActiveSegment closes the active segment of the container, seals it and opens
+// a new active segment, removing the oldest sealed segments exceeding the maximum
+// number of segments. It returns the sealed segment and the new active segment.
+// The caller must hold the write lock of segmentsMu.
+func (ls *LogStorage) rotateActiveSegment(
+	containerID string,
+	active *os.File,
+) (segment, *os.File, error) {
+	if err := active.Close(); err != nil {
+		return segment{}, nil, fmt.Errorf("close log file: %w", err)
+	}
+
+	segments, err := ls.sealedSegments(containerID)
+	if err != nil {
+		return segment{}, nil, err
+	}
+	seq := ls.nextSeq(containerID, segments)
+	sealed := segment{seq: seq, path: ls.sealedSegmentPath(containerID, seq)}
+	if err := os.Rename(ls.logFilePath(containerID), sealed.path); err != nil {
+		return segment{}, nil, fmt.Errorf("seal log file: %w", err)
+	}
+	ls.lastSeqs[containerID] = seq
+	err = os.Rename(indexPath(ls.logFilePath(containerID)), indexPath(sealed.path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return segment{}, nil, fmt.Errorf("seal index: %w", err)
+	}
+	segments = append(segments, sealed)
+
+	// The active segment counts as one of the segments.
+	if maxSegments := ls.options.MaxSegments; maxSegments > 0 {
+		for len(segments) > max(maxSegments-1, 0) {
+			if err := removeSegmentFiles(segments[0].path); err != nil {
+				return segment{}, nil, fmt.Errorf("remove log segment: %w", err)
+			}
+			segments = segments[1:]
+		}
+	}
+
+	f, err := os.OpenFile(
+		ls.logFilePath(containerID),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0o666,
+	)
+	if err != nil {
+		return segment{}, nil, fmt.Errorf("open log file: %w", err)
+	}
+
+	return sealed, f, nil
+}
+
+// Position returns the position following the last byte written. A record ending
+// the active segment keeps the position in the sealed segment.
+func (w *segmentWriter) Position() log.Position {
+	return w.pos
+}
+
+// Close closes the active segment once the sealed segments are compressed.
+func (w *segmentWriter) Close() error {
+	w.compressions.Wait()
+	w.ls.releaseWriter(w.containerID)
+	w.index.Close()
+	return w.f.Close()
+}
+
+// removeSegmentFiles deletes a segment and its index.
+func removeSegmentFiles(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(indexPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
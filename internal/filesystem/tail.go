@@ -0,0 +1,157 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// tailChunkSize is the size of the chunks read when scanning a file backwards.
+const tailChunkSize = 64 * 1024
+
+// maxRecordSize is the maximum size of a log record line read with a [bufio.Scanner].
+const maxRecordSize = 1024 * 1024
+
+// tailFile returns the last n lines of f for which match returns true, in the
+// order they appear in the file. Each returned line is terminated by a newline.
+//
+// The file is read backwards chunk by chunk so that only its end is scanned.
+func tailFile(f *io.SectionReader, n int, match func(line []byte) bool) ([]byte, error) {
+	var (
+		// Matching lines in reverse order.
+		lines [][]byte
+		// Beginning of the first line of the previously read chunk
+		// that might be continued in the preceding chunk.
+		rest   []byte
+		offset = f.Size()
+	)
+	collect := func(line []byte) bool {
+		if len(bytes.TrimSpace(line)) > 0 && match(line) {
+			lines = append(lines, slices.Clone(line))
+		}
+		return len(lines) < n
+	}
+
+scan:
+	for offset > 0 {
+		size := min(tailChunkSize, offset)
+		offset -= size
+
+		chunk := make([]byte, size, size+int64(len(rest)))
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+		data := append(chunk, rest...)
+
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			line := data[i+1:]
+			data = data[:i]
+			if !collect(line) {
+				break scan
+			}
+		}
+		rest = data
+	}
+	// The first line of the file is not preceded by a newline.
+	if offset == 0 && len(lines) < n {
+		collect(rest)
+	}
+
+	var buf bytes.Buffer
+	for _, line := range slices.Backward(lines) {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// tailReader returns the last n lines read from r for which match returns true,
+// in order. Each returned line is terminated by a newline.
+//
+// Unlike [tailFile], r is read entirely. It is meant for compressed files.
+func tailReader(r io.Reader, n int, match func(line []byte) bool) ([]byte, error) {
+	// Ring buffer holding the last matching lines.
+	var (
+		lines [][]byte
+		next  int
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxRecordSize)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 || !match(line) {
+			continue
+		}
+		if len(lines) < n {
+			lines = append(lines, slices.Clone(line))
+			continue
+		}
+		lines[next] = slices.Clone(line)
+		next = (next + 1) % n
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	var buf bytes.Buffer
+	for _, line := range slices.Concat(lines[next:], lines[:next]) {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// truncatePartialLine removes the end of the file following its last newline,
+// which is the result of an interrupted write. It does nothing if the file does not exist.
+func truncatePartialLine(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+
+	offset, err := recordsEnd(f, info.Size())
+	if err != nil {
+		return err
+	}
+	if offset == info.Size() {
+		return nil
+	}
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("truncate file: %w", err)
+	}
+	return nil
+}
+
+// recordsEnd returns the offset following the last newline of the first size bytes
+// of f, which ends the last complete record.
+func recordsEnd(f io.ReaderAt, size int64) (int64, error) {
+	offset := size
+	for offset > 0 {
+		chunk := make([]byte, min(tailChunkSize, offset))
+		offset -= int64(len(chunk))
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("read file: %w", err)
+		}
+
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return offset + int64(i) + 1, nil
+		}
+	}
+	return 0, nil
+}
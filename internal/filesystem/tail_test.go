@@ -0,0 +1,77 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTailFile(t *testing.T) {
+	// Write enough lines to span several chunks.
+	var content strings.Builder
+	const lineCount = 20000
+	for i := range lineCount {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	if err := os.WriteFile(path, []byte(content.String()), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	matchAll := func([]byte) bool { return true }
+	matchEven := func(line []byte) bool {
+		var n int
+		_, _ = fmt.Sscanf(string(line), "line %d", &n)
+		return n%2 == 0
+	}
+
+	testCases := []struct {
+		name     string
+		n        int
+		match    func([]byte) bool
+		expected string
+	}{
+		{
+			name:     "last lines",
+			n:        3,
+			match:    matchAll,
+			expected: "line 19997\nline 19998\nline 19999\n",
+		},
+		{
+			name:     "last matching lines",
+			n:        2,
+			match:    matchEven,
+			expected: "line 19996\nline 19998\n",
+		},
+		{
+			name:     "more lines than available",
+			n:        lineCount + 10,
+			match:    matchAll,
+			expected: content.String(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			defer f.Close()
+
+			got, err := tailFile(io.NewSectionReader(f, 0, int64(content.Len())), tc.n, tc.match)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(got, []byte(tc.expected)) {
+				t.Errorf("expected %d bytes, got %d bytes", len(tc.expected), len(got))
+			}
+		})
+	}
+}
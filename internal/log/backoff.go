@@ -0,0 +1,56 @@
+package log
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// minReconnectDelay is the delay before the first attempt to reconnect to Docker.
+	minReconnectDelay = 500 * time.Millisecond
+	// maxReconnectDelay caps the delay between two attempts to reconnect to Docker.
+	maxReconnectDelay = 30 * time.Second
+)
+
+// backoff computes exponentially increasing delays between retries, with jitter
+// so that the streams interrupted at the same time do not reconnect all at once.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+func newReconnectBackoff() *backoff {
+	return &backoff{min: minReconnectDelay, max: maxReconnectDelay}
+}
+
+// next returns the delay to wait before the next attempt. The delay is picked
+// randomly between half and all of the exponentially growing delay.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		d = min(b.min<<b.attempt, b.max)
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// reset starts over from the minimum delay.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// sleep pauses for the duration d. It returns false if ctx is done before.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,23 +1,22 @@
 package log
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"slices"
 	"sync"
+	"time"
 )
 
 // ContainerMonitor provides access to Docker container operations for monitoring.
 type ContainerMonitor interface {
 	ContainerLogStreamer
-
-	// ListContainers returns a slice representing all running containers in Docker.
-	ListContainers(ctx context.Context) ([]Container, error)
-
-	// WatchContainerEvents watches for container lifecycle events (started, deleted, etc.).
-	WatchContainers(ctx context.Context) (<-chan ContainerEvent, <-chan error)
+	ContainerWatcher
 }
 
 // StorageWriter creates writable log streams for storing container logs.
@@ -25,17 +24,56 @@ type ContainerMonitor interface {
 // NOTE: We only wrote a filesystem implementation as for now for the test but we would
 // most likely also accept a [context.Context] for implementations using the network.
 type StorageWriter interface {
-	// Create creates a new log file for the specified container and
-	// returns an [io.WriteCloser] to write directly to the storage.
-	Create(container Container) (io.WriteCloser, error)
+	// Create creates the log file for the specified container if it does not exist
+	// and returns a [LogWriter] appending directly to the storage.
+	Create(container Container) (LogWriter, error)
+
+	// LastTimestamp returns the timestamp of the last record stored for the container
+	// and the number of records stored with this timestamp, or the zero time if no logs
+	// are stored yet.
+	LastTimestamp(containerID string) (time.Time, int, error)
+
+	// UpdateMetadata replaces the stored metadata of the container.
+	UpdateMetadata(container Container) error
+
+	// MarkRemoved records the time at which the container was removed from Docker
+	// so that its logs can be deleted after a while. It does nothing if no logs
+	// are stored for the container.
+	MarkRemoved(containerID string, removedAt time.Time) error
+
+	// MarkRemovedExcept marks the containers whose logs are stored as removed from
+	// Docker, except the given ones. It does nothing for the containers already
+	// marked as removed.
+	MarkRemovedExcept(containerIDs []string) error
+}
+
+// LogWriter appends the logs of a container to the storage.
+type LogWriter interface {
+	io.WriteCloser
+
+	// Position returns the position in the storage following the last byte written.
+	Position() Position
 }
 
 // CollectorOptions are optional parameters used to configure
 // the behavior of the [Collector]
 type CollectorOptions struct {
-	// Containers specifies a list of container names to monitor.
+	// Selector selects the containers to monitor.
 	// If empty, all containers will be monitored.
-	Containers []string
+	Selector ContainerSelector
+
+	// Multiline configures how the lines of multiline records are joined for the
+	// containers which do not configure it themselves. If it does not set any
+	// pattern, the lines are not joined.
+	Multiline MultilineConfig
+
+	// ParseFields is the format of the structured logs whose fields are extracted for the
+	// containers which do not configure it themselves. Defaults to [FieldsFormatNone].
+	ParseFields FieldsFormat
+
+	// Hub broadcasts the collected records to the clients following the logs.
+	// If nil, the records are only saved to the storage.
+	Hub *Hub
 }
 
 // Collector monitors Docker containers, collects their logs and saves them to storage backend.
@@ -45,6 +83,8 @@ type Collector struct {
 	logger  *slog.Logger
 	wg      sync.WaitGroup
 	options CollectorOptions
+
+	registry *collectorRegistry
 }
 
 // NewCollector creates a new log [Collector] that will monitor containers
@@ -56,15 +96,19 @@ func NewCollector(
 	opts CollectorOptions,
 ) *Collector {
 	return &Collector{
-		monitor: monitor,
-		storage: storage,
-		logger:  logger,
-		options: opts,
+		monitor:  monitor,
+		storage:  storage,
+		logger:   logger,
+		options:  opts,
+		registry: newCollectorRegistry(),
 	}
 }
 
 // Run starts the log collection process, discovering existing containers
 // and watching for new ones. It blocks until the context is cancelled.
+//
+// If the connection to Docker is lost, it reconnects with an exponential backoff,
+// replaying the events missed in the meantime and discovering the containers again.
 func (c *Collector) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer func() {
@@ -74,18 +118,55 @@ func (c *Collector) Run(ctx context.Context) error {
 		c.wg.Wait()
 	}()
 
+	// Time from which the events must be watched so that none is missed. The containers
+	// starting during the discovery are also notified by the events but the registry
+	// guarantees that their logs are collected only once.
+	since := checkpoint{time: time.Now()}
+
 	// Discover currently running containers and start collecting their logs.
 	if err := c.discoverContainers(ctx); err != nil {
 		return fmt.Errorf("discover running containers: %w", err)
 	}
 
-	// Watch for new containers and start collecting their logs.
-	// This call is blocking.
-	if err := c.watchContainers(ctx); err != nil {
-		return fmt.Errorf("watch containers: %w", err)
-	}
+	var (
+		bo         = newReconnectBackoff()
+		reconnects int
+	)
+	for {
+		// Watch for new containers and start collecting their logs.
+		// This call is blocking.
+		last, err := c.watchContainers(ctx, since)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if last != since {
+			// Do not replay the events seen.
+			since = last
+			bo.reset()
+		}
 
-	return nil
+		// The events stream was interrupted, e.g. because the Docker daemon restarted.
+		for {
+			reconnects++
+			delay := bo.next()
+			c.logger.Warn(
+				"Docker events stream interrupted, reconnecting",
+				slog.Any("error", err),
+				slog.Int("reconnects", reconnects),
+				slog.Duration("delay", delay),
+			)
+			if !sleep(ctx, delay) {
+				return ctx.Err()
+			}
+
+			// Containers may have started while we were disconnected.
+			err = c.discoverContainers(ctx)
+			if err == nil {
+				break
+			}
+			err = fmt.Errorf("discover running containers: %w", err)
+		}
+	}
 }
 
 func (c *Collector) discoverContainers(ctx context.Context) error {
@@ -94,73 +175,172 @@ func (c *Collector) discoverContainers(ctx context.Context) error {
 		return fmt.Errorf("list containers: %w", err)
 	}
 
+	// The containers may have been removed while the proxy was stopped or the events
+	// stream was interrupted, in which case no event notified their removal.
+	containerIDs := make([]string, len(containers))
+	for i, ctr := range containers {
+		containerIDs[i] = ctr.ID
+	}
+	if err := c.storage.MarkRemovedExcept(containerIDs); err != nil {
+		c.logger.Warn("Failed to mark containers as removed", slog.Any("error", err))
+	}
+
 	for _, ctr := range containers {
-		if !c.shouldWatchContainer(ctr.Name) {
+		// The containers may have started while the events stream was interrupted.
+		if c.options.Hub != nil && ctr.State == "running" {
+			c.options.Hub.PublishStart(ctr)
+		}
+
+		if !c.shouldWatchContainer(ctr) {
 			continue
 		}
 
-		c.wg.Go(func() {
-			if err := c.collectContainerLogs(ctx, ctr); err != nil {
-				c.logger.Error(
-					"Stopped collecting logs",
-					slog.Any("error", err),
-					slog.String("containerName", ctr.Name),
-				)
-			}
-		})
+		c.startCollecting(ctx, ctr)
 	}
 
 	return nil
 }
 
-func (c *Collector) watchContainers(ctx context.Context) error {
-	events, errs := c.monitor.WatchContainers(ctx)
+// watchContainers handles the container events occurring after the given checkpoint
+// until the events stream ends. It returns the checkpoint of the last event handled.
+func (c *Collector) watchContainers(ctx context.Context, since checkpoint) (checkpoint, error) {
+	last := since
+	// The events sharing the time of the checkpoint are sent again.
+	replayed := since
+
+	events, errs := c.monitor.WatchContainers(ctx, since.time)
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return last, ctx.Err()
 
 		case event, ok := <-events:
 			if !ok {
-				return nil
+				return last, errors.New("events stream closed")
 			}
-
-			if !c.shouldWatchContainer(event.Container.Name) {
+			if replayed.skip(event.Time) {
 				continue
 			}
+			last.advance(event.Time)
 
 			switch event.Type {
 			case EventTypeStarted:
-				c.wg.Go(func() {
-					if err := c.collectContainerLogs(ctx, event.Container); err != nil {
-						c.logger.Error(
-							"Stopped collecting logs",
-							slog.Any("error", err),
-							slog.String("containerName", event.Container.Name),
-						)
-					}
-				})
+				// Notify the clients waiting for the container, whether collected or not.
+				if c.options.Hub != nil {
+					c.options.Hub.PublishStart(event.Container)
+				}
+				if c.shouldWatchContainer(event.Container) {
+					c.startCollecting(ctx, event.Container)
+				}
 
 			case EventTypeRemoved:
-				c.logger.Info(
-					"Container removed",
-					slog.String("containerName", event.Container.Name),
-					slog.String("containerId", event.Container.ID),
-				)
-				// The log collection goroutine will naturally exit when the container
-				// stops producing logs and the stream closes.
+				// Do not wait for the log stream to close as nothing more can be collected.
+				if c.registry.remove(event.Container.ID) {
+					c.logger.Info(
+						"Container removed",
+						slog.String("containerName", event.Container.Name),
+						slog.String("containerId", event.Container.ID),
+					)
+				}
+				if c.options.Hub != nil {
+					c.options.Hub.RemoveContainer(event.Container)
+				}
+
+				// The logs of the container may have been collected before the proxy restarted.
+				if err := c.storage.MarkRemoved(event.Container.ID, event.Time); err != nil {
+					c.logger.Warn(
+						"Failed to mark container as removed",
+						slog.Any("error", err),
+						slog.String("containerName", event.Container.Name),
+					)
+				}
 			}
 
 		case err, ok := <-errs:
 			if !ok {
-				return nil
+				return last, errors.New("events stream closed")
 			}
 
-			return err
+			return last, err
+		}
+	}
+}
+
+// startCollecting collects the logs of the container in a new goroutine,
+// unless they are already being collected.
+func (c *Collector) startCollecting(ctx context.Context, container Container) {
+	collectorCtx, ok := c.registry.register(ctx, container)
+	if !ok {
+		return
+	}
+
+	c.wg.Go(func() {
+		for {
+			if err := c.collectContainerLogs(collectorCtx, container); err != nil {
+				c.logger.Error(
+					"Stopped collecting logs",
+					slog.Any("error", err),
+					slog.String("containerName", container.Name),
+				)
+			}
+
+			var restarted bool
+			container, restarted = c.registry.finish(collectorCtx, container.ID)
+			if !restarted {
+				return
+			}
+		}
+	})
+}
+
+// State returns the state of the collection of the container's logs.
+// It returns false if the logs of the container have never been collected or
+// the container was removed.
+func (c *Collector) State(containerID string) (CollectorState, bool) {
+	return c.registry.state(containerID)
+}
+
+// Status returns the status of the collection of the logs of every container
+// discovered since the collector started and not removed since, sorted by container name.
+func (c *Collector) Status() []CollectorStatus {
+	statuses := c.registry.statuses(time.Now())
+	if c.options.Hub != nil {
+		for i := range statuses {
+			c.options.Hub.setFollowerStats(&statuses[i])
 		}
 	}
+	return statuses
 }
 
+// ContainerStatus returns the status of the collection of the container's logs.
+// The containerNameOrID parameter accepts either a container name or ID.
+//
+// Returns [*ContainerNotFoundError] if the logs of the container are not collected.
+func (c *Collector) ContainerStatus(containerNameOrID string) (CollectorStatus, error) {
+	status, ok := c.registry.status(containerNameOrID, time.Now())
+	if !ok {
+		return CollectorStatus{}, &ContainerNotFoundError{Name: containerNameOrID}
+	}
+	if c.options.Hub != nil {
+		c.options.Hub.setFollowerStats(&status)
+	}
+	return status, nil
+}
+
+// setState moves the collector of the container to the given state.
+func (c *Collector) setState(container Container, state CollectorState) {
+	if err := c.registry.transition(container.ID, state); err != nil {
+		c.logger.Error(
+			"Failed to update collector state",
+			slog.Any("error", err),
+			slog.String("containerName", container.Name),
+		)
+	}
+}
+
+// collectContainerLogs saves the logs of the container until it stops. If the log
+// stream is interrupted while the container is still running, e.g. because the Docker
+// daemon restarted, it reconnects with an exponential backoff.
 func (c *Collector) collectContainerLogs(ctx context.Context, container Container) error {
 	c.logger.Info(
 		"Start collecting logs",
@@ -168,39 +348,228 @@ func (c *Collector) collectContainerLogs(ctx context.Context, container Containe
 		slog.String("containerId", container.ID),
 		slog.Bool("tty", container.TTY),
 	)
+	if c.options.Hub != nil {
+		// The followers read the rest of the logs from the storage, if any.
+		defer c.options.Hub.EndSubscriptions(container)
+	}
+
+	bo := newReconnectBackoff()
+	for {
+		n, err := c.copyContainerLogs(ctx, container)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if n > 0 {
+			bo.reset()
+		}
+		if err != nil {
+			c.registry.recordError(container.ID, err)
+		}
+
+		// The log stream ends when the container stops, so save its final state
+		// (e.g. finish time and exit code) while Docker still knows about it.
+		current, inspectErr := c.monitor.InspectContainer(ctx, container.ID)
+		var notFoundErr *ContainerNotFoundError
+		switch {
+		case errors.As(inspectErr, &notFoundErr):
+			return err
 
+		case inspectErr == nil && current.State != "running":
+			c.saveFinalState(current)
+			return err
+		}
+
+		// The container is still running or Docker is unreachable.
+		if inspectErr == nil {
+			// Keep track of a restart which occurred in the meantime.
+			container = current
+		} else {
+			c.registry.recordError(container.ID, inspectErr)
+		}
+		c.setState(container, CollectorStateBackingOff)
+		reconnects := c.registry.recordReconnect(container.ID)
+		delay := bo.next()
+		c.logger.Warn(
+			"Log stream interrupted, reconnecting",
+			slog.Any("error", errors.Join(err, inspectErr)),
+			slog.String("containerName", container.Name),
+			slog.Int("reconnects", reconnects),
+			slog.Duration("delay", delay),
+		)
+		if !sleep(ctx, delay) {
+			return nil
+		}
+		c.setState(container, CollectorStatePending)
+	}
+}
+
+// copyContainerLogs appends the logs of the container following the last stored record
+// to the storage until the log stream ends. It returns the number of bytes written.
+func (c *Collector) copyContainerLogs(ctx context.Context, container Container) (int64, error) {
 	// We include everything here to make sure we can filter them later
-	// if needed.
-	r, err := c.monitor.StreamContainerLogs(ctx, Query{
+	// if needed, unless the container restricts the collected stream.
+	query := Query{
 		ContainerName: container.Name,
-		IncludeStdout: true,
-		IncludeStderr: true,
+		IncludeStdout: container.Settings.IncludesStream(StreamTypeStdout),
+		IncludeStderr: container.Settings.IncludesStream(StreamTypeStderr),
 		Follow:        true,
-	})
+	}
+
+	// Resume from the last stored record so that restarting the proxy neither
+	// duplicates the logs already stored nor loses the ones Docker rotated away.
+	last, count, err := c.storage.LastTimestamp(container.ID)
+	if err != nil {
+		return 0, fmt.Errorf("get last stored timestamp: %w", err)
+	}
+	if !last.IsZero() {
+		c.logger.Info(
+			"Resuming log collection",
+			slog.String("containerName", container.Name),
+			slog.Time("since", last),
+		)
+		query.Since = last
+	}
+
+	r, err := c.monitor.StreamContainerLogs(ctx, query)
 	if err != nil {
-		return fmt.Errorf("fetch container logs: %w", err)
+		return 0, fmt.Errorf("fetch container logs: %w", err)
 	}
 	defer r.Close()
+	// Make sure the copy stops as soon as the collection is canceled.
+	stop := context.AfterFunc(ctx, func() { r.Close() })
+	defer stop()
 
 	f, err := c.storage.Create(container)
 	if err != nil {
-		return fmt.Errorf("create log file: %w", err)
+		return 0, fmt.Errorf("create log file: %w", err)
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, r)
+	c.setState(container, CollectorStateStreaming)
+
+	var w io.Writer = f
+	if c.options.Hub != nil {
+		// Publish the records once they are saved so that followers can
+		// read the ones preceding them from the storage.
+		w = &publishWriter{w: f, hub: c.options.Hub, container: container}
+	}
+	w = &statsWriter{
+		w: w,
+		onWrite: func(n, records int, last time.Time) {
+			c.registry.recordWrite(container.ID, n, records, last)
+		},
+	}
+	fieldsFormat := cmp.Or(container.Settings.ParseFields, c.options.ParseFields)
+	if fieldsFormat != "" && fieldsFormat != FieldsFormatNone {
+		// Extract the fields once the lines of multiline records are joined.
+		w = newFieldsWriter(w, fieldsFormat)
+	}
+	multiline := container.Settings.Multiline.withDefaults(c.options.Multiline)
+	if multiline.Enabled() {
+		mw := newMultilineWriter(w, multiline)
+		// Write the last multiline record before closing the log file.
+		defer mw.Close()
+		w = mw
+	}
+	if count > 0 {
+		// The records sharing the timestamp of the last stored record are sent again.
+		w = &skipWriter{w: w, stored: checkpoint{time: last, count: count}}
+	}
+	n, err := io.Copy(w, r)
 	if err != nil {
-		return fmt.Errorf("copy logs to file: %w", err)
+		return n, fmt.Errorf("copy logs to file: %w", err)
 	}
 
-	return nil
+	return n, nil
 }
 
-func (c *Collector) shouldWatchContainer(containerName string) bool {
-	// Watch all containers if no specific containers specified
-	if len(c.options.Containers) == 0 {
+// checkpoint identifies the last record or event handled in a stream ordered by time,
+// by its time and the number of them handled at this time. The stream can then be
+// resumed from this time without missing the records or events sharing it.
+type checkpoint struct {
+	time  time.Time
+	count int
+}
+
+// advance moves the checkpoint to a record or event handled at t.
+func (c *checkpoint) advance(t time.Time) {
+	switch {
+	case t.Equal(c.time):
+		c.count++
+	case t.After(c.time):
+		c.time, c.count = t, 1
+	}
+}
+
+// skip reports whether the record or event at t, read in order from the stream resumed
+// from the checkpoint, was already handled. Only the first ones at its time can be.
+func (c *checkpoint) skip(t time.Time) bool {
+	if c.count > 0 && t.Equal(c.time) {
+		c.count--
 		return true
 	}
+	c.count = 0
+	return false
+}
+
+// skipWriter drops the NDJSON records written to w which were already stored
+// before the collection resumed from the stored checkpoint.
+type skipWriter struct {
+	w      io.Writer
+	stored checkpoint
+	// partial is the beginning of the next record, not yet terminated by a newline.
+	partial []byte
+}
+
+func (w *skipWriter) Write(p []byte) (int, error) {
+	if w.stored.count == 0 && len(w.partial) == 0 {
+		return w.w.Write(p)
+	}
+
+	w.partial = append(w.partial, p...)
+	for w.stored.count > 0 {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		var rec struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		if json.Unmarshal(w.partial[:i], &rec) != nil || !w.stored.skip(rec.Timestamp) {
+			// The records following it are not stored yet.
+			w.stored.count = 0
+			break
+		}
+		w.partial = w.partial[i+1:]
+	}
 
-	return slices.Contains(c.options.Containers, containerName)
+	rest := w.partial
+	w.partial = nil
+	if len(rest) > 0 {
+		if _, err := w.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *Collector) saveFinalState(container Container) {
+	if err := c.storage.UpdateMetadata(container); err != nil {
+		c.logger.Warn(
+			"Failed to update container metadata",
+			slog.Any("error", err),
+			slog.String("containerName", container.Name),
+		)
+	}
+}
+
+func (c *Collector) shouldWatchContainer(container Container) bool {
+	if container.Settings.Disabled {
+		c.logger.Debug(
+			"Log collection disabled by container label",
+			slog.String("containerName", container.Name),
+		)
+		return false
+	}
+	return c.options.Selector.Selects(container)
 }
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// CollectorStatus describes the collection of a container's logs.
+type CollectorStatus struct {
+	// ContainerID is the ID of the container.
+	ContainerID string `json:"containerId"`
+
+	// ContainerName is the name of the container.
+	ContainerName string `json:"containerName"`
+
+	// State is the state of the collector.
+	State CollectorState `json:"state"`
+
+	// BytesWritten is the number of bytes of logs saved to the storage.
+	BytesWritten int64 `json:"bytesWritten"`
+
+	// RecordsWritten is the number of log records saved to the storage.
+	RecordsWritten int64 `json:"recordsWritten"`
+
+	// LastRecordAt is the timestamp of the last log record saved to the storage.
+	LastRecordAt time.Time `json:"lastRecordAt,omitzero"`
+
+	// LagSeconds is the number of seconds elapsed since the timestamp of the last
+	// log record saved. It keeps growing if the logs stop being captured, but also
+	// if the container stops emitting logs.
+	LagSeconds float64 `json:"lagSeconds"`
+
+	// Errors is the number of times the log stream failed.
+	Errors int `json:"errors"`
+
+	// LastError is the message of the last error, if any.
+	LastError string `json:"lastError,omitempty"`
+
+	// Reconnects is the number of times the log stream was reopened after being interrupted.
+	Reconnects int `json:"reconnects"`
+
+	// Followers is the number of clients currently following the logs through the hub.
+	Followers int `json:"followers"`
+
+	// FollowerRecordsDropped is the number of records dropped because a follower
+	// did not receive them fast enough.
+	FollowerRecordsDropped int64 `json:"followerRecordsDropped"`
+
+	// FollowersDisconnected is the number of followers disconnected because they
+	// did not receive the records fast enough.
+	FollowersDisconnected int64 `json:"followersDisconnected"`
+}
+
+// statsWriter counts the bytes and NDJSON records written to w and keeps
+// track of the timestamp of the last record.
+type statsWriter struct {
+	w io.Writer
+	// onWrite is called after each write with the number of bytes and complete
+	// records written, and the timestamp of the last complete record if any.
+	onWrite func(n, records int, last time.Time)
+	// partial is the beginning of the last record, not yet terminated by a newline.
+	partial []byte
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	written := p[:n]
+
+	var (
+		records = bytes.Count(written, []byte{'\n'})
+		last    time.Time
+	)
+	if i := bytes.LastIndexByte(written, '\n'); i >= 0 {
+		line := written[:i]
+		if j := bytes.LastIndexByte(line, '\n'); j >= 0 {
+			line = line[j+1:]
+		} else {
+			line = append(w.partial, line...)
+		}
+
+		var rec struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		if json.Unmarshal(line, &rec) == nil {
+			last = rec.Timestamp
+		}
+		w.partial = append(w.partial[:0], written[i+1:]...)
+	} else {
+		w.partial = append(w.partial, written...)
+	}
+
+	w.onWrite(n, records, last)
+	return n, err
+}
@@ -2,13 +2,19 @@ package log_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
 	"testing/synctest"
+	"time"
 
 	"github.com/matthieugusmini/docker-logproxy/internal/log"
 )
@@ -51,6 +57,93 @@ func TestCollector_Run(t *testing.T) {
 		})
 	})
 
+	t.Run("saves final state when container stops", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo", State: "exited", ExitCode: 137},
+			}
+			monitor.logs["foo"] = io.NopCloser(strings.NewReader("log data\n"))
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			ctr, ok := storage.getMetadata("foo")
+			if !ok {
+				t.Fatal("container metadata not updated")
+			}
+			if ctr.ExitCode != 137 {
+				t.Errorf("exit code = %d, want %d", ctr.ExitCode, 137)
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("resumes after the last stored record", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo"},
+				{ID: "def456", Name: "bar"},
+			}
+			// The first record sharing the time of the last stored one is already stored.
+			stored := `{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"1\n"}` + "\n"
+			next := `{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"2\n"}` + "\n" +
+				`{"timestamp":"2024-01-01T12:00:01Z","stream":"stdout","output":"3\n"}` + "\n"
+			monitor.logs["foo"] = io.NopCloser(strings.NewReader(stored + next))
+
+			checkpoint := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			storage := newFakeStorageWriter()
+			storage.checkpoints["abc123"] = checkpoint
+			storage.checkpointCounts["abc123"] = 1
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			sinceByName := make(map[string]time.Time)
+			for _, query := range monitor.getQueries() {
+				sinceByName[query.ContainerName] = query.Since
+			}
+			if !sinceByName["foo"].Equal(checkpoint) {
+				t.Errorf("since = %v, want %v", sinceByName["foo"], checkpoint)
+			}
+			if since := sinceByName["bar"]; !since.IsZero() {
+				t.Errorf("since = %v, want zero time for a container without stored logs", since)
+			}
+
+			w, ok := storage.getWriter("foo")
+			if !ok {
+				t.Fatal("container logs not collected")
+			}
+			if got := w.buf.String(); got != next {
+				t.Errorf("container logs = %q, want %q", got, next)
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
 	t.Run("watches for new container events", func(t *testing.T) {
 		synctest.Test(t, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -112,9 +205,8 @@ func TestCollector_Run(t *testing.T) {
 
 			storage := newFakeStorageWriter()
 			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{
-				Containers: []string{
-					"webapp",
-					"database",
+				Selector: log.ContainerSelector{
+					Include: mustParseMatchers(t, "webapp", "database"),
 				},
 			})
 
@@ -148,7 +240,9 @@ func TestCollector_Run(t *testing.T) {
 			monitor := newFakeContainerMonitor()
 			storage := newFakeStorageWriter()
 			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{
-				Containers: []string{"allowed"},
+				Selector: log.ContainerSelector{
+					Include: mustParseMatchers(t, "allowed"),
+				},
 			})
 
 			go func() {
@@ -215,113 +309,962 @@ func TestCollector_Run(t *testing.T) {
 		})
 	})
 
-	t.Run("stops when container monitoring fails", func(t *testing.T) {
+	t.Run("collects each container only once", func(t *testing.T) {
 		synctest.Test(t, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
 			logger := slog.New(slog.DiscardHandler)
 			monitor := newFakeContainerMonitor()
+			container := log.Container{ID: "abc123", Name: "foo", State: "running"}
+			monitor.containers = []log.Container{container}
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			monitor.logs["foo"] = pr
+
 			storage := newFakeStorageWriter()
 			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
 
-			errCh := make(chan error, 1)
 			go func() {
-				errCh <- collector.Run(ctx)
+				_ = collector.Run(ctx)
 			}()
 
 			synctest.Wait()
 
-			wantErr := errors.New("unexpected error when watching events")
-			monitor.errs <- wantErr
+			// The container started during the discovery so it is also notified by an event.
+			monitor.events <- log.ContainerEvent{Type: log.EventTypeStarted, Container: container}
 
 			synctest.Wait()
 
-			select {
-			case err := <-errCh:
-				if !errors.Is(err, wantErr) {
-					t.Errorf("expected watch error, got %v", err)
-				}
-			default:
-				t.Error("collector should have stopped when monitoring failed")
+			if got := len(monitor.getQueries()); got != 1 {
+				t.Errorf("expected 1 log stream, got %d", got)
 			}
+			if state, _ := collector.State("abc123"); state != log.CollectorStateStreaming {
+				t.Errorf("state = %q, want %q", state, log.CollectorStateStreaming)
+			}
+
+			cancel()
+			synctest.Wait()
 		})
 	})
-}
 
-type fakeContainerMonitor struct {
-	containers []log.Container
-	events     chan log.ContainerEvent
-	errs       chan error
-	logs       map[string]io.ReadCloser
-	listErr    error
-}
+	t.Run("stops collecting when container is removed", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 
-func newFakeContainerMonitor() *fakeContainerMonitor {
-	return &fakeContainerMonitor{
-		containers: []log.Container{},
-		events:     make(chan log.ContainerEvent),
-		errs:       make(chan error),
-		logs:       make(map[string]io.ReadCloser),
-	}
-}
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			container := log.Container{ID: "abc123", Name: "foo", State: "running"}
+			monitor.containers = []log.Container{container}
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			monitor.logs["foo"] = pr
 
-func (f *fakeContainerMonitor) ListContainers(ctx context.Context) ([]log.Container, error) {
-	if f.listErr != nil {
-		return nil, f.listErr
-	}
-	return f.containers, nil
-}
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
 
-func (f *fakeContainerMonitor) WatchContainers(
-	ctx context.Context,
-) (<-chan log.ContainerEvent, <-chan error) {
-	return f.events, f.errs
-}
+			go func() {
+				_ = collector.Run(ctx)
+			}()
 
-func (f *fakeContainerMonitor) StreamContainerLogs(
-	ctx context.Context,
-	query log.Query,
-) (io.ReadCloser, error) {
-	if rc, ok := f.logs[query.ContainerName]; ok {
-		return rc, nil
-	}
-	return io.NopCloser(strings.NewReader("")), nil
-}
+			synctest.Wait()
 
-type fakeStorageWriter struct {
-	mu      sync.Mutex
-	writers map[string]*fakeWriteCloser
-}
+			removedAt := time.Now()
+			monitor.events <- log.ContainerEvent{
+				Type:      log.EventTypeRemoved,
+				Container: container,
+				Time:      removedAt,
+			}
 
-func newFakeStorageWriter() *fakeStorageWriter {
-	return &fakeStorageWriter{
-		writers: make(map[string]*fakeWriteCloser),
-	}
-}
+			synctest.Wait()
 
-func (f *fakeStorageWriter) Create(container log.Container) (io.WriteCloser, error) {
-	wc := &fakeWriteCloser{buf: &strings.Builder{}}
-	f.mu.Lock()
-	f.writers[container.Name] = wc
-	f.mu.Unlock()
-	return wc, nil
-}
+			if state, ok := collector.State("abc123"); ok {
+				t.Errorf("expected removed container to be forgotten, got state %q", state)
+			}
+			if got, ok := storage.getRemoval("abc123"); !ok || !got.Equal(removedAt) {
+				t.Errorf("expected container to be marked removed at %v, got %v", removedAt, got)
+			}
+			if _, err := pw.Write([]byte("late logs\n")); !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("log stream should be closed, got %v", err)
+			}
 
-func (f *fakeStorageWriter) getWriter(name string) (*fakeWriteCloser, bool) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	w, ok := f.writers[name]
-	return w, ok
-}
+			cancel()
+			synctest.Wait()
+		})
+	})
 
-type fakeWriteCloser struct {
-	buf    *strings.Builder
-	closed bool
-}
+	t.Run("marks the containers removed while stopped", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
 
-func (f *fakeWriteCloser) Write(p []byte) (n int, err error) {
-	return f.buf.Write(p)
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{{ID: "abc123", Name: "foo", State: "exited"}}
+
+			storage := newFakeStorageWriter()
+			storage.stored = []string{"abc123", "def456"}
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			if _, ok := storage.getRemoval("def456"); !ok {
+				t.Error("expected the container missing from Docker to be marked removed")
+			}
+			if _, ok := storage.getRemoval("abc123"); ok {
+				t.Error("expected the container listed in Docker not to be marked removed")
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("tracks collection statistics", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo", State: "running"},
+			}
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			monitor.logs["foo"] = pr
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			// Strip the monotonic clock reading to compare with the parsed timestamp.
+			lastRecordAt := time.Now().UTC().Round(0).Add(-time.Minute)
+			records := fmt.Sprintf(
+				`{"timestamp":%q,"stream":"stdout","output":"a\n"}`+"\n"+
+					`{"timestamp":%q,"stream":"stdout","output":"b\n"}`+"\n",
+				lastRecordAt.Add(-time.Second).Format(time.RFC3339Nano),
+				lastRecordAt.Format(time.RFC3339Nano),
+			)
+			// Split the writes in the middle of a record.
+			if _, err := io.WriteString(pw, records[:10]); err != nil {
+				t.Fatalf("failed to write logs: %v", err)
+			}
+			if _, err := io.WriteString(pw, records[10:]); err != nil {
+				t.Fatalf("failed to write logs: %v", err)
+			}
+
+			synctest.Wait()
+
+			status, err := collector.ContainerStatus("foo")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := log.CollectorStatus{
+				ContainerID:    "abc123",
+				ContainerName:  "foo",
+				State:          log.CollectorStateStreaming,
+				BytesWritten:   int64(len(records)),
+				RecordsWritten: 2,
+				LastRecordAt:   lastRecordAt,
+				LagSeconds:     60,
+			}
+			if !reflect.DeepEqual(status, want) {
+				t.Errorf("expected %+v, got %+v", want, status)
+			}
+
+			if _, err := collector.ContainerStatus("unknown"); err == nil {
+				t.Error("expected error for unknown container")
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("publishes the collected records to the hub", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo", State: "running"},
+			}
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			monitor.logs["foo"] = pr
+
+			hub := log.NewHub(log.HubOptions{})
+			sub := hub.Subscribe("foo")
+			defer sub.Close()
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{
+				Hub: hub,
+			})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			records := `{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"a\n"}` + "\n"
+			// Split the writes in the middle of a record.
+			if _, err := io.WriteString(pw, records[:10]); err != nil {
+				t.Fatalf("failed to write logs: %v", err)
+			}
+			if _, err := io.WriteString(pw, records[10:]); err != nil {
+				t.Fatalf("failed to write logs: %v", err)
+			}
+
+			synctest.Wait()
+
+			want := log.Record{
+				Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+				Stream:    log.StreamTypeStdout,
+				Log:       "a\n",
+			}
+			if got := <-sub.Records(); !reflect.DeepEqual(got.Record, want) {
+				t.Errorf("expected %+v, got %+v", want, got)
+			}
+
+			status, err := collector.ContainerStatus("foo")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status.Followers != 1 {
+				t.Errorf("expected %d followers, got %d", 1, status.Followers)
+			}
+
+			// The subscriptions end once the collection stops.
+			cancel()
+			synctest.Wait()
+
+			if _, ok := <-sub.Records(); ok {
+				t.Error("expected the subscription to end")
+			}
+		})
+	})
+
+	t.Run("reconnects when container monitoring fails", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			eventTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			monitor.logs["foo"] = io.NopCloser(strings.NewReader("foo logs\n"))
+			monitor.events <- log.ContainerEvent{
+				Type:      log.EventTypeStarted,
+				Container: log.Container{ID: "abc123", Name: "foo"},
+				Time:      eventTime,
+			}
+
+			synctest.Wait()
+
+			// A container starts while the Docker daemon is unreachable.
+			monitor.setContainers([]log.Container{{ID: "def456", Name: "bar", State: "running"}})
+			monitor.logs["bar"] = io.NopCloser(strings.NewReader("bar logs\n"))
+			monitor.errs <- errors.New("unexpected error when watching events")
+
+			synctest.Wait()
+
+			select {
+			case err := <-errCh:
+				t.Fatalf("collector should not have stopped: %v", err)
+			default:
+			}
+
+			// Wait for the reconnection.
+			time.Sleep(time.Minute)
+			synctest.Wait()
+
+			if _, ok := storage.getWriter("bar"); !ok {
+				t.Error("containers should be discovered again after reconnecting")
+			}
+
+			watches := monitor.getWatches()
+			if len(watches) != 2 {
+				t.Fatalf("expected 2 watches, got %d", len(watches))
+			}
+			if !watches[1].Equal(eventTime) {
+				t.Errorf("since = %v, want %v", watches[1], eventTime)
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("reconnects when log stream is interrupted", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo", State: "running"},
+			}
+			monitor.logs["foo"] = io.NopCloser(strings.NewReader("before\n"))
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			// The container is still running so the stream must be reopened.
+			monitor.setLogs("foo", io.NopCloser(strings.NewReader("after\n")))
+			monitor.setContainers([]log.Container{{ID: "abc123", Name: "foo", State: "exited"}})
+
+			time.Sleep(time.Minute)
+			synctest.Wait()
+
+			w, ok := storage.getWriter("foo")
+			if !ok {
+				t.Fatal("container logs not collected")
+			}
+			want := "before\nafter\n"
+			if got := w.buf.String(); got != want {
+				t.Errorf("container logs = %q, want %q", got, want)
+			}
+
+			if got := len(monitor.getQueries()); got != 2 {
+				t.Errorf("expected 2 log streams, got %d", got)
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+}
+
+func TestCollector_Settings(t *testing.T) {
+	t.Run("skips containers disabled by label", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo", Settings: mustParseSettings(t, map[string]string{
+					"logproxy.enable": "false",
+				})},
+			}
+			monitor.logs["foo"] = io.NopCloser(strings.NewReader("foo logs\n"))
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			if _, ok := storage.getWriter("foo"); ok {
+				t.Error("foo should NOT be collected (disabled by label)")
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("collects only the configured stream", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo", Settings: mustParseSettings(t, map[string]string{
+					"logproxy.stream": "stderr",
+				})},
+			}
+			monitor.logs["foo"] = io.NopCloser(strings.NewReader(""))
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			queries := monitor.getQueries()
+			if len(queries) == 0 {
+				t.Fatal("container logs not collected")
+			}
+			if queries[0].IncludeStdout || !queries[0].IncludeStderr {
+				t.Errorf(
+					"expected only stderr to be collected, got stdout=%t stderr=%t",
+					queries[0].IncludeStdout,
+					queries[0].IncludeStderr,
+				)
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("joins multiline records", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo", Settings: mustParseSettings(t, map[string]string{
+					"logproxy.multiline.pattern": `^\d{4}-`,
+				})},
+			}
+			pr, pw := io.Pipe()
+			monitor.logs["foo"] = pr
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			lines := []string{
+				`{"timestamp":"2025-01-01T00:00:00Z","stream":"stderr","output":"2025-01-01 panic\n"}`,
+				`{"timestamp":"2025-01-01T00:00:01Z","stream":"stderr","output":"\tat main.go:12\n"}`,
+				`{"timestamp":"2025-01-01T00:00:02Z","stream":"stderr","output":"\tat main.go:34\n"}`,
+				`{"timestamp":"2025-01-01T00:00:03Z","stream":"stderr","output":"2025-01-01 next\n"}`,
+			}
+			for _, line := range lines {
+				_, _ = io.WriteString(pw, line+"\n")
+			}
+			synctest.Wait()
+
+			w, ok := storage.getWriter("foo")
+			if !ok {
+				t.Fatal("container logs not collected")
+			}
+			want := `{"timestamp":"2025-01-01T00:00:00Z","stream":"stderr",` +
+				`"output":"2025-01-01 panic\n\tat main.go:12\n\tat main.go:34\n"}` + "\n"
+			if got := w.String(); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+
+			// The last record is written once no line is appended to it for a while.
+			time.Sleep(2 * time.Second)
+			synctest.Wait()
+
+			want += lines[3] + "\n"
+			if got := w.String(); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+
+			pw.Close()
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("extracts the fields of structured records", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{
+				{ID: "abc123", Name: "foo"},
+				{
+					ID:   "def456",
+					Name: "bar",
+					Settings: mustParseSettings(t, map[string]string{
+						"logproxy.parse-fields": "none",
+					}),
+				},
+			}
+			fooReader, fooWriter := io.Pipe()
+			monitor.logs["foo"] = fooReader
+			barReader, barWriter := io.Pipe()
+			monitor.logs["bar"] = barReader
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{
+				ParseFields: log.FieldsFormatAuto,
+			})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			lines := []string{
+				`{"timestamp":"2025-01-01T00:00:00Z","stream":"stdout",` +
+					`"output":"level=warn user_id=42\n"}`,
+				`{"timestamp":"2025-01-01T00:00:01Z","stream":"stdout","output":"plain text\n"}`,
+			}
+			for _, line := range lines {
+				_, _ = io.WriteString(fooWriter, line+"\n")
+				_, _ = io.WriteString(barWriter, line+"\n")
+			}
+			fooWriter.Close()
+			barWriter.Close()
+			synctest.Wait()
+
+			w, ok := storage.getWriter("foo")
+			if !ok {
+				t.Fatal("container logs not collected")
+			}
+			want := `{"timestamp":"2025-01-01T00:00:00Z","stream":"stdout",` +
+				`"output":"level=warn user_id=42\n","fields":{"level":"warn","user_id":"42"}}` +
+				"\n" + lines[1] + "\n"
+			if got := w.String(); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+
+			// The container labels take precedence over the collector options.
+			w, ok = storage.getWriter("bar")
+			if !ok {
+				t.Fatal("container logs not collected")
+			}
+			want = lines[0] + "\n" + lines[1] + "\n"
+			if got := w.String(); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+
+	t.Run("joins the stack traces of the multiline presets", func(t *testing.T) {
+		testCases := []struct {
+			preset string
+			lines  []string
+		}{
+			{
+				preset: "java",
+				lines: []string{
+					"Exception in thread \"main\" java.lang.IllegalStateException: boom\n",
+					"\tat com.example.Main.run(Main.java:12)\n",
+					"Caused by: java.io.IOException: closed\n",
+					"\t... 3 more\n",
+				},
+			},
+			{
+				preset: "python",
+				lines: []string{
+					"Traceback (most recent call last):\n",
+					"  File \"main.py\", line 3, in <module>\n",
+					"    run()\n",
+					"ValueError: boom\n",
+				},
+			},
+			{
+				preset: "go",
+				lines: []string{
+					"panic: boom\n",
+					"\n",
+					"goroutine 1 [running]:\n",
+					"main.main()\n",
+					"\t/app/main.go:12 +0x1d\n",
+					"exit status 2\n",
+				},
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.preset, func(t *testing.T) {
+				synctest.Test(t, func(t *testing.T) {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+
+					logger := slog.New(slog.DiscardHandler)
+					monitor := newFakeContainerMonitor()
+					monitor.containers = []log.Container{
+						{
+							ID:   "abc123",
+							Name: "foo",
+							Settings: mustParseSettings(t, map[string]string{
+								"logproxy.multiline.preset": tc.preset,
+							}),
+						},
+					}
+					pr, pw := io.Pipe()
+					monitor.logs["foo"] = pr
+
+					storage := newFakeStorageWriter()
+					collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{})
+
+					go func() {
+						_ = collector.Run(ctx)
+					}()
+
+					synctest.Wait()
+
+					testTime := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+					enc := json.NewEncoder(pw)
+					for _, line := range append([]string{"starting\n"}, tc.lines...) {
+						_ = enc.Encode(log.Record{
+							Timestamp: testTime,
+							Stream:    log.StreamTypeStderr,
+							Log:       line,
+						})
+					}
+					pw.Close()
+					synctest.Wait()
+
+					w, ok := storage.getWriter("foo")
+					if !ok {
+						t.Fatal("container logs not collected")
+					}
+					var got []string
+					dec := json.NewDecoder(strings.NewReader(w.String()))
+					for dec.More() {
+						var rec log.Record
+						if err := dec.Decode(&rec); err != nil {
+							t.Fatalf("failed to decode record: %v", err)
+						}
+						got = append(got, rec.Log)
+					}
+
+					// The line preceding the stack trace is not joined to it.
+					want := []string{"starting\n", strings.Join(tc.lines, "")}
+					if tc.preset == "go" {
+						// The exit status does not belong to the stack trace.
+						want = []string{
+							"starting\n",
+							strings.Join(tc.lines[:len(tc.lines)-1], ""),
+							tc.lines[len(tc.lines)-1],
+						}
+					}
+					if !slices.Equal(got, want) {
+						t.Errorf("expected %q, got %q", want, got)
+					}
+
+					cancel()
+					synctest.Wait()
+				})
+			})
+		}
+	})
+
+	t.Run("applies the default multiline configuration", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			logger := slog.New(slog.DiscardHandler)
+			monitor := newFakeContainerMonitor()
+			monitor.containers = []log.Container{{ID: "abc123", Name: "foo"}}
+			pr, pw := io.Pipe()
+			monitor.logs["foo"] = pr
+
+			storage := newFakeStorageWriter()
+			collector := log.NewCollector(monitor, storage, logger, log.CollectorOptions{
+				Multiline: log.MultilineConfig{
+					Continuation: regexp.MustCompile(`^\s`),
+					MaxLines:     2,
+				},
+			})
+
+			go func() {
+				_ = collector.Run(ctx)
+			}()
+
+			synctest.Wait()
+
+			lines := []string{
+				`{"timestamp":"2025-01-01T00:00:00Z","stream":"stdout","output":"error\n"}`,
+				`{"timestamp":"2025-01-01T00:00:01Z","stream":"stdout","output":" one\n"}`,
+				`{"timestamp":"2025-01-01T00:00:02Z","stream":"stdout","output":" two\n"}`,
+			}
+			for _, line := range lines {
+				_, _ = io.WriteString(pw, line+"\n")
+			}
+			pw.Close()
+			synctest.Wait()
+
+			w, ok := storage.getWriter("foo")
+			if !ok {
+				t.Fatal("container logs not collected")
+			}
+			// The lines beyond the limit start a new record.
+			want := `{"timestamp":"2025-01-01T00:00:00Z","stream":"stdout",` +
+				`"output":"error\n one\n"}` + "\n" + lines[2] + "\n"
+			if got := w.String(); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+
+			cancel()
+			synctest.Wait()
+		})
+	})
+}
+
+func mustParseSettings(t *testing.T, labels map[string]string) log.ContainerSettings {
+	t.Helper()
+
+	settings, err := log.ParseContainerSettings(labels)
+	if err != nil {
+		t.Fatalf("failed to parse settings: %v", err)
+	}
+	return settings
+}
+
+func mustParseMatchers(t *testing.T, values ...string) []log.ContainerMatcher {
+	t.Helper()
+
+	matchers := make([]log.ContainerMatcher, len(values))
+	for i, v := range values {
+		m, err := log.ParseContainerMatcher(v)
+		if err != nil {
+			t.Fatalf("failed to parse matcher %q: %v", v, err)
+		}
+		matchers[i] = m
+	}
+	return matchers
+}
+
+type fakeContainerMonitor struct {
+	containers []log.Container
+	events     chan log.ContainerEvent
+	errs       chan error
+	logs       map[string]io.ReadCloser
+	listErr    error
+
+	mu      sync.Mutex
+	queries []log.Query
+	watches []time.Time
+}
+
+func newFakeContainerMonitor() *fakeContainerMonitor {
+	return &fakeContainerMonitor{
+		containers: []log.Container{},
+		events:     make(chan log.ContainerEvent),
+		errs:       make(chan error),
+		logs:       make(map[string]io.ReadCloser),
+	}
+}
+
+func (f *fakeContainerMonitor) ListContainers(ctx context.Context) ([]log.Container, error) {
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.containers, nil
+}
+
+func (f *fakeContainerMonitor) setContainers(containers []log.Container) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers = containers
+}
+
+func (f *fakeContainerMonitor) InspectContainer(
+	ctx context.Context,
+	containerNameOrID string,
+) (log.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ctr := range f.containers {
+		if ctr.ID == containerNameOrID || ctr.Name == containerNameOrID {
+			return ctr, nil
+		}
+	}
+	return log.Container{}, &log.ContainerNotFoundError{Name: containerNameOrID}
+}
+
+func (f *fakeContainerMonitor) WatchContainers(
+	ctx context.Context,
+	since time.Time,
+) (<-chan log.ContainerEvent, <-chan error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watches = append(f.watches, since)
+	return f.events, f.errs
+}
+
+func (f *fakeContainerMonitor) getWatches() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.watches)
+}
+
+func (f *fakeContainerMonitor) StreamContainerLogs(
+	ctx context.Context,
+	query log.Query,
+) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+
+	if rc, ok := f.logs[query.ContainerName]; ok {
+		return rc, nil
+	}
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (f *fakeContainerMonitor) setLogs(containerName string, rc io.ReadCloser) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs[containerName] = rc
+}
+
+func (f *fakeContainerMonitor) getQueries() []log.Query {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.queries)
+}
+
+type fakeStorageWriter struct {
+	mu          sync.Mutex
+	writers     map[string]*fakeWriteCloser
+	metadata    map[string]log.Container
+	checkpoints map[string]time.Time
+	// checkpointCounts are the numbers of records stored at the checkpoints.
+	checkpointCounts map[string]int
+	removals         map[string]time.Time
+	// stored are the IDs of the containers whose logs are stored, marked as removed
+	// unless they are listed in Docker.
+	stored []string
+}
+
+func newFakeStorageWriter() *fakeStorageWriter {
+	return &fakeStorageWriter{
+		writers:          make(map[string]*fakeWriteCloser),
+		metadata:         make(map[string]log.Container),
+		checkpoints:      make(map[string]time.Time),
+		checkpointCounts: make(map[string]int),
+		removals:         make(map[string]time.Time),
+	}
+}
+
+func (f *fakeStorageWriter) LastTimestamp(containerID string) (time.Time, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checkpoints[containerID], f.checkpointCounts[containerID], nil
+}
+
+func (f *fakeStorageWriter) Create(container log.Container) (log.LogWriter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Like the real storage, keep appending to the existing logs.
+	if wc, ok := f.writers[container.Name]; ok {
+		return wc, nil
+	}
+	wc := &fakeWriteCloser{buf: &strings.Builder{}}
+	f.writers[container.Name] = wc
+	return wc, nil
+}
+
+func (f *fakeStorageWriter) UpdateMetadata(container log.Container) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.metadata[container.Name] = container
+	return nil
+}
+
+func (f *fakeStorageWriter) MarkRemoved(containerID string, removedAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removals[containerID] = removedAt
+	return nil
+}
+
+func (f *fakeStorageWriter) MarkRemovedExcept(containerIDs []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range f.stored {
+		if _, ok := f.removals[id]; !ok && !slices.Contains(containerIDs, id) {
+			f.removals[id] = time.Time{}
+		}
+	}
+	return nil
+}
+
+func (f *fakeStorageWriter) getRemoval(containerID string) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.removals[containerID]
+	return t, ok
+}
+
+func (f *fakeStorageWriter) getMetadata(name string) (log.Container, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ctr, ok := f.metadata[name]
+	return ctr, ok
+}
+
+func (f *fakeStorageWriter) getWriter(name string) (*fakeWriteCloser, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w, ok := f.writers[name]
+	return w, ok
+}
+
+type fakeWriteCloser struct {
+	mu     sync.Mutex
+	buf    *strings.Builder
+	closed bool
+}
+
+func (f *fakeWriteCloser) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buf.Write(p)
+}
+
+// Position returns the position following the logs written so far.
+func (f *fakeWriteCloser) Position() log.Position {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return log.Position{Offset: int64(f.buf.Len())}
+}
+
+// String returns the logs written so far.
+func (f *fakeWriteCloser) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buf.String()
 }
 
 func (f *fakeWriteCloser) Close() error {
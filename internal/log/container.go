@@ -1,5 +1,7 @@
 package log
 
+import "time"
+
 // Container represents information about a Docker container.
 type Container struct {
 	// ID is the container's unique identifier.
@@ -10,6 +12,46 @@ type Container struct {
 
 	// TTY indicates whether the container has a pseudo-TTY allocated.
 	TTY bool `json:"tty"`
+
+	// State is the state of the container in Docker (e.g. running, exited)
+	// when it was last inspected.
+	State string `json:"state,omitempty"`
+
+	// Image is the name of the image the container was created from.
+	Image string `json:"image,omitempty"`
+
+	// Labels are the labels set on the container.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// CreatedAt is the time at which the container was created.
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+
+	// StartedAt is the time at which the container was last started.
+	StartedAt time.Time `json:"startedAt,omitzero"`
+
+	// FinishedAt is the time at which the container last exited.
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+
+	// ExitCode is the exit code of the container's last run.
+	// It is only meaningful if the container has exited.
+	ExitCode int `json:"exitCode"`
+
+	// Settings configure the collection of the container logs. They are read from its labels.
+	Settings ContainerSettings `json:"-"`
+}
+
+// Run represents a run of a container, from the time it started until it exited.
+type Run struct {
+	// StartedAt is the time at which the container started.
+	StartedAt time.Time `json:"startedAt"`
+
+	// FinishedAt is the time at which the container exited.
+	// It is zero if the run is not known to have finished.
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+
+	// ExitCode is the exit code of the run.
+	// It is only meaningful if the run has finished.
+	ExitCode int `json:"exitCode"`
 }
 
 // EventType represents the type of container event.
@@ -30,4 +72,7 @@ type ContainerEvent struct {
 
 	// Container contains information about the container involved in the event.
 	Container Container
+
+	// Time is the time at which the event occurred.
+	Time time.Time
 }
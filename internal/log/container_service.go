@@ -0,0 +1,235 @@
+package log
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ContainerInspector provides information about the containers known to Docker.
+type ContainerInspector interface {
+	// ListContainers returns all the containers in Docker, running or not.
+	ListContainers(ctx context.Context) ([]Container, error)
+
+	// InspectContainer returns the details of the specified container.
+	// Returns [*ContainerNotFoundError] if the container does not exist.
+	InspectContainer(ctx context.Context, containerNameOrID string) (Container, error)
+}
+
+// ContainerStorage provides information about the containers whose logs are stored.
+type ContainerStorage interface {
+	// ListStoredContainers returns the containers whose logs are stored.
+	ListStoredContainers() ([]StoredContainer, error)
+
+	// GetStoredContainer returns the specified container if its logs are stored.
+	// Returns [*ContainerNotFoundError] if the container logs are not stored.
+	GetStoredContainer(containerNameOrID string) (StoredContainer, error)
+}
+
+// StoredContainer represents a container whose logs are stored.
+type StoredContainer struct {
+	// Container is the container metadata as last saved.
+	Container
+
+	// LogSize is the size of the stored logs in bytes.
+	LogSize int64
+
+	// FirstLogAt is the timestamp of the first stored log record.
+	FirstLogAt time.Time
+
+	// LastLogAt is the timestamp of the last stored log record.
+	LastLogAt time.Time
+
+	// Runs are the runs of the container recorded while collecting its logs,
+	// from the oldest to the latest.
+	Runs []Run
+}
+
+// StateRemoved is the state of the containers that no longer exist in Docker
+// but whose logs are still stored.
+const StateRemoved = "removed"
+
+// ContainerSummary describes a container known to the proxy.
+type ContainerSummary struct {
+	Container
+
+	// Live indicates whether the container still exists in Docker.
+	Live bool `json:"live"`
+
+	// LogSize is the size of the stored logs in bytes.
+	LogSize int64 `json:"logSize"`
+}
+
+// ContainerDetails describes a container known to the proxy in detail.
+type ContainerDetails struct {
+	ContainerSummary
+
+	// FirstLogAt is the timestamp of the first stored log record.
+	FirstLogAt time.Time `json:"firstLogAt,omitzero"`
+
+	// LastLogAt is the timestamp of the last stored log record.
+	LastLogAt time.Time `json:"lastLogAt,omitzero"`
+
+	// Runs are the runs of the container recorded while collecting its logs,
+	// from the oldest to the latest.
+	Runs []Run `json:"runs,omitempty"`
+}
+
+// ContainerFilter represents the parameters for filtering the containers.
+type ContainerFilter struct {
+	// NamePrefix, if not empty, only includes the containers whose name starts with it.
+	NamePrefix string
+
+	// State, if not empty, only includes the containers in this state
+	// (e.g. running, exited or [StateRemoved]).
+	State string
+
+	// Labels, if not empty, only includes the containers having all these labels.
+	// Each label is either "key", matching any value, or "key=value".
+	Labels []string
+}
+
+func (f ContainerFilter) includes(ctr ContainerSummary) bool {
+	return strings.HasPrefix(ctr.Name, f.NamePrefix) &&
+		(f.State == "" || ctr.State == f.State) &&
+		hasLabels(ctr.Labels, f.Labels)
+}
+
+// hasLabels reports whether labels satisfy all the selectors,
+// each being either "key" or "key=value".
+func hasLabels(labels map[string]string, selectors []string) bool {
+	for _, selector := range selectors {
+		key, value, hasValue := strings.Cut(selector, "=")
+		v, ok := labels[key]
+		if !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ContainerService provides information about the containers known to the proxy,
+// whether they still exist in Docker or only their logs remain in storage.
+type ContainerService struct {
+	inspector ContainerInspector
+	storage   ContainerStorage
+}
+
+// NewContainerService creates a new [ContainerService] using the given Docker
+// container inspector and storage.
+func NewContainerService(inspector ContainerInspector, storage ContainerStorage) *ContainerService {
+	return &ContainerService{
+		inspector: inspector,
+		storage:   storage,
+	}
+}
+
+// ListContainers returns the containers existing in Docker merged with the
+// containers whose logs are stored, sorted by name.
+func (s *ContainerService) ListContainers(
+	ctx context.Context,
+	filter ContainerFilter,
+) ([]ContainerSummary, error) {
+	live, err := s.inspector.ListContainers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", err)
+	}
+
+	stored, err := s.storage.ListStoredContainers()
+	if err != nil {
+		return nil, fmt.Errorf("list stored containers: %w", err)
+	}
+
+	summaryByID := make(map[string]*ContainerSummary, len(live)+len(stored))
+	for _, ctr := range live {
+		summaryByID[ctr.ID] = &ContainerSummary{
+			Container: ctr,
+			Live:      true,
+		}
+	}
+	for _, ctr := range stored {
+		if summary, ok := summaryByID[ctr.ID]; ok {
+			summary.LogSize = ctr.LogSize
+			continue
+		}
+
+		ctr.State = StateRemoved
+		summaryByID[ctr.ID] = &ContainerSummary{
+			Container: ctr.Container,
+			LogSize:   ctr.LogSize,
+		}
+	}
+
+	res := make([]ContainerSummary, 0, len(summaryByID))
+	for _, summary := range summaryByID {
+		if filter.includes(*summary) {
+			res = append(res, *summary)
+		}
+	}
+	slices.SortFunc(res, func(a, b ContainerSummary) int {
+		return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.ID, b.ID))
+	})
+
+	return res, nil
+}
+
+// GetContainer returns the details of the specified container. It first attempts
+// to inspect the container in Docker, then falls back to the stored metadata if
+// the container is not found.
+//
+// Returns [*ContainerNotFoundError] if the container is neither in Docker nor in storage.
+func (s *ContainerService) GetContainer(
+	ctx context.Context,
+	containerNameOrID string,
+) (ContainerDetails, error) {
+	var notFoundErr *ContainerNotFoundError
+	live, err := s.inspector.InspectContainer(ctx, containerNameOrID)
+	isLive := err == nil
+	if err != nil && !errors.As(err, &notFoundErr) {
+		return ContainerDetails{}, fmt.Errorf("inspect container: %w", err)
+	}
+
+	// Use the ID if possible as the name may have been reused by another container.
+	storageKey := containerNameOrID
+	if isLive {
+		storageKey = live.ID
+	}
+	stored, err := s.storage.GetStoredContainer(storageKey)
+	isStored := err == nil
+	if err != nil && !errors.As(err, &notFoundErr) {
+		return ContainerDetails{}, fmt.Errorf("get stored container: %w", err)
+	}
+
+	switch {
+	case isLive:
+		return ContainerDetails{
+			ContainerSummary: ContainerSummary{
+				Container: live,
+				Live:      true,
+				LogSize:   stored.LogSize,
+			},
+			FirstLogAt: stored.FirstLogAt,
+			LastLogAt:  stored.LastLogAt,
+			Runs:       stored.Runs,
+		}, nil
+
+	case isStored:
+		stored.State = StateRemoved
+		return ContainerDetails{
+			ContainerSummary: ContainerSummary{
+				Container: stored.Container,
+				LogSize:   stored.LogSize,
+			},
+			FirstLogAt: stored.FirstLogAt,
+			LastLogAt:  stored.LastLogAt,
+			Runs:       stored.Runs,
+		}, nil
+
+	default:
+		return ContainerDetails{}, &ContainerNotFoundError{Name: containerNameOrID}
+	}
+}
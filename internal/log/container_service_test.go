@@ -0,0 +1,221 @@
+package log_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestContainerService_ListContainers(t *testing.T) {
+	inspector := &fakeContainerInspector{
+		containers: []log.Container{
+			{ID: "abc123", Name: "web-1", State: "running"},
+			{ID: "def456", Name: "web-2", State: "exited"},
+			{ID: "ghi789", Name: "db", State: "running"},
+		},
+	}
+	storage := &fakeContainerStorage{
+		containers: []log.StoredContainer{
+			{Container: log.Container{ID: "abc123", Name: "web-1"}, LogSize: 42},
+			{Container: log.Container{ID: "jkl012", Name: "web-old"}, LogSize: 1024},
+		},
+	}
+	service := log.NewContainerService(inspector, storage)
+
+	testCases := []struct {
+		name     string
+		filter   log.ContainerFilter
+		expected []log.ContainerSummary
+	}{
+		{
+			name:   "all containers",
+			filter: log.ContainerFilter{},
+			expected: []log.ContainerSummary{
+				{Container: log.Container{ID: "ghi789", Name: "db", State: "running"}, Live: true},
+				{
+					Container: log.Container{ID: "abc123", Name: "web-1", State: "running"},
+					Live:      true,
+					LogSize:   42,
+				},
+				{Container: log.Container{ID: "def456", Name: "web-2", State: "exited"}, Live: true},
+				{
+					Container: log.Container{ID: "jkl012", Name: "web-old", State: log.StateRemoved},
+					LogSize:   1024,
+				},
+			},
+		},
+		{
+			name:   "name prefix",
+			filter: log.ContainerFilter{NamePrefix: "web-"},
+			expected: []log.ContainerSummary{
+				{
+					Container: log.Container{ID: "abc123", Name: "web-1", State: "running"},
+					Live:      true,
+					LogSize:   42,
+				},
+				{Container: log.Container{ID: "def456", Name: "web-2", State: "exited"}, Live: true},
+				{
+					Container: log.Container{ID: "jkl012", Name: "web-old", State: log.StateRemoved},
+					LogSize:   1024,
+				},
+			},
+		},
+		{
+			name:   "removed containers",
+			filter: log.ContainerFilter{State: log.StateRemoved},
+			expected: []log.ContainerSummary{
+				{
+					Container: log.Container{ID: "jkl012", Name: "web-old", State: log.StateRemoved},
+					LogSize:   1024,
+				},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := service.ListContainers(context.Background(), tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestContainerService_GetContainer(t *testing.T) {
+	firstLogAt := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	lastLogAt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	inspector := &fakeContainerInspector{
+		containers: []log.Container{
+			{ID: "abc123", Name: "web-1", Image: "nginx:latest", State: "running"},
+		},
+	}
+	storage := &fakeContainerStorage{
+		containers: []log.StoredContainer{
+			{
+				Container:  log.Container{ID: "abc123", Name: "web-1"},
+				LogSize:    42,
+				FirstLogAt: firstLogAt,
+				LastLogAt:  lastLogAt,
+			},
+			{
+				Container:  log.Container{ID: "jkl012", Name: "web-old", Image: "nginx:1.27"},
+				LogSize:    1024,
+				FirstLogAt: firstLogAt,
+				LastLogAt:  lastLogAt,
+			},
+		},
+	}
+	service := log.NewContainerService(inspector, storage)
+
+	testCases := []struct {
+		name     string
+		nameOrID string
+		expected log.ContainerDetails
+	}{
+		{
+			name:     "live container by name",
+			nameOrID: "web-1",
+			expected: log.ContainerDetails{
+				ContainerSummary: log.ContainerSummary{
+					Container: log.Container{
+						ID:    "abc123",
+						Name:  "web-1",
+						Image: "nginx:latest",
+						State: "running",
+					},
+					Live:    true,
+					LogSize: 42,
+				},
+				FirstLogAt: firstLogAt,
+				LastLogAt:  lastLogAt,
+			},
+		},
+		{
+			name:     "removed container by ID",
+			nameOrID: "jkl012",
+			expected: log.ContainerDetails{
+				ContainerSummary: log.ContainerSummary{
+					Container: log.Container{
+						ID:    "jkl012",
+						Name:  "web-old",
+						Image: "nginx:1.27",
+						State: log.StateRemoved,
+					},
+					LogSize: 1024,
+				},
+				FirstLogAt: firstLogAt,
+				LastLogAt:  lastLogAt,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := service.GetContainer(context.Background(), tc.nameOrID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("unknown container", func(t *testing.T) {
+		_, err := service.GetContainer(context.Background(), "unknown")
+
+		var notFoundErr *log.ContainerNotFoundError
+		if !errors.As(err, &notFoundErr) {
+			t.Errorf("expected ContainerNotFoundError, got %v", err)
+		}
+	})
+}
+
+type fakeContainerInspector struct {
+	containers []log.Container
+}
+
+func (f *fakeContainerInspector) ListContainers(ctx context.Context) ([]log.Container, error) {
+	return f.containers, nil
+}
+
+func (f *fakeContainerInspector) InspectContainer(
+	ctx context.Context,
+	containerNameOrID string,
+) (log.Container, error) {
+	for _, ctr := range f.containers {
+		if ctr.ID == containerNameOrID || ctr.Name == containerNameOrID {
+			return ctr, nil
+		}
+	}
+	return log.Container{}, &log.ContainerNotFoundError{Name: containerNameOrID}
+}
+
+type fakeContainerStorage struct {
+	containers []log.StoredContainer
+}
+
+func (f *fakeContainerStorage) ListStoredContainers() ([]log.StoredContainer, error) {
+	return f.containers, nil
+}
+
+func (f *fakeContainerStorage) GetStoredContainer(
+	containerNameOrID string,
+) (log.StoredContainer, error) {
+	for _, ctr := range f.containers {
+		if ctr.ID == containerNameOrID || ctr.Name == containerNameOrID {
+			return ctr, nil
+		}
+	}
+	return log.StoredContainer{}, &log.ContainerNotFoundError{Name: containerNameOrID}
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// recordEncoder writes log records to an output stream in a specific [Format].
+type recordEncoder interface {
+	// Encode writes the record to the stream.
+	Encode(rec Record) error
+
+	// Close terminates the stream, writing any trailing data required by the format.
+	// It does not close the underlying writer.
+	Close() error
+}
+
+func newRecordEncoder(w io.Writer, format Format) recordEncoder {
+	switch format {
+	case FormatNDJSON:
+		return newNDJSONEncoder(w)
+	case FormatJSON:
+		return newJSONArrayEncoder(w)
+	default:
+		return &textEncoder{w: w}
+	}
+}
+
+// textEncoder writes only the raw log entry text of the records,
+// prefixed with the container name if set.
+type textEncoder struct {
+	w io.Writer
+}
+
+func (e *textEncoder) Encode(rec Record) error {
+	line := rec.Log
+	if rec.Container != "" {
+		line = rec.Container + " | " + line
+	}
+	_, err := io.WriteString(e.w, line)
+	return err
+}
+
+func (e *textEncoder) Close() error {
+	return nil
+}
+
+// ndjsonEncoder writes one JSON encoded record per line.
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) *ndjsonEncoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &ndjsonEncoder{enc: enc}
+}
+
+func (e *ndjsonEncoder) Encode(rec Record) error {
+	return e.enc.Encode(&rec)
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
+
+// jsonArrayEncoder writes the records as the elements of a JSON array.
+// Each record is written as soon as it is encoded so that the array can be
+// consumed incrementally when following the logs.
+type jsonArrayEncoder struct {
+	w     io.Writer
+	buf   bytes.Buffer
+	enc   *json.Encoder
+	count int
+}
+
+func newJSONArrayEncoder(w io.Writer) *jsonArrayEncoder {
+	e := &jsonArrayEncoder{w: w}
+	e.enc = json.NewEncoder(&e.buf)
+	e.enc.SetEscapeHTML(false)
+	return e
+}
+
+func (e *jsonArrayEncoder) Encode(rec Record) error {
+	e.buf.Reset()
+	if e.count == 0 {
+		e.buf.WriteString("[\n")
+	} else {
+		e.buf.WriteString(",\n")
+	}
+	if err := e.enc.Encode(&rec); err != nil {
+		return err
+	}
+	// Strip the newline appended by the encoder.
+	e.buf.Truncate(e.buf.Len() - 1)
+	e.count++
+
+	_, err := e.w.Write(e.buf.Bytes())
+	return err
+}
+
+func (e *jsonArrayEncoder) Close() error {
+	end := "\n]\n"
+	if e.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
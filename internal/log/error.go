@@ -25,3 +25,16 @@ func (e *ContainerNotFoundError) Error() string {
 func (e *ContainerNotFoundError) Unwrap() error {
 	return e.Err
 }
+
+// RunNotFoundError indicates that the requested run of a container is not known.
+type RunNotFoundError struct {
+	// Name is the container name.
+	Name string
+
+	// Index is the index of the requested run.
+	Index int
+}
+
+func (e *RunNotFoundError) Error() string {
+	return fmt.Sprintf("run %d of container %s not found", e.Index, e.Name)
+}
@@ -0,0 +1,256 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The fields extracted from structured logs under a well-known name.
+const (
+	// FieldLevel is the severity of the log.
+	FieldLevel = "level"
+	// FieldMessage is the message of the log.
+	FieldMessage = "msg"
+	// FieldTime is the time at which the application emitted the log, as written by it.
+	FieldTime = "time"
+)
+
+// fieldAliases are the names under which the applications commonly write the well-known
+// fields, renamed to the well-known name.
+var fieldAliases = map[string][]string{
+	FieldLevel:   {"lvl", "severity", "loglevel"},
+	FieldMessage: {"message"},
+	FieldTime:    {"ts", "timestamp", "@timestamp"},
+}
+
+// FieldsFormat is the format of the structured logs whose fields are extracted.
+type FieldsFormat string
+
+const (
+	// FieldsFormatNone does not extract any field.
+	FieldsFormatNone FieldsFormat = "none"
+	// FieldsFormatAuto detects whether each log is written in JSON or logfmt.
+	FieldsFormatAuto FieldsFormat = "auto"
+	// FieldsFormatJSON extracts the fields of the logs written as JSON objects.
+	FieldsFormatJSON FieldsFormat = "json"
+	// FieldsFormatLogfmt extracts the fields of the logs written as logfmt key=value pairs.
+	FieldsFormatLogfmt FieldsFormat = "logfmt"
+)
+
+// ParseFieldsFormat parses the format of the structured logs: none, auto, json or logfmt.
+func ParseFieldsFormat(s string) (FieldsFormat, error) {
+	switch format := FieldsFormat(s); format {
+	case FieldsFormatNone, FieldsFormatAuto, FieldsFormatJSON, FieldsFormatLogfmt:
+		return format, nil
+	default:
+		return "", fmt.Errorf("%q is not a fields format (none, auto, json or logfmt)", s)
+	}
+}
+
+// ParseFields extracts the fields of a structured log written in the given format.
+// It returns nil if the log is not written in this format or has no field.
+//
+// The nested JSON objects are flattened, their fields being joined to the parent one
+// with a dot (e.g. user.id), and the other JSON values which are not strings are kept
+// in their JSON encoding. The well-known fields written under a common alias
+// (e.g. message or severity) are renamed to [FieldMessage], [FieldLevel] and [FieldTime].
+func ParseFields(line string, format FieldsFormat) map[string]string {
+	line = strings.TrimSpace(line)
+
+	var fields map[string]string
+	isJSON := strings.HasPrefix(line, "{")
+	switch {
+	case isJSON && (format == FieldsFormatJSON || format == FieldsFormatAuto):
+		fields = parseJSONFields(line)
+	case !isJSON && (format == FieldsFormatLogfmt || format == FieldsFormatAuto):
+		fields = parseLogfmtFields(line)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	for name, aliases := range fieldAliases {
+		for _, alias := range aliases {
+			if _, ok := fields[name]; ok {
+				break
+			}
+			if v, ok := fields[alias]; ok {
+				fields[name] = v
+				delete(fields, alias)
+			}
+		}
+	}
+	return fields
+}
+
+// parseJSONFields returns the fields of a JSON object, or nil if line is not one.
+func parseJSONFields(line string) map[string]string {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil || dec.More() {
+		return nil
+	}
+
+	fields := make(map[string]string, len(obj))
+	flattenJSONFields(fields, "", obj)
+	return fields
+}
+
+// flattenJSONFields adds the fields of the JSON object to fields, prefixing their name.
+func flattenJSONFields(fields map[string]string, prefix string, obj map[string]any) {
+	for k, v := range obj {
+		name := prefix + k
+		switch v := v.(type) {
+		case nil:
+		case string:
+			fields[name] = v
+		case json.Number:
+			fields[name] = v.String()
+		case bool:
+			fields[name] = strconv.FormatBool(v)
+		case map[string]any:
+			flattenJSONFields(fields, name+".", v)
+		default:
+			data, err := json.Marshal(v)
+			if err == nil {
+				fields[name] = string(data)
+			}
+		}
+	}
+}
+
+// parseLogfmtFields returns the fields of a logfmt line, or nil if line is not one.
+// All its tokens must be key=value pairs, the values being optionally quoted.
+func parseLogfmtFields(line string) map[string]string {
+	fields := make(map[string]string)
+	for line != "" {
+		i := strings.IndexAny(line, "= \t\"")
+		if i <= 0 || line[i] != '=' {
+			return nil
+		}
+		key := line[:i]
+		line = line[i+1:]
+
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil
+			}
+			value, _ = strconv.Unquote(quoted)
+			line = line[len(quoted):]
+			if line != "" && line[0] != ' ' && line[0] != '\t' {
+				return nil
+			}
+		} else {
+			j := strings.IndexAny(line, " \t")
+			if j < 0 {
+				j = len(line)
+			}
+			value = line[:j]
+			line = line[j:]
+		}
+		fields[key] = value
+
+		line = strings.TrimLeft(line, " \t")
+	}
+	return fields
+}
+
+// Level is the severity of a structured log. The zero value is not a level.
+type Level int
+
+// The levels of the structured logs, from the least to the most severe.
+const (
+	LevelTrace Level = iota + 1
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+// levelNames are the names of the levels, the first one being the canonical name.
+var levelNames = map[Level][]string{
+	LevelTrace: {"trace"},
+	LevelDebug: {"debug", "dbg"},
+	LevelInfo:  {"info", "information", "notice"},
+	LevelWarn:  {"warn", "warning"},
+	LevelError: {"error", "err"},
+	LevelFatal: {"fatal", "panic", "critical", "crit"},
+}
+
+// ParseLevel parses the level of a structured log, case insensitively. It accepts the
+// common aliases of the levels, e.g. warning for [LevelWarn].
+func ParseLevel(s string) (Level, error) {
+	lower := strings.ToLower(s)
+	for level, names := range levelNames {
+		for _, name := range names {
+			if lower == name {
+				return level, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%q is not a level (trace, debug, info, warn, error or fatal)", s)
+}
+
+func (l Level) String() string {
+	if names, ok := levelNames[l]; ok {
+		return names[0]
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// fieldsWriter extracts the fields of the NDJSON records written to it before writing
+// them to w. The records which are not structured logs are written as is.
+type fieldsWriter struct {
+	w      io.Writer
+	format FieldsFormat
+	buf    bytes.Buffer
+	enc    *json.Encoder
+	// partial is the beginning of the last record, not yet terminated by a newline.
+	partial []byte
+}
+
+func newFieldsWriter(w io.Writer, format FieldsFormat) *fieldsWriter {
+	fw := &fieldsWriter{w: w, format: format}
+	fw.enc = json.NewEncoder(&fw.buf)
+	fw.enc.SetEscapeHTML(false)
+	return fw
+}
+
+func (w *fieldsWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := w.partial[:i+1]
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err == nil && rec.Fields == nil {
+			rec.Fields = ParseFields(rec.Log, w.format)
+			if rec.Fields != nil {
+				w.buf.Reset()
+				if err := w.enc.Encode(&rec); err != nil {
+					return 0, fmt.Errorf("encode log record: %w", err)
+				}
+				line = w.buf.Bytes()
+			}
+		}
+		if _, err := w.w.Write(line); err != nil {
+			return 0, err
+		}
+
+		w.partial = w.partial[i+1:]
+	}
+	w.partial = bytes.Clone(w.partial)
+
+	return len(p), nil
+}
@@ -0,0 +1,130 @@
+package log_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestParseFields(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		format   log.FieldsFormat
+		expected map[string]string
+	}{
+		{
+			name:   "json",
+			line:   `{"level":"warn","msg":"slow query","duration_ms":1200,"cached":false}` + "\n",
+			format: log.FieldsFormatAuto,
+			expected: map[string]string{
+				"level":       "warn",
+				"msg":         "slow query",
+				"duration_ms": "1200",
+				"cached":      "false",
+			},
+		},
+		{
+			name:   "nested json",
+			line:   `{"msg":"login","user":{"id":42,"roles":["admin"]},"trace":null}`,
+			format: log.FieldsFormatJSON,
+			expected: map[string]string{
+				"msg":        "login",
+				"user.id":    "42",
+				"user.roles": `["admin"]`,
+			},
+		},
+		{
+			name:   "json aliases",
+			line:   `{"severity":"ERROR","message":"boom","ts":"2024-01-01T12:00:00Z"}`,
+			format: log.FieldsFormatAuto,
+			expected: map[string]string{
+				"level": "ERROR",
+				"msg":   "boom",
+				"time":  "2024-01-01T12:00:00Z",
+			},
+		},
+		{
+			name:   "logfmt",
+			line:   `time=2024-01-01T12:00:00Z level=info msg="request \"done\"" user_id=42` + "\n",
+			format: log.FieldsFormatAuto,
+			expected: map[string]string{
+				"time":    "2024-01-01T12:00:00Z",
+				"level":   "info",
+				"msg":     `request "done"`,
+				"user_id": "42",
+			},
+		},
+		{
+			name:     "plain text",
+			line:     "GET /health 200\n",
+			format:   log.FieldsFormatAuto,
+			expected: nil,
+		},
+		{
+			name:     "text with an equal sign",
+			line:     "retrying with timeout=5s\n",
+			format:   log.FieldsFormatAuto,
+			expected: nil,
+		},
+		{
+			name:     "invalid json",
+			line:     `{"level":"info"` + "\n",
+			format:   log.FieldsFormatAuto,
+			expected: nil,
+		},
+		{
+			name:     "json restricted to logfmt",
+			line:     `{"level":"info"}`,
+			format:   log.FieldsFormatLogfmt,
+			expected: nil,
+		},
+		{
+			name:     "disabled",
+			line:     "level=info",
+			format:   log.FieldsFormatNone,
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := log.ParseFields(tc.line, tc.format)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected log.Level
+	}{
+		{value: "debug", expected: log.LevelDebug},
+		{value: "INFO", expected: log.LevelInfo},
+		{value: "Warning", expected: log.LevelWarn},
+		{value: "err", expected: log.LevelError},
+		{value: "panic", expected: log.LevelFatal},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := log.ParseLevel(tc.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	for _, value := range []string{"", "verbose", "42"} {
+		if _, err := log.ParseLevel(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// defaultHubBufferSize is the default number of records buffered per subscriber.
+const defaultHubBufferSize = 1024
+
+// SlowConsumerPolicy determines what happens to a subscriber of the [Hub] which
+// does not receive the records as fast as they are published.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDrop drops the records published while the buffer of the subscriber
+	// is full. A marker record reporting how many were dropped is delivered afterwards.
+	SlowConsumerDrop SlowConsumerPolicy = "drop"
+	// SlowConsumerDisconnect ends the subscription once its buffer is full.
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+)
+
+// ErrSlowConsumer is the error of a subscription ended because it did not keep up
+// with the published records.
+var ErrSlowConsumer = errors.New("subscriber too slow to receive the logs")
+
+// errCatchUpOverflow is the error of a subscription ended because its buffer filled up
+// while its follower was catching up with the stored logs.
+var errCatchUpOverflow = errors.New("subscriber buffer full while catching up")
+
+// HubOptions are optional parameters used to configure the behavior of the [Hub].
+type HubOptions struct {
+	// BufferSize is the number of records buffered per subscriber.
+	// Defaults to 1024.
+	BufferSize int
+
+	// SlowConsumerPolicy determines what happens once the buffer of a subscriber is full.
+	// Defaults to [SlowConsumerDrop].
+	SlowConsumerPolicy SlowConsumerPolicy
+}
+
+// Hub broadcasts the records collected from the containers to their followers, so that
+// following the logs of a container does not open another log stream from Docker.
+// It also notifies the clients waiting for a container to start, so that they do not
+// each watch the Docker events.
+//
+// Publishing never blocks: each subscriber has a bounded buffer and the records it
+// cannot hold are handled according to the [SlowConsumerPolicy].
+type Hub struct {
+	options HubOptions
+
+	mu sync.Mutex
+	// subscriptions are the subscriptions by container name or ID.
+	subscriptions map[string]map[*Subscription]struct{}
+	// stats are the statistics of the followers by container ID.
+	stats map[string]*followerStats
+	// starts are the channels notified of the starts of the containers by name or ID.
+	starts map[string]map[chan Container]struct{}
+}
+
+// followerStats are the statistics of the followers of a container.
+type followerStats struct {
+	dropped      int64
+	disconnected int64
+}
+
+// NewHub creates a new [Hub].
+func NewHub(opts HubOptions) *Hub {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultHubBufferSize
+	}
+	if opts.SlowConsumerPolicy == "" {
+		opts.SlowConsumerPolicy = SlowConsumerDrop
+	}
+	return &Hub{
+		options:       opts,
+		subscriptions: make(map[string]map[*Subscription]struct{}),
+		stats:         make(map[string]*followerStats),
+		starts:        make(map[string]map[chan Container]struct{}),
+	}
+}
+
+// ParseSlowConsumerPolicy parses the name of a [SlowConsumerPolicy].
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(s); policy {
+	case SlowConsumerDrop, SlowConsumerDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("%q is neither drop nor disconnect", s)
+	}
+}
+
+// PublishedRecord is a record published to the [Hub].
+type PublishedRecord struct {
+	Record
+	// Position is the position following the record in the storage, or the zero
+	// position if the record is not stored, e.g. a marker of dropped records.
+	Position Position
+}
+
+// Subscription receives the records published for a container.
+type Subscription struct {
+	hub *Hub
+	key string
+	// records is closed when the subscription ends.
+	records chan PublishedRecord
+
+	// The following fields are guarded by hub.mu.
+
+	// catchingUp indicates whether the follower is still reading the records stored
+	// before subscribing, in which case the subscription ends once its buffer is full
+	// rather than applying the [SlowConsumerPolicy].
+	catchingUp bool
+	// dropped is the number of records dropped since the last one delivered.
+	dropped int
+	// err is the reason why the subscription ended, if it was not closed.
+	err    error
+	closed bool
+}
+
+// Subscribe returns a subscription to the records published for the container
+// with the given name or ID, from now on. It must be closed once done.
+func (h *Hub) Subscribe(containerNameOrID string) *Subscription {
+	return h.subscribe(containerNameOrID, false)
+}
+
+// subscribe returns a subscription to the records published for the container, catching
+// up with the stored logs until [Subscription.caughtUp] is called if catchingUp is set.
+func (h *Hub) subscribe(containerNameOrID string, catchingUp bool) *Subscription {
+	sub := &Subscription{
+		hub:        h,
+		key:        containerNameOrID,
+		records:    make(chan PublishedRecord, h.options.BufferSize),
+		catchingUp: catchingUp,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, ok := h.subscriptions[containerNameOrID]
+	if !ok {
+		subs = make(map[*Subscription]struct{})
+		h.subscriptions[containerNameOrID] = subs
+	}
+	subs[sub] = struct{}{}
+	return sub
+}
+
+// Records returns the channel receiving the records. It is closed when the
+// subscription ends, after which [Subscription.Err] reports why.
+func (s *Subscription) Records() <-chan PublishedRecord {
+	return s.records
+}
+
+// caughtUp reports that the follower read the records stored before subscribing, from
+// which point the [SlowConsumerPolicy] applies. It returns false if the subscription
+// ended meanwhile.
+func (s *Subscription) caughtUp() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.catchingUp = false
+	return !s.closed
+}
+
+// Err returns [ErrSlowConsumer] if the subscription was ended because it did not keep
+// up with the published records, or nil.
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.end(s, nil)
+}
+
+// end ends the subscription with the given error. The caller must hold h.mu.
+func (h *Hub) end(sub *Subscription, err error) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.err = err
+	close(sub.records)
+
+	subs := h.subscriptions[sub.key]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subscriptions, sub.key)
+	}
+}
+
+// hasSubscribers reports whether the container has any subscriber.
+func (h *Hub) hasSubscribers(container Container) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscriptions[container.ID]) > 0 || len(h.subscriptions[container.Name]) > 0
+}
+
+// Publish delivers the record, stored before the given position, to the subscribers
+// of the container.
+func (h *Hub) Publish(container Container, rec Record, pos Position) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range []string{container.ID, container.Name} {
+		for sub := range h.subscriptions[key] {
+			h.deliver(container, sub, PublishedRecord{Record: rec, Position: pos})
+		}
+	}
+}
+
+// deliver sends the record to the subscriber without blocking. The caller must hold h.mu.
+func (h *Hub) deliver(container Container, sub *Subscription, rec PublishedRecord) {
+	if sub.catchingUp {
+		select {
+		case sub.records <- rec:
+		default:
+			// The follower reads the records from the storage instead.
+			h.end(sub, errCatchUpOverflow)
+		}
+		return
+	}
+
+	if sub.dropped > 0 {
+		marker := PublishedRecord{Record: Record{
+			Timestamp: rec.Timestamp,
+			Stream:    rec.Stream,
+			Log:       fmt.Sprintf("[docker-logproxy: %d records dropped]\n", sub.dropped),
+		}}
+		select {
+		case sub.records <- marker:
+			sub.dropped = 0
+		default:
+		}
+	}
+
+	if sub.dropped == 0 {
+		select {
+		case sub.records <- rec:
+			return
+		default:
+		}
+	}
+
+	stats := h.stats[container.ID]
+	if stats == nil {
+		stats = &followerStats{}
+		h.stats[container.ID] = stats
+	}
+	switch h.options.SlowConsumerPolicy {
+	case SlowConsumerDisconnect:
+		stats.disconnected++
+		h.end(sub, ErrSlowConsumer)
+	default:
+		stats.dropped++
+		sub.dropped++
+	}
+}
+
+// EndSubscriptions ends the subscriptions to the container, e.g. once it stopped.
+func (h *Hub) EndSubscriptions(container Container) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range []string{container.ID, container.Name} {
+		for sub := range h.subscriptions[key] {
+			h.end(sub, nil)
+		}
+	}
+}
+
+// RemoveContainer ends the subscriptions to the removed container and forgets the
+// statistics of its followers.
+func (h *Hub) RemoveContainer(container Container) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range []string{container.ID, container.Name} {
+		for sub := range h.subscriptions[key] {
+			h.end(sub, nil)
+		}
+	}
+	delete(h.stats, container.ID)
+}
+
+// SubscribeStarts returns a channel receiving the container with the given name or ID
+// each time it starts from now on, until the context is canceled. The starts are
+// not queued: a start is only delivered if the previous one was received.
+func (h *Hub) SubscribeStarts(ctx context.Context, containerNameOrID string) <-chan Container {
+	starts := make(chan Container, 1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, ok := h.starts[containerNameOrID]
+	if !ok {
+		subs = make(map[chan Container]struct{})
+		h.starts[containerNameOrID] = subs
+	}
+	subs[starts] = struct{}{}
+
+	context.AfterFunc(ctx, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		subs := h.starts[containerNameOrID]
+		delete(subs, starts)
+		if len(subs) == 0 {
+			delete(h.starts, containerNameOrID)
+		}
+	})
+	return starts
+}
+
+// PublishStart notifies the subscribers to the starts of the container that it started.
+func (h *Hub) PublishStart(container Container) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range []string{container.ID, container.Name} {
+		for starts := range h.starts[key] {
+			select {
+			case starts <- container:
+			default:
+			}
+		}
+	}
+}
+
+// setFollowerStats sets the statistics of the followers of the container in the status.
+func (h *Hub) setFollowerStats(status *CollectorStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status.Followers = len(h.subscriptions[status.ContainerID]) +
+		len(h.subscriptions[status.ContainerName])
+	if stats, ok := h.stats[status.ContainerID]; ok {
+		status.FollowerRecordsDropped = stats.dropped
+		status.FollowersDisconnected = stats.disconnected
+	}
+}
+
+// publishWriter publishes the NDJSON records written to w to the subscribers of the container,
+// along with their position in the storage.
+type publishWriter struct {
+	w         LogWriter
+	hub       *Hub
+	container Container
+	// partial is the beginning of the last record, not yet terminated by a newline.
+	partial []byte
+}
+
+func (w *publishWriter) Write(p []byte) (int, error) {
+	// Write the records one at a time so that the position following each is known.
+	var written int
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			n, err := w.w.Write(p)
+			w.partial = append(w.partial, p[:n]...)
+			return written + n, err
+		}
+		n, err := w.w.Write(p[:i+1])
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		// Look for subscribers once the record is stored so that the followers
+		// subscribing meanwhile read it from the storage.
+		if w.hub.hasSubscribers(w.container) {
+			line := p[:i+1]
+			if len(w.partial) > 0 {
+				line = append(w.partial, line...)
+			}
+			var rec Record
+			if json.Unmarshal(line, &rec) == nil {
+				w.hub.Publish(w.container, rec, w.w.Position())
+			}
+		}
+		w.partial = w.partial[:0]
+		p = p[i+1:]
+	}
+
+	return written, nil
+}
+
+// followerReader reads the records stored after the history of a container being collected
+// as NDJSON. It reads them from the storage until it catches up with the records stored so
+// far, and then receives them from the hub as they are collected, skipping the ones it
+// already read using their position in the storage. If its subscription fills up before it
+// caught up, it goes on reading the storage rather than dropping records.
+type followerReader struct {
+	hub     *Hub
+	storage StorageReader
+	query   Query
+	// stored reads the records stored after the history, returning [io.EOF] each time
+	// it catches up with the records stored so far.
+	stored StoredLogReader
+
+	// mu guards sub and closed, as the reader may be closed while being read.
+	// The subscription is only set while reading, with mu held.
+	mu sync.Mutex
+	// sub is the subscription to the records published to the hub, if subscribed.
+	sub    *Subscription
+	closed bool
+	// live indicates whether the records are received from the subscription, once
+	// the records stored before subscribing are read.
+	live bool
+	// stopped indicates whether the collection stopped, in which case the stored
+	// records are read until the end.
+	stopped bool
+	// pos is the position following the last record read.
+	pos Position
+
+	chunk []byte
+	// partial is the beginning of the last stored record, not yet terminated by a newline.
+	partial []byte
+	buf     bytes.Buffer
+	enc     *json.Encoder
+	done    bool
+}
+
+func newFollowerReader(
+	hub *Hub,
+	storage StorageReader,
+	query Query,
+	stored StoredLogReader,
+) *followerReader {
+	r := &followerReader{
+		hub:     hub,
+		storage: storage,
+		query:   query,
+		stored:  stored,
+		pos:     stored.Position(),
+		chunk:   make([]byte, 32*1024),
+	}
+	r.enc = json.NewEncoder(&r.buf)
+	return r
+}
+
+func (r *followerReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		var err error
+		if r.live {
+			err = r.receive()
+		} else {
+			err = r.readStored()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// readStored reads the next records from the storage. Once it caught up with the records
+// stored so far, it subscribes to the hub, reads the records stored before subscribing
+// and then receives the records from the subscription.
+func (r *followerReader) readStored() error {
+	n, err := r.stored.Read(r.chunk)
+	if n > 0 {
+		r.bufferStored(r.chunk[:n])
+		return nil
+	}
+	if !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	switch {
+	case r.stopped:
+		r.done = true
+
+	case r.sub == nil:
+		sub := r.hub.subscribe(r.query.ContainerName, true)
+		// The records are not published anymore once the collection stops.
+		if !r.storage.IsCollecting(r.query) {
+			sub.Close()
+			r.stopped = true
+			return nil
+		}
+		if !r.setSubscription(sub) {
+			// The reader was closed meanwhile.
+			sub.Close()
+			r.done = true
+			return io.EOF
+		}
+
+	case r.sub.caughtUp():
+		r.live = true
+		// The records are received whole from now on.
+		r.partial = r.partial[:0]
+
+	default:
+		// The subscription filled up while catching up, so catch up again,
+		// unless it was ended by closing the reader.
+		if !r.setSubscription(nil) {
+			r.done = true
+			return io.EOF
+		}
+	}
+	return nil
+}
+
+// setSubscription sets the subscription to the hub. It returns false if the reader
+// is closed, in which case the subscription is not set.
+func (r *followerReader) setSubscription(sub *Subscription) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.sub = sub
+	return true
+}
+
+// bufferStored buffers the records of the data read from the storage which follow
+// the last record read.
+func (r *followerReader) bufferStored(data []byte) {
+	// The data is read from a single file, up to the position of the reader.
+	end := r.stored.Position()
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			r.partial = append(r.partial, data...)
+			return
+		}
+		r.partial = append(r.partial, data[:i+1]...)
+		data = data[i+1:]
+
+		pos := Position{Segment: end.Segment, Offset: end.Offset - int64(len(data))}
+		if pos.Compare(r.pos) > 0 {
+			r.buf.Write(r.partial)
+			r.pos = pos
+		}
+		r.partial = r.partial[:0]
+	}
+}
+
+// receive receives the next record from the subscription, unless it was read from
+// the storage already.
+func (r *followerReader) receive() error {
+	rec, ok := <-r.sub.Records()
+	if !ok {
+		if err := r.sub.Err(); err != nil {
+			return err
+		}
+		// The collection stopped.
+		r.done = true
+		return nil
+	}
+
+	if !rec.Position.IsZero() {
+		if rec.Position.Compare(r.pos) <= 0 {
+			return nil
+		}
+		r.pos = rec.Position
+	}
+	if err := r.enc.Encode(rec.Record); err != nil {
+		return fmt.Errorf("encode log record: %w", err)
+	}
+	return nil
+}
+
+func (r *followerReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	if r.sub != nil {
+		r.sub.Close()
+	}
+	return r.stored.Close()
+}
@@ -0,0 +1,183 @@
+package log_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestHub(t *testing.T) {
+	container := log.Container{ID: "abc123", Name: "web"}
+	testTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	record := func(i int) log.Record {
+		return log.Record{
+			Timestamp: testTime.Add(time.Duration(i) * time.Second),
+			Stream:    log.StreamTypeStdout,
+			Log:       "line\n",
+		}
+	}
+
+	t.Run("delivers the records to the subscribers by name or ID", func(t *testing.T) {
+		hub := log.NewHub(log.HubOptions{})
+		byName := hub.Subscribe("web")
+		defer byName.Close()
+		byID := hub.Subscribe("abc123")
+		defer byID.Close()
+		other := hub.Subscribe("db")
+		defer other.Close()
+
+		hub.Publish(container, record(0), log.Position{})
+
+		for _, sub := range []*log.Subscription{byName, byID} {
+			if got := <-sub.Records(); !reflect.DeepEqual(got.Record, record(0)) {
+				t.Errorf("expected %v, got %v", record(0), got)
+			}
+		}
+		if got := len(other.Records()); got != 0 {
+			t.Errorf("expected no record for other containers, got %d", got)
+		}
+	})
+
+	t.Run("drops the records of slow subscribers", func(t *testing.T) {
+		hub := log.NewHub(log.HubOptions{BufferSize: 2})
+		sub := hub.Subscribe("web")
+		defer sub.Close()
+
+		for i := range 5 {
+			hub.Publish(container, record(i), log.Position{})
+		}
+		// Make room for the marker and the next record.
+		<-sub.Records()
+		<-sub.Records()
+		hub.Publish(container, record(5), log.Position{})
+
+		marker := <-sub.Records()
+		if want := "[docker-logproxy: 3 records dropped]\n"; marker.Log != want {
+			t.Errorf("expected %q, got %q", want, marker.Log)
+		}
+		if got := <-sub.Records(); !reflect.DeepEqual(got.Record, record(5)) {
+			t.Errorf("expected %v, got %v", record(5), got)
+		}
+		if err := sub.Err(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("disconnects slow subscribers", func(t *testing.T) {
+		hub := log.NewHub(log.HubOptions{
+			BufferSize:         2,
+			SlowConsumerPolicy: log.SlowConsumerDisconnect,
+		})
+		sub := hub.Subscribe("web")
+		defer sub.Close()
+
+		for i := range 3 {
+			hub.Publish(container, record(i), log.Position{})
+		}
+
+		var got int
+		for range sub.Records() {
+			got++
+		}
+		if got != 2 {
+			t.Errorf("expected %d records, got %d", 2, got)
+		}
+		if err := sub.Err(); !errors.Is(err, log.ErrSlowConsumer) {
+			t.Errorf("expected %v, got %v", log.ErrSlowConsumer, err)
+		}
+	})
+
+	t.Run("ends the subscriptions of the container", func(t *testing.T) {
+		hub := log.NewHub(log.HubOptions{})
+		sub := hub.Subscribe("web")
+		defer sub.Close()
+
+		hub.Publish(container, record(0), log.Position{})
+		hub.EndSubscriptions(container)
+
+		if _, ok := <-sub.Records(); !ok {
+			t.Fatal("expected the buffered record before the end")
+		}
+		if _, ok := <-sub.Records(); ok {
+			t.Error("expected the subscription to end")
+		}
+		if err := sub.Err(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("notifies the starts of the container by name or ID", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			hub := log.NewHub(log.HubOptions{})
+			ctx, cancel := context.WithCancel(context.Background())
+			byID := hub.SubscribeStarts(ctx, "abc123")
+			byName := hub.SubscribeStarts(ctx, "web")
+			other := hub.SubscribeStarts(ctx, "db")
+
+			hub.PublishStart(container)
+
+			for _, starts := range []<-chan log.Container{byID, byName} {
+				select {
+				case got := <-starts:
+					if got.ID != container.ID {
+						t.Errorf("expected container %q, got %q", container.ID, got.ID)
+					}
+				default:
+					t.Error("expected the start to be notified")
+				}
+			}
+			select {
+			case got := <-other:
+				t.Errorf("unexpected start of container %q", got.ID)
+			default:
+			}
+
+			// The subscriptions end with the context.
+			cancel()
+			synctest.Wait()
+			hub.PublishStart(container)
+			select {
+			case got := <-byName:
+				t.Errorf("unexpected start of container %q after cancel", got.ID)
+			default:
+			}
+		})
+	})
+
+	t.Run("ends the subscriptions of a removed container", func(t *testing.T) {
+		hub := log.NewHub(log.HubOptions{})
+		byID := hub.Subscribe("abc123")
+		defer byID.Close()
+		byName := hub.Subscribe("web")
+		defer byName.Close()
+
+		hub.RemoveContainer(container)
+
+		for _, sub := range []*log.Subscription{byID, byName} {
+			if _, ok := <-sub.Records(); ok {
+				t.Error("expected the subscription to end")
+			}
+		}
+	})
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+	for _, s := range []string{"drop", "disconnect"} {
+		policy, err := log.ParseSlowConsumerPolicy(s)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", s, err)
+		}
+		if string(policy) != s {
+			t.Errorf("expected %q, got %q", s, policy)
+		}
+	}
+
+	if _, err := log.ParseSlowConsumerPolicy("block"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
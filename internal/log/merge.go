@@ -0,0 +1,209 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// mergeWindow is the maximum time a record is held back while following
+// merged logs, waiting for the records of quieter containers to order it.
+const mergeWindow = 200 * time.Millisecond
+
+// GetMergedContainerLogs retrieves the logs of several containers as a single
+// stream ordered by timestamp. Each record carries the name of the container which
+// emitted it, prefixed to the line in text format or in the container field otherwise.
+//
+// The query applies to each container individually, its container name is ignored.
+// In particular [Query.Tail] is the number of last records returned per container.
+//
+// When following, records are held back for at most [mergeWindow] so a quiet
+// container does not delay the others, which means that records received later
+// than that may be out of order.
+func (s *Service) GetMergedContainerLogs(
+	ctx context.Context,
+	containerNames []string,
+	query Query,
+) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	streams := make([]io.ReadCloser, 0, len(containerNames))
+	closeStreams := func() {
+		for _, rc := range streams {
+			rc.Close()
+		}
+	}
+	for _, name := range containerNames {
+		containerQuery := query
+		containerQuery.ContainerName = name
+		containerQuery.Format = FormatNDJSON
+		rc, err := s.GetContainerLogs(ctx, containerQuery)
+		if err != nil {
+			closeStreams()
+			cancel()
+			return nil, err
+		}
+		streams = append(streams, rc)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer cancel()
+
+		m := newRecordMerger(ctx, streams)
+		defer m.close()
+
+		enc := newRecordEncoder(pw, query.Format)
+		err := m.merge(func(src int, rec Record) error {
+			rec.Container = containerNames[src]
+			return enc.Encode(rec)
+		}, query.Follow)
+		if err == nil {
+			err = enc.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// mergeItem is the next record read from a merged stream.
+type mergeItem struct {
+	src  int
+	rec  Record
+	err  error
+	done bool
+}
+
+// recordMerger performs a k-way merge of NDJSON record streams by timestamp.
+//
+// Each stream is decoded by its own goroutine which reads at most one record
+// ahead, so that the merge only buffers a single record per stream.
+type recordMerger struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams []io.ReadCloser
+	items   chan mergeItem
+	next    []chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newRecordMerger(ctx context.Context, streams []io.ReadCloser) *recordMerger {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &recordMerger{
+		ctx:     ctx,
+		cancel:  cancel,
+		streams: streams,
+		items:   make(chan mergeItem),
+		next:    make([]chan struct{}, len(streams)),
+	}
+	for i, rc := range streams {
+		m.next[i] = make(chan struct{}, 1)
+		m.wg.Go(func() { m.read(i, rc) })
+	}
+	return m
+}
+
+// read decodes the records of the stream, waiting for the previous one
+// to be consumed before decoding the next one.
+func (m *recordMerger) read(src int, r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		item := mergeItem{src: src}
+		if err := dec.Decode(&item.rec); errors.Is(err, io.EOF) {
+			item.done = true
+		} else if err != nil {
+			item.err = fmt.Errorf("decode log record: %w", err)
+		}
+
+		select {
+		case m.items <- item:
+		case <-m.ctx.Done():
+			return
+		}
+		if item.done || item.err != nil {
+			return
+		}
+
+		select {
+		case <-m.next[src]:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// merge calls yield with the records of all the streams in timestamp order until
+// every stream ends. If follow is true, a record is yielded once it has been held
+// for [mergeWindow] even if some streams have no record available yet.
+func (m *recordMerger) merge(yield func(src int, rec Record) error, follow bool) error {
+	var (
+		heads    = make([]*mergeItem, len(m.streams))
+		received = make([]time.Time, len(m.streams))
+		// Number of streams which may still produce a record but have none available.
+		pending = len(m.streams)
+	)
+
+	for {
+		oldest := -1
+		for i, head := range heads {
+			if head != nil && (oldest < 0 || head.rec.Timestamp.Before(heads[oldest].rec.Timestamp)) {
+				oldest = i
+			}
+		}
+
+		if pending == 0 && oldest < 0 {
+			return nil
+		}
+
+		var wait time.Duration
+		if follow && oldest >= 0 {
+			wait = time.Until(received[oldest].Add(mergeWindow))
+		}
+		if pending == 0 || (follow && oldest >= 0 && wait <= 0) {
+			if err := yield(oldest, heads[oldest].rec); err != nil {
+				return err
+			}
+			heads[oldest] = nil
+			pending++
+			m.next[oldest] <- struct{}{}
+			continue
+		}
+
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timeout = time.After(wait)
+		}
+
+		select {
+		case item := <-m.items:
+			pending--
+			if item.err != nil {
+				return item.err
+			}
+			if !item.done {
+				heads[item.src] = &item
+				received[item.src] = time.Now()
+			}
+
+		case <-timeout:
+
+		case <-m.ctx.Done():
+			return m.ctx.Err()
+		}
+	}
+}
+
+// close stops the decoding goroutines and closes the streams.
+func (m *recordMerger) close() {
+	m.cancel()
+	for _, rc := range m.streams {
+		rc.Close()
+	}
+	m.wg.Wait()
+}
@@ -0,0 +1,188 @@
+package log_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestService_GetMergedContainerLogs(t *testing.T) {
+	testTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	logger := slog.New(slog.DiscardHandler)
+
+	streamer := &fakeContainerLogStreamer{
+		containers: map[string][]log.Record{
+			"api": {
+				{Timestamp: testTime, Stream: "stdout", Log: "request received\n"},
+				{Timestamp: testTime.Add(3 * time.Second), Stream: "stdout", Log: "response sent\n"},
+			},
+			"db": {
+				{Timestamp: testTime.Add(2 * time.Second), Stream: "stdout", Log: "query executed\n"},
+			},
+		},
+	}
+	storage := &fakeStorageReader{
+		containers: map[string][]log.Record{
+			"worker": {
+				{Timestamp: testTime.Add(time.Second), Stream: "stdout", Log: "job queued\n"},
+				{Timestamp: testTime.Add(4 * time.Second), Stream: "stdout", Log: "job done\n"},
+			},
+		},
+	}
+	service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+	testCases := []struct {
+		name     string
+		format   log.Format
+		expected string
+	}{
+		{
+			name:   "text",
+			format: log.FormatText,
+			expected: "api | request received\n" +
+				"worker | job queued\n" +
+				"db | query executed\n" +
+				"api | response sent\n" +
+				"worker | job done\n",
+		},
+		{
+			name:   "ndjson",
+			format: log.FormatNDJSON,
+			expected: `{"timestamp":"2024-01-01T12:00:00Z","stream":"stdout","output":"request received\n","container":"api"}` + "\n" +
+				`{"timestamp":"2024-01-01T12:00:01Z","stream":"stdout","output":"job queued\n","container":"worker"}` + "\n" +
+				`{"timestamp":"2024-01-01T12:00:02Z","stream":"stdout","output":"query executed\n","container":"db"}` + "\n" +
+				`{"timestamp":"2024-01-01T12:00:03Z","stream":"stdout","output":"response sent\n","container":"api"}` + "\n" +
+				`{"timestamp":"2024-01-01T12:00:04Z","stream":"stdout","output":"job done\n","container":"worker"}` + "\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, err := service.GetMergedContainerLogs(
+				context.Background(),
+				[]string{"api", "worker", "db"},
+				log.Query{IncludeStdout: true, IncludeStderr: true, Format: tc.format},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+
+			if string(got) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, string(got))
+			}
+		})
+	}
+
+	t.Run("container does not exist", func(t *testing.T) {
+		_, err := service.GetMergedContainerLogs(
+			context.Background(),
+			[]string{"api", "unknown"},
+			log.Query{IncludeStdout: true, IncludeStderr: true},
+		)
+
+		var notFoundErr *log.ContainerNotFoundError
+		if !errors.As(err, &notFoundErr) {
+			t.Fatalf("expected *log.ContainerNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("follow does not wait for quiet containers", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			streamer := newFakeFollowStreamer("api", "db")
+			service := log.NewService(streamer, &fakeStorageReader{}, logger, log.ServiceOptions{})
+
+			rc, err := service.GetMergedContainerLogs(
+				t.Context(),
+				[]string{"api", "db"},
+				log.Query{IncludeStdout: true, IncludeStderr: true, Follow: true},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+			lines := bufio.NewReader(rc)
+
+			streamer.emit(t, "api", log.Record{Timestamp: testTime, Stream: "stdout", Log: "first\n"})
+			expectLine(t, lines, "api | first\n")
+
+			streamer.emit(t, "db", log.Record{
+				Timestamp: testTime.Add(time.Second),
+				Stream:    "stdout",
+				Log:       "second\n",
+			})
+			expectLine(t, lines, "db | second\n")
+
+			streamer.end("api")
+			streamer.end("db")
+			if _, err := lines.ReadByte(); err != io.EOF {
+				t.Errorf("expected EOF, got %v", err)
+			}
+		})
+	})
+}
+
+func expectLine(t *testing.T, r *bufio.Reader, expected string) {
+	t.Helper()
+
+	got, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read line: %v", err)
+	}
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+// fakeFollowStreamer streams the records emitted by the test until the stream is ended.
+type fakeFollowStreamer struct {
+	readers map[string]*io.PipeReader
+	writers map[string]*io.PipeWriter
+}
+
+func newFakeFollowStreamer(containerNames ...string) *fakeFollowStreamer {
+	f := &fakeFollowStreamer{
+		readers: make(map[string]*io.PipeReader),
+		writers: make(map[string]*io.PipeWriter),
+	}
+	for _, name := range containerNames {
+		f.readers[name], f.writers[name] = io.Pipe()
+	}
+	return f
+}
+
+func (f *fakeFollowStreamer) StreamContainerLogs(
+	ctx context.Context,
+	query log.Query,
+) (io.ReadCloser, error) {
+	r, exists := f.readers[query.ContainerName]
+	if !exists {
+		return nil, &log.ContainerNotFoundError{Name: query.ContainerName}
+	}
+	return r, nil
+}
+
+func (f *fakeFollowStreamer) emit(t *testing.T, containerName string, rec log.Record) {
+	t.Helper()
+
+	if err := json.NewEncoder(f.writers[containerName]).Encode(rec); err != nil {
+		t.Fatalf("failed to emit record: %v", err)
+	}
+}
+
+func (f *fakeFollowStreamer) end(containerName string) {
+	f.writers[containerName].Close()
+}
@@ -0,0 +1,279 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMultilineMaxLines is the default maximum number of lines joined into a record.
+	defaultMultilineMaxLines = 1000
+
+	// defaultMultilineFlushTimeout is the default time after which a multiline record is
+	// written if no other line was appended to it.
+	defaultMultilineFlushTimeout = time.Second
+)
+
+// MultilineConfig configures how the lines of multiline records (e.g. stack traces) are
+// joined before being stored.
+//
+// With only a start pattern, the lines not matching it are appended to the record started
+// by the previous line matching it. With only a continuation pattern, the lines matching it
+// are appended to the previous record. With both, the lines matching the continuation
+// pattern are appended to the previous record only if it started with a line matching the
+// start pattern.
+//
+// The lines are only joined within the same stream.
+type MultilineConfig struct {
+	// Start, if not nil, matches the first line of multiline records.
+	Start *regexp.Regexp
+
+	// Continuation, if not nil, matches the lines appended to a multiline record.
+	Continuation *regexp.Regexp
+
+	// MaxLines, if positive, is the maximum number of lines joined into a record. The
+	// following lines start a new record. Defaults to 1000.
+	MaxLines int
+
+	// FlushTimeout, if positive, is the time after which a multiline record is written
+	// if no other line was appended to it. Defaults to 1s.
+	FlushTimeout time.Duration
+}
+
+// multilinePresets are the multiline configurations of the common stack traces.
+var multilinePresets = map[string]MultilineConfig{
+	// Java exceptions, their causes and suppressed exceptions.
+	"java": {
+		Continuation: regexp.MustCompile(
+			`^(\s+at\s|\s+\.\.\.\s*\d+\s+(more|common frames omitted)|` +
+				`\s*Caused by:|\s*Suppressed:)`,
+		),
+	},
+	// Python tracebacks, including the chained exceptions.
+	"python": {
+		Start: regexp.MustCompile(`^Traceback \(most recent call last\):`),
+		Continuation: regexp.MustCompile(
+			`^(\s|Traceback \(most recent call last\):|` +
+				`[\w.]+(Error|Exception|Exit|Interrupt|Warning|Iteration)\b|` +
+				`During handling of the above exception|` +
+				`The above exception was the direct cause)`,
+		),
+	},
+	// Go panics and fatal errors with the stack traces of the goroutines.
+	"go": {
+		Start: regexp.MustCompile(`^(panic: |fatal error: )`),
+		Continuation: regexp.MustCompile(
+			`^(\s|goroutine \d+ \[|\[signal |created by |[\w./()*-]+\(.*\)\s*$|panic: )`,
+		),
+	},
+}
+
+// MultilinePreset returns the multiline configuration of the stack traces of the given
+// language: java, python or go.
+func MultilinePreset(name string) (MultilineConfig, error) {
+	preset, ok := multilinePresets[name]
+	if !ok {
+		return MultilineConfig{}, fmt.Errorf(
+			"%q is not a multiline preset (java, python or go)",
+			name,
+		)
+	}
+	return preset, nil
+}
+
+// Enabled reports whether the multiline records are joined.
+func (c MultilineConfig) Enabled() bool {
+	return c.Start != nil || c.Continuation != nil
+}
+
+// ApplyPreset sets the patterns of the preset which are not set yet.
+func (c *MultilineConfig) ApplyPreset(preset MultilineConfig) {
+	if c.Start == nil {
+		c.Start = preset.Start
+	}
+	if c.Continuation == nil {
+		c.Continuation = preset.Continuation
+	}
+}
+
+// withDefaults returns the configuration completed with the defaults, used if it
+// does not set any pattern.
+func (c MultilineConfig) withDefaults(defaults MultilineConfig) MultilineConfig {
+	if !c.Enabled() {
+		c.Start = defaults.Start
+		c.Continuation = defaults.Continuation
+	}
+	if c.MaxLines <= 0 {
+		c.MaxLines = defaults.MaxLines
+	}
+	if c.MaxLines <= 0 {
+		c.MaxLines = defaultMultilineMaxLines
+	}
+	if c.FlushTimeout <= 0 {
+		c.FlushTimeout = defaults.FlushTimeout
+	}
+	if c.FlushTimeout <= 0 {
+		c.FlushTimeout = defaultMultilineFlushTimeout
+	}
+	return c
+}
+
+// multilineWriter joins the NDJSON records written to it into multiline records
+// before writing them to w, as configured by [MultilineConfig].
+type multilineWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	enc    *json.Encoder
+	config MultilineConfig
+	// partial is the beginning of the last record, not yet terminated by a newline.
+	partial []byte
+	// pending is the multiline record being joined, if any.
+	pending *Record
+	// pendingLines is the number of lines joined into the pending record.
+	pendingLines int
+	// joinable indicates whether lines can be appended to the pending record.
+	joinable bool
+	timer    *time.Timer
+	closed   bool
+	// err is the error which occurred while writing a record when the timer fired.
+	err error
+}
+
+// newMultilineWriter returns a [multilineWriter] configured by config, whose limits must be set.
+func newMultilineWriter(w io.Writer, config MultilineConfig) *multilineWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &multilineWriter{
+		w:      w,
+		enc:    enc,
+		config: config,
+	}
+}
+
+func (w *multilineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := w.partial[:i+1]
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			// Keep the line as is, the readers skip the corrupted ones.
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+			if _, err := w.w.Write(line); err != nil {
+				return 0, err
+			}
+		} else if err := w.join(rec); err != nil {
+			return 0, err
+		}
+
+		w.partial = w.partial[i+1:]
+	}
+	w.partial = bytes.Clone(w.partial)
+
+	if w.pending != nil {
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.config.FlushTimeout, w.flushPending)
+		} else {
+			w.timer.Reset(w.config.FlushTimeout)
+		}
+	}
+
+	return len(p), nil
+}
+
+// join appends the record to the pending multiline record if it continues it.
+// Otherwise it writes the pending record and the new record becomes the pending one.
+func (w *multilineWriter) join(rec Record) error {
+	if w.pending != nil && w.joinable && w.pending.Stream == rec.Stream && w.continues(rec.Log) {
+		if w.pendingLines < w.config.MaxLines {
+			w.pending.Log += rec.Log
+			w.pendingLines++
+			return nil
+		}
+
+		// The following lines still belong to the multiline record.
+		if err := w.flush(); err != nil {
+			return err
+		}
+		w.pending, w.pendingLines, w.joinable = &rec, 1, true
+		return nil
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.pending, w.pendingLines = &rec, 1
+	// With both patterns, only the records starting with the start pattern are joined.
+	w.joinable = w.config.Start == nil || w.config.Continuation == nil ||
+		w.config.Start.MatchString(rec.Log)
+	if !w.joinable {
+		return w.flush()
+	}
+	return nil
+}
+
+// continues reports whether the line continues the pending multiline record.
+func (w *multilineWriter) continues(line string) bool {
+	if w.config.Continuation != nil {
+		return w.config.Continuation.MatchString(line)
+	}
+	return !w.config.Start.MatchString(line)
+}
+
+// flush writes the pending multiline record, if any.
+func (w *multilineWriter) flush() error {
+	if w.pending == nil {
+		return nil
+	}
+	rec := w.pending
+	w.pending = nil
+	return w.enc.Encode(rec)
+}
+
+// flushPending writes the pending multiline record once no line was appended
+// to it for [MultilineConfig.FlushTimeout].
+func (w *multilineWriter) flushPending() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.err != nil {
+		return
+	}
+	w.err = w.flush()
+}
+
+// Close writes the pending multiline record. It does not close the underlying writer.
+func (w *multilineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.flush()
+}
@@ -0,0 +1,208 @@
+package log
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Query represents the parameters for retrieving container logs.
+type Query struct {
+	// ContainerName is the name of the container to retrieve logs from.
+	ContainerName string
+
+	// IncludeStdout indicates whether to include stdout logs in the stream.
+	IncludeStdout bool
+
+	// IncludeStderr indicates whether to include stderr logs in the stream.
+	IncludeStderr bool
+
+	// Follow indicates whether to stream logs in real-time as they are generated.
+	// When true, the connection remains open and new logs are streamed as they appear.
+	Follow bool
+
+	// Wait indicates whether to wait for the container to start if it does not exist yet,
+	// rather than failing with [*ContainerNotFoundError].
+	Wait bool
+
+	// Persist indicates whether to keep following the logs once the container stops,
+	// continuing with its next runs and the containers later created with the same name.
+	// It implies Follow.
+	Persist bool
+
+	// Since, if not zero, excludes the logs emitted before this time.
+	Since time.Time
+
+	// Until, if not zero, excludes the logs emitted after this time.
+	Until time.Time
+
+	// Tail, if not nil, limits the logs to the last *Tail records
+	// satisfying the other filters, so that zero returns none of the logs.
+	// When following, the stream continues with new records after those.
+	Tail *int
+
+	// Format is the format of the returned log stream.
+	// Defaults to [FormatText].
+	Format Format
+
+	// Grep, if not empty, only includes the logs containing this substring.
+	Grep string
+
+	// Regex, if not nil, only includes the logs matching this regular expression.
+	Regex *regexp.Regexp
+
+	// Invert inverts the sense of Grep and Regex to include the logs not matching them.
+	Invert bool
+
+	// Context is the number of logs to include before and after each log
+	// matched by Grep or Regex, like grep -C.
+	Context int
+
+	// Fields, if not empty, only includes the structured logs whose fields have these
+	// values. The logs whose fields were not extracted during the collection are parsed
+	// as JSON or logfmt, see [ParseFields].
+	Fields map[string]string
+
+	// MinLevel, if not zero, only includes the structured logs of this level or above.
+	MinLevel Level
+
+	// MaxLevel, if not zero, only includes the structured logs of this level or below.
+	MaxLevel Level
+
+	// Run, if not nil, only includes the logs of a single run of the container, from
+	// one of its starts to the next one. The first run is 0 and negative indexes count
+	// back from the latest run, which is -1.
+	Run *int
+}
+
+// Includes reports whether the record satisfies the query filters.
+// It does not take [Query.Tail] and [Query.Context] into account.
+func (q Query) Includes(rec Record) bool {
+	return q.includesMetadata(rec) && q.matchesFields(rec) && q.matchesContent(rec)
+}
+
+// includesMetadata reports whether the record satisfies the stream and time filters.
+func (q Query) includesMetadata(rec Record) bool {
+	isStreamIncluded := (rec.Stream == StreamTypeStderr && q.IncludeStderr) ||
+		(rec.Stream == StreamTypeStdout && q.IncludeStdout)
+	if !isStreamIncluded {
+		return false
+	}
+
+	if !q.Since.IsZero() && rec.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && rec.Timestamp.After(q.Until) {
+		return false
+	}
+
+	return true
+}
+
+// hasContentFilter reports whether the query filters the logs by their content.
+func (q Query) hasContentFilter() bool {
+	return q.Grep != "" || q.Regex != nil
+}
+
+// hasFieldFilter reports whether the query filters the logs by their fields.
+func (q Query) hasFieldFilter() bool {
+	return len(q.Fields) > 0 || q.MinLevel != 0 || q.MaxLevel != 0
+}
+
+// matchesFields reports whether the record satisfies the field and level filters.
+func (q Query) matchesFields(rec Record) bool {
+	if !q.hasFieldFilter() {
+		return true
+	}
+
+	fields := rec.Fields
+	if fields == nil {
+		fields = ParseFields(rec.Log, FieldsFormatAuto)
+	}
+
+	for name, value := range q.Fields {
+		if v, ok := fields[name]; !ok || v != value {
+			return false
+		}
+	}
+
+	if q.MinLevel != 0 || q.MaxLevel != 0 {
+		level, err := ParseLevel(fields[FieldLevel])
+		if err != nil {
+			return false
+		}
+		if (q.MinLevel != 0 && level < q.MinLevel) || (q.MaxLevel != 0 && level > q.MaxLevel) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesContent reports whether the record satisfies the content filters.
+func (q Query) matchesContent(rec Record) bool {
+	if !q.hasContentFilter() {
+		return true
+	}
+
+	// Ignore the line terminator so that patterns can be anchored to the end of the line.
+	line := strings.TrimSuffix(rec.Log, "\n")
+	matches := (q.Grep == "" || strings.Contains(line, q.Grep)) &&
+		(q.Regex == nil || q.Regex.MatchString(line))
+	return matches != q.Invert
+}
+
+// tailIsExact reports whether applying the tail before the other filters,
+// as Docker does, yields the same records as applying it after them.
+func (q Query) tailIsExact() bool {
+	return q.IncludeStdout && q.IncludeStderr &&
+		q.Since.IsZero() && q.Until.IsZero() &&
+		!q.hasContentFilter() && !q.hasFieldFilter()
+}
+
+// recordFilter selects the records satisfying a query. It is stateful so that
+// it can also select the records surrounding the matches when [Query.Context] is set.
+type recordFilter struct {
+	query Query
+	// before holds the last records not matching the content filters,
+	// up to query.Context, in case the next record matches.
+	before []Record
+	// afterLeft is the number of records still to select after the last match.
+	afterLeft int
+}
+
+func newRecordFilter(query Query) *recordFilter {
+	return &recordFilter{query: query}
+}
+
+// filter calls yield, in order, for each record selected following rec.
+func (f *recordFilter) filter(rec Record, yield func(Record) error) error {
+	if !f.query.includesMetadata(rec) || !f.query.matchesFields(rec) {
+		return nil
+	}
+
+	if f.query.matchesContent(rec) {
+		for _, r := range f.before {
+			if err := yield(r); err != nil {
+				return err
+			}
+		}
+		f.before = f.before[:0]
+		f.afterLeft = f.query.Context
+		return yield(rec)
+	}
+
+	if f.afterLeft > 0 {
+		f.afterLeft--
+		return yield(rec)
+	}
+
+	if f.query.Context > 0 {
+		if len(f.before) == f.query.Context {
+			f.before = append(f.before[:0], f.before[1:]...)
+		}
+		f.before = append(f.before, rec)
+	}
+
+	return nil
+}
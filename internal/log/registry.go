@@ -0,0 +1,268 @@
+package log
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CollectorState is the state of the collection of a container's logs.
+//
+// A collection starts pending, then alternates between streaming and backing off
+// whenever the log stream is interrupted, until it is stopped:
+//
+//	pending -> streaming <-> backing-off
+//	   any  -> stopped
+type CollectorState string
+
+const (
+	// CollectorStatePending indicates the log stream of the container is being opened.
+	CollectorStatePending CollectorState = "pending"
+	// CollectorStateStreaming indicates the logs of the container are being saved.
+	CollectorStateStreaming CollectorState = "streaming"
+	// CollectorStateBackingOff indicates the log stream was interrupted and
+	// will be reopened after a delay.
+	CollectorStateBackingOff CollectorState = "backing-off"
+	// CollectorStateStopped indicates the logs of the container are not collected anymore.
+	CollectorStateStopped CollectorState = "stopped"
+)
+
+// collectorTransitions lists the valid transitions of the collector state machine.
+var collectorTransitions = map[CollectorState][]CollectorState{
+	CollectorStatePending:    {CollectorStateStreaming, CollectorStateBackingOff, CollectorStateStopped},
+	CollectorStateStreaming:  {CollectorStateBackingOff, CollectorStateStopped},
+	CollectorStateBackingOff: {CollectorStatePending, CollectorStateStopped},
+	CollectorStateStopped:    {CollectorStatePending},
+}
+
+// collectorRegistry keeps track of the log collectors by container ID. It guarantees
+// that at most one collector runs for a given container.
+type collectorRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*collectorEntry
+}
+
+type collectorEntry struct {
+	container Container
+	state     CollectorState
+	cancel    context.CancelFunc
+	// restarted is the container as it started again while being collected, if it did.
+	restarted *Container
+	status    CollectorStatus
+	// removed indicates the container was removed. The entry is deleted once its
+	// collector is stopped.
+	removed bool
+}
+
+func newCollectorRegistry() *collectorRegistry {
+	return &collectorRegistry{
+		entries: make(map[string]*collectorEntry),
+	}
+}
+
+// register registers a pending collector for the container unless one is already
+// running. It returns the context of the collector, canceled when the container
+// is removed, and whether the caller must run the collector.
+func (r *collectorRegistry) register(
+	ctx context.Context,
+	container Container,
+) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.entries[container.ID]; ok && entry.state != CollectorStateStopped {
+		// The container may have been restarted right after its log stream ended,
+		// in which case the collection must go on with the new run.
+		entry.restarted = &container
+		return nil, false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	entry := &collectorEntry{
+		container: container,
+		state:     CollectorStatePending,
+		cancel:    cancel,
+	}
+	// Keep the statistics of the previous collections of the container.
+	if previous, ok := r.entries[container.ID]; ok {
+		entry.status = previous.status
+	}
+	r.entries[container.ID] = entry
+	return ctx, true
+}
+
+// transition moves the collector of the container to the given state.
+func (r *collectorRegistry) transition(containerID string, to CollectorState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[containerID]
+	if !ok {
+		return fmt.Errorf("no collector registered for container %s", containerID)
+	}
+	return entry.transition(to)
+}
+
+func (e *collectorEntry) transition(to CollectorState) error {
+	for _, valid := range collectorTransitions[e.state] {
+		if valid == to {
+			e.state = to
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid collector state transition from %s to %s", e.state, to)
+}
+
+// finish is called when the collector of the container returns. If the container
+// started again in the meantime, the collector becomes pending again and finish
+// returns the restarted container to collect. Otherwise the collector is stopped.
+func (r *collectorRegistry) finish(ctx context.Context, containerID string) (Container, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Any state can transition to stopped and stopped to pending.
+	entry := r.entries[containerID]
+	_ = entry.transition(CollectorStateStopped)
+
+	restarted := entry.restarted
+	entry.restarted = nil
+	if restarted != nil && ctx.Err() == nil {
+		_ = entry.transition(CollectorStatePending)
+		entry.container = *restarted
+		return *restarted, true
+	}
+
+	entry.cancel()
+	if entry.removed {
+		delete(r.entries, containerID)
+	}
+	return Container{}, false
+}
+
+// remove stops the collector of the removed container, if any, and forgets it once
+// stopped. It reports whether a collector was registered for the container.
+func (r *collectorRegistry) remove(containerID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[containerID]
+	if !ok {
+		return false
+	}
+	entry.restarted = nil
+	entry.removed = true
+	entry.cancel()
+	if entry.state == CollectorStateStopped {
+		delete(r.entries, containerID)
+	}
+	return true
+}
+
+// state returns the state of the collector of the container.
+func (r *collectorRegistry) state(containerID string) (CollectorState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[containerID]
+	if !ok {
+		return "", false
+	}
+	return entry.state, true
+}
+
+// recordWrite updates the statistics of the collector after logs were saved.
+func (r *collectorRegistry) recordWrite(containerID string, n, records int, last time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.entries[containerID]; ok {
+		entry.status.BytesWritten += int64(n)
+		entry.status.RecordsWritten += int64(records)
+		if last.After(entry.status.LastRecordAt) {
+			entry.status.LastRecordAt = last
+		}
+	}
+}
+
+// recordError updates the statistics of the collector after the log stream failed.
+func (r *collectorRegistry) recordError(containerID string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.entries[containerID]; ok {
+		entry.status.Errors++
+		entry.status.LastError = err.Error()
+	}
+}
+
+// recordReconnect updates the statistics of the collector before the log stream
+// is reopened. It returns the total number of reconnections.
+func (r *collectorRegistry) recordReconnect(containerID string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[containerID]
+	if !ok {
+		return 0
+	}
+	entry.status.Reconnects++
+	return entry.status.Reconnects
+}
+
+// statuses returns the status of all the collectors, sorted by container name.
+func (r *collectorRegistry) statuses(now time.Time) []CollectorStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := make([]CollectorStatus, 0, len(r.entries))
+	for _, entry := range r.entries {
+		res = append(res, entry.statusAt(now))
+	}
+	slices.SortFunc(res, func(a, b CollectorStatus) int {
+		return cmp.Or(
+			strings.Compare(a.ContainerName, b.ContainerName),
+			strings.Compare(a.ContainerID, b.ContainerID),
+		)
+	})
+	return res
+}
+
+// status returns the status of the collector of the container specified by name or ID.
+// If several containers had the same name, the running collector is preferred.
+func (r *collectorRegistry) status(containerNameOrID string, now time.Time) (CollectorStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.entries[containerNameOrID]; ok {
+		return entry.statusAt(now), true
+	}
+
+	var found *collectorEntry
+	for _, entry := range r.entries {
+		if entry.container.Name != containerNameOrID {
+			continue
+		}
+		if found == nil || found.state == CollectorStateStopped {
+			found = entry
+		}
+	}
+	if found == nil {
+		return CollectorStatus{}, false
+	}
+	return found.statusAt(now), true
+}
+
+func (e *collectorEntry) statusAt(now time.Time) CollectorStatus {
+	status := e.status
+	status.ContainerID = e.container.ID
+	status.ContainerName = e.container.Name
+	status.State = e.state
+	if !status.LastRecordAt.IsZero() {
+		status.LagSeconds = now.Sub(status.LastRecordAt).Seconds()
+	}
+	return status
+}
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ContainerMatcher matches containers by one of their properties.
+type ContainerMatcher interface {
+	// Matches reports whether the container matches.
+	Matches(container Container) bool
+}
+
+// ParseContainerMatcher parses a container matcher from its textual representation:
+//
+//   - "name=<glob>" or "<glob>" matches the container name with a glob pattern (e.g. "proj-web-*")
+//   - "regex=<regexp>" matches the container name with a regular expression
+//   - "label=<key>" matches the containers having the label, whatever its value
+//   - "label=<key>=<value>" matches the containers having the label with this value
+//   - "image=<glob>" matches the container image with a glob pattern (e.g. "nginx:*")
+func ParseContainerMatcher(s string) (ContainerMatcher, error) {
+	kind, value, ok := strings.Cut(s, "=")
+	if !ok {
+		kind, value = "name", s
+	}
+
+	switch kind {
+	case "name":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %w", value, err)
+		}
+		return nameMatcher(value), nil
+
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name regex: %w", err)
+		}
+		return regexMatcher{re}, nil
+
+	case "label":
+		if value == "" || strings.HasPrefix(value, "=") {
+			return nil, fmt.Errorf("missing label key in %q", s)
+		}
+		return labelMatcher(value), nil
+
+	case "image":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q: %w", value, err)
+		}
+		return imageMatcher(value), nil
+
+	default:
+		// Container names cannot contain "=", so this is an unknown kind of matcher.
+		return nil, fmt.Errorf("unknown matcher %q, expected name, regex, label or image", kind)
+	}
+}
+
+// nameMatcher matches the container name with a glob pattern.
+type nameMatcher string
+
+func (m nameMatcher) Matches(container Container) bool {
+	ok, _ := path.Match(string(m), container.Name)
+	return ok
+}
+
+// regexMatcher matches the container name with a regular expression.
+type regexMatcher struct {
+	re *regexp.Regexp
+}
+
+func (m regexMatcher) Matches(container Container) bool {
+	return m.re.MatchString(container.Name)
+}
+
+// labelMatcher matches the container labels with "key" or "key=value".
+type labelMatcher string
+
+func (m labelMatcher) Matches(container Container) bool {
+	return hasLabels(container.Labels, []string{string(m)})
+}
+
+// imageMatcher matches the container image with a glob pattern.
+type imageMatcher string
+
+func (m imageMatcher) Matches(container Container) bool {
+	ok, _ := path.Match(string(m), container.Image)
+	return ok
+}
+
+// ContainerSelector selects containers with inclusion and exclusion rules.
+type ContainerSelector struct {
+	// Include, if not empty, only selects the containers matching at least one of the matchers.
+	Include []ContainerMatcher
+
+	// Exclude rejects the containers matching any of the matchers,
+	// even if they match an inclusion rule.
+	Exclude []ContainerMatcher
+}
+
+// Selects reports whether the selector selects the container.
+func (s ContainerSelector) Selects(container Container) bool {
+	for _, m := range s.Exclude {
+		if m.Matches(container) {
+			return false
+		}
+	}
+
+	if len(s.Include) == 0 {
+		return true
+	}
+	for _, m := range s.Include {
+		if m.Matches(container) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package log_test
+
+import (
+	"testing"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestContainerSelector_Selects(t *testing.T) {
+	web := log.Container{
+		Name:   "shop-web-1",
+		Image:  "nginx:1.27",
+		Labels: map[string]string{"com.docker.compose.project": "shop", "tier": "front"},
+	}
+	db := log.Container{
+		Name:   "shop-db-1",
+		Image:  "postgres:17",
+		Labels: map[string]string{"com.docker.compose.project": "shop"},
+	}
+	other := log.Container{Name: "scratch", Image: "alpine:latest"}
+
+	testCases := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected []bool // web, db, other
+	}{
+		{
+			name:     "no rules",
+			expected: []bool{true, true, true},
+		},
+		{
+			name:     "exact name",
+			include:  []string{"scratch"},
+			expected: []bool{false, false, true},
+		},
+		{
+			name:     "name glob",
+			include:  []string{"shop-*"},
+			expected: []bool{true, true, false},
+		},
+		{
+			name:     "explicit name glob",
+			include:  []string{"name=shop-web-*"},
+			expected: []bool{true, false, false},
+		},
+		{
+			name:     "regex",
+			include:  []string{`regex=^shop-(web|api)-\d+$`},
+			expected: []bool{true, false, false},
+		},
+		{
+			name:     "label key",
+			include:  []string{"label=tier"},
+			expected: []bool{true, false, false},
+		},
+		{
+			name:     "label key and value",
+			include:  []string{"label=com.docker.compose.project=shop"},
+			expected: []bool{true, true, false},
+		},
+		{
+			name:     "image glob",
+			include:  []string{"image=postgres:*"},
+			expected: []bool{false, true, false},
+		},
+		{
+			name:     "several inclusion rules",
+			include:  []string{"image=postgres:*", "scratch"},
+			expected: []bool{false, true, true},
+		},
+		{
+			name:     "exclusion only",
+			exclude:  []string{"image=nginx:*"},
+			expected: []bool{false, true, true},
+		},
+		{
+			name:     "exclusion wins over inclusion",
+			include:  []string{"label=com.docker.compose.project=shop"},
+			exclude:  []string{"*-db-*"},
+			expected: []bool{true, false, false},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selector := log.ContainerSelector{
+				Include: mustParseMatchers(t, tc.include...),
+				Exclude: mustParseMatchers(t, tc.exclude...),
+			}
+
+			for i, ctr := range []log.Container{web, db, other} {
+				if got := selector.Selects(ctr); got != tc.expected[i] {
+					t.Errorf("%s: expected %t, got %t", ctr.Name, tc.expected[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseContainerMatcher_Invalid(t *testing.T) {
+	for _, value := range []string{
+		"name=[",
+		"regex=(",
+		"label=",
+		"label==value",
+		"image=[",
+		"status=running",
+	} {
+		if _, err := log.ParseContainerMatcher(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
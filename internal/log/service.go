@@ -1,12 +1,14 @@
 package log
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"slices"
 	"time"
 )
 
@@ -18,13 +20,90 @@ type ContainerLogStreamer interface {
 	StreamContainerLogs(ctx context.Context, query Query) (io.ReadCloser, error)
 }
 
+// ContainerWatcher provides the lifecycle of the Docker containers.
+type ContainerWatcher interface {
+	ContainerInspector
+
+	// WatchContainers watches for container lifecycle events (started, deleted, etc.).
+	// If since is not zero, the events which occurred since that time are replayed first.
+	WatchContainers(ctx context.Context, since time.Time) (<-chan ContainerEvent, <-chan error)
+}
+
 // StorageReader opens stored log streams for containers.
 //
 // NOTE: We only wrote a filesystem implementation as for now for the test but we would
 // most likely also accept a [context.Context] for implementations using the network.
 type StorageReader interface {
-	// Open returns a reader for the stored logs of the specified container.
-	Open(containerName string) (io.ReadCloser, error)
+	// Open returns a reader for the stored logs of the container specified in the query.
+	//
+	// Implementations are not required to filter the records but they can use
+	// the query to avoid reading unnecessary data (e.g. only read the end
+	// of the logs when [Query.Tail] is set).
+	//
+	// If [Query.Follow] is set, the reader waits for the records collected until the reader
+	// is closed or, if the logs were being collected when opened, until the collection stops.
+	// As the stream does not end, the implementation must then apply [Query.Tail] itself.
+	Open(query Query) (io.ReadCloser, error)
+
+	// OpenHistory returns a reader for the logs of the container specified in the query
+	// stored so far, like Open does without following them, and a [StoredLogReader]
+	// reading the records stored after them.
+	//
+	// If [Query.Follow] is set, the second reader waits for the records collected like
+	// Open does when following. Otherwise it returns [io.EOF] each time it catches up
+	// with the records stored so far, and reads the records stored meanwhile once
+	// read again.
+	OpenHistory(query Query) (io.ReadCloser, StoredLogReader, error)
+
+	// IsCollecting reports whether the logs of the container specified in the query
+	// are being collected, including all the streams it requests.
+	IsCollecting(query Query) bool
+
+	// ListRuns returns the runs of the container recorded while collecting its logs,
+	// from the oldest to the latest.
+	ListRuns(containerNameOrID string) ([]Run, error)
+}
+
+// StoredLogReader reads the records stored after a [Position] in the storage.
+type StoredLogReader interface {
+	io.ReadCloser
+
+	// Position returns the position following the last byte read.
+	Position() Position
+}
+
+// Position is a position in the stored logs of a container, used to hand over
+// the records read from the storage to the ones published to the [Hub].
+type Position struct {
+	// Segment numbers the files the logs are written to, in the order they are written.
+	Segment int64
+	// Offset is the offset in the file.
+	Offset int64
+}
+
+// Compare returns -1, 0 or +1 depending on whether p is before, at or after other.
+func (p Position) Compare(other Position) int {
+	return cmp.Or(cmp.Compare(p.Segment, other.Segment), cmp.Compare(p.Offset, other.Offset))
+}
+
+// IsZero reports whether p is the zero position, preceding all the others.
+func (p Position) IsZero() bool {
+	return p == Position{}
+}
+
+// ServiceOptions are optional parameters used to configure
+// the behavior of the [Service].
+type ServiceOptions struct {
+	// Hub receives the records collected from the containers. If set, the logs
+	// being collected are followed through the hub rather than from the storage,
+	// and the starts of the containers are received from the hub rather than by
+	// watching the Docker events.
+	Hub *Hub
+
+	// Watcher is used to wait for the containers to start, see [Query.Wait] and
+	// [Query.Persist], and to follow the stored logs of the stopped containers.
+	// If nil, waiting for a container is not supported.
+	Watcher ContainerWatcher
 }
 
 // Service provides a unified interface for accessing container logs
@@ -34,6 +113,7 @@ type Service struct {
 	streamer ContainerLogStreamer
 	storage  StorageReader
 	logger   *slog.Logger
+	options  ServiceOptions
 }
 
 // NewService creates a new [Service] for retrieving Docker container logs
@@ -42,29 +122,27 @@ func NewService(
 	streamer ContainerLogStreamer,
 	storage StorageReader,
 	logger *slog.Logger,
+	opts ServiceOptions,
 ) *Service {
 	return &Service{
 		streamer: streamer,
 		storage:  storage,
 		logger:   logger,
+		options:  opts,
 	}
 }
 
-// Query represents the parameters for retrieving container logs.
-type Query struct {
-	// ContainerName is the name of the container to retrieve logs from.
-	ContainerName string
+// Format represents the output format of a log stream.
+type Format string
 
-	// IncludeStdout indicates whether to include stdout logs in the stream.
-	IncludeStdout bool
-
-	// IncludeStderr indicates whether to include stderr logs in the stream.
-	IncludeStderr bool
-
-	// Follow indicates whether to stream logs in real-time as they are generated.
-	// When true, the connection remains open and new logs are streamed as they appear.
-	Follow bool
-}
+const (
+	// FormatText outputs the raw log entries text.
+	FormatText Format = "text"
+	// FormatNDJSON outputs one JSON encoded [Record] per line.
+	FormatNDJSON Format = "ndjson"
+	// FormatJSON outputs a JSON array of [Record].
+	FormatJSON Format = "json"
+)
 
 // StreamType identifies the output stream of a log entry.
 type StreamType string
@@ -86,61 +164,385 @@ type Record struct {
 
 	// Log contains the raw log entry text.
 	Log string `json:"output"`
+
+	// Container is the name of the container which emitted the log.
+	// It is only set when the logs of several containers are merged.
+	Container string `json:"container,omitempty"`
+
+	// Fields are the fields extracted from the log if it is structured, see [ParseFields].
+	// They are only set if the collection of the container logs extracts them.
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
 // GetContainerLogs retrieves logs for the specified container. It first attempts to fetch
 // live logs from Docker, then falls back to stored logs if the container is not found.
 // The returned stream is filtered according to the query parameters.
 func (s *Service) GetContainerLogs(ctx context.Context, query Query) (io.ReadCloser, error) {
-	var (
-		rc          io.ReadCloser
-		err         error
-		notFoundErr *ContainerNotFoundError
-	)
-	rc, err = s.streamer.StreamContainerLogs(ctx, query)
+	if query.Run != nil {
+		var err error
+		query, err = s.selectRun(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Wait || query.Persist {
+		return s.watchContainerLogs(ctx, query)
+	}
+
+	sources, err := s.openContainerLogs(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Transform the NDJSON streams into the requested format, filtering them according to the query.
+	// Docker already applies some of these filters but the stored logs still need them.
+	pr, pw := io.Pipe()
+
+	go func() {
+		enc := newRecordEncoder(pw, query.Format)
+		_, err := copyRecords(ctx, enc, sources, newRecordFilter(query))
+		if err == nil {
+			err = enc.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// copyRecords encodes the records of the sources selected by the filter, in order, and
+// closes them. It returns the timestamp of the last record read.
+func copyRecords(
+	ctx context.Context,
+	enc recordEncoder,
+	sources []logSource,
+	filter *recordFilter,
+) (time.Time, error) {
+	closeSources := func() {
+		for _, src := range sources {
+			src.rc.Close()
+		}
+	}
+	defer closeSources()
+	// The stored logs being followed do not end when the context is canceled.
+	stop := context.AfterFunc(ctx, closeSources)
+	defer stop()
+
+	return writeRecords(enc, sources, filter)
+}
+
+// selectRun restricts the time range of the query to the run it selects.
+//
+// A run spans from the start of the container to its next start, so that the
+// logs emitted while it was exiting are included. The first run also includes
+// the logs stored before any run was recorded.
+func (s *Service) selectRun(query Query) (Query, error) {
+	// The runs of a container are unknown until its logs are collected.
+	var notFoundErr *ContainerNotFoundError
+	runs, err := s.storage.ListRuns(query.ContainerName)
+	if err != nil && !errors.As(err, &notFoundErr) {
+		return Query{}, fmt.Errorf("list container runs: %w", err)
+	}
+
+	i := *query.Run
+	if i < 0 {
+		i += len(runs)
+	}
+	if len(runs) == 0 && *query.Run == -1 {
+		// Without any recorded run, all the logs belong to the latest one.
+		query.Run = nil
+		return query, nil
+	}
+	if i < 0 || i >= len(runs) {
+		return Query{}, &RunNotFoundError{Name: query.ContainerName, Index: *query.Run}
+	}
+
+	if i > 0 && runs[i].StartedAt.After(query.Since) {
+		query.Since = runs[i].StartedAt
+	}
+	if i < len(runs)-1 {
+		end := runs[i+1].StartedAt.Add(-time.Nanosecond)
+		if query.Until.IsZero() || end.Before(query.Until) {
+			query.Until = end
+		}
+	}
+
+	return query, nil
+}
+
+// logSource is a NDJSON stream of records to filter.
+type logSource struct {
+	rc io.ReadCloser
+	// tail, if not nil, is the number of last selected records to keep from the stream.
+	// The stream is then read entirely before any record is written.
+	tail *int
+}
+
+// openContainerLogs returns the NDJSON log streams of the container, to read in order,
+// from Docker or from the storage if the container cannot be found in Docker.
+func (s *Service) openContainerLogs(ctx context.Context, query Query) ([]logSource, error) {
+	var notFoundErr *ContainerNotFoundError
+	follow := query.Follow && query.Until.IsZero()
+
+	if follow && s.options.Hub != nil {
+		sources, ok, err := s.subscribeContainerLogs(query)
+		if ok || err != nil {
+			return sources, err
+		}
+	}
+
+	// The collector stores the container logs as they are emitted, so they are followed
+	// from the storage rather than from a new Docker stream replaying their history.
+	if follow && s.storage.IsCollecting(query) {
+		sources, err := s.openStoredLogs(query, true)
+		if err == nil {
+			return sources, nil
+		} else if !errors.As(err, &notFoundErr) {
+			return nil, fmt.Errorf("open log file: %w", err)
+		}
+		// The stored logs were removed meanwhile.
+	}
+
+	// The log stream of a stopped container ends right away, so its stored logs are
+	// followed instead until it starts again. Persisting follows its next runs itself.
+	if follow && !query.Persist && s.isStopped(ctx, query.ContainerName) {
+		sources, err := s.openStoredLogs(query, true)
+		if err == nil {
+			return sources, nil
+		} else if !errors.As(err, &notFoundErr) {
+			return nil, fmt.Errorf("open log file: %w", err)
+		}
+		// The logs of the container are not stored.
+	}
+
+	sources, err := s.streamContainerLogs(ctx, query)
 	if errors.As(err, &notFoundErr) {
 		s.logger.Debug(
 			"Container not found in Docker, attempting to read from storage",
 			slog.String("containerName", query.ContainerName),
 		)
 
-		rc, err = s.storage.Open(query.ContainerName)
+		sources, err := s.openStoredLogs(query, follow && !query.Persist)
 		if errors.As(err, &notFoundErr) {
 			return nil, err
 		} else if err != nil {
 			return nil, fmt.Errorf("open log file: %w", err)
 		}
+		return sources, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("fetch container logs: %w", err)
 	}
 
-	// Transform the NDJSON stream into raw text, filtering by stream type.
-	pr, pw := io.Pipe()
+	return sources, nil
+}
 
-	go func() {
-		defer rc.Close()
-		defer pw.Close()
+// openStoredLogs returns the stored log streams of the container. If following, the storage
+// waits for the records collected until the stream is closed or the collection stops.
+func (s *Service) openStoredLogs(query Query, follow bool) ([]logSource, error) {
+	query.Follow = follow
+	if !follow || query.Tail == nil || query.Context == 0 {
+		storageQuery := query
+		if query.Context > 0 {
+			// The context of the matches is only known after reading all the logs.
+			storageQuery.Tail = nil
+		}
+		rc, err := s.storage.Open(storageQuery)
+		if err != nil {
+			return nil, err
+		}
+		if follow {
+			// The storage applies the tail itself when following.
+			return []logSource{{rc: rc}}, nil
+		}
+		// The storage is not required to apply the tail itself.
+		return []logSource{{rc: rc, tail: query.Tail}}, nil
+	}
+
+	// The context of the matches to tail is only known after reading all the logs, so the
+	// history is read entirely before following the records stored after it.
+	historyQuery := query
+	historyQuery.Tail = nil
+	history, live, err := s.storage.OpenHistory(historyQuery)
+	if err != nil {
+		return nil, err
+	}
+	return []logSource{{rc: history, tail: query.Tail}, {rc: live}}, nil
+}
+
+// isStopped reports whether the container exists in Docker but is not running.
+// It returns false if the state of the containers is unknown.
+func (s *Service) isStopped(ctx context.Context, containerNameOrID string) bool {
+	if s.options.Watcher == nil {
+		return false
+	}
+	ctr, err := s.options.Watcher.InspectContainer(ctx, containerNameOrID)
+	return err == nil && ctr.State != "running"
+}
+
+// subscribeContainerLogs returns the stored logs of the container followed by the records
+// published to the hub while they are being collected. It returns false if they are not.
+func (s *Service) subscribeContainerLogs(query Query) ([]logSource, bool, error) {
+	if !s.storage.IsCollecting(query) {
+		return nil, false, nil
+	}
+
+	historyQuery := query
+	historyQuery.Follow = false
+	if query.Context > 0 {
+		// The context of the matches is only known after reading all the logs.
+		historyQuery.Tail = nil
+	}
+	history, stored, err := s.storage.OpenHistory(historyQuery)
+	var notFoundErr *ContainerNotFoundError
+	if errors.As(err, &notFoundErr) {
+		// The stored logs were removed meanwhile.
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("open log file: %w", err)
+	}
+
+	// The records stored after the history are read from the storage until caught up,
+	// and then received from the hub.
+	return []logSource{
+		{rc: history, tail: query.Tail},
+		{rc: newFollowerReader(s.options.Hub, s.storage, query, stored)},
+	}, true, nil
+}
+
+// streamContainerLogs fetches the container logs from Docker.
+//
+// Docker applies the tail before filtering the logs by stream, time or content,
+// so when the query filters the logs we compute the last matching records from the
+// complete history ourselves and then continue with the live logs if following.
+func (s *Service) streamContainerLogs(ctx context.Context, query Query) ([]logSource, error) {
+	if query.Tail == nil || query.tailIsExact() {
+		rc, err := s.streamer.StreamContainerLogs(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return []logSource{{rc: rc}}, nil
+	}
 
-		dec := json.NewDecoder(rc)
+	now := time.Now()
+	cutoff := now
+	if !query.Until.IsZero() && query.Until.Before(cutoff) {
+		cutoff = query.Until
+	}
+
+	historyQuery := query
+	historyQuery.Tail = nil
+	historyQuery.Follow = false
+	historyQuery.Until = cutoff
+	history, err := s.streamer.StreamContainerLogs(ctx, historyQuery)
+	if err != nil {
+		return nil, err
+	}
+	sources := []logSource{{rc: history, tail: query.Tail}}
+
+	// Nothing more can match if the query ends in the past.
+	if !query.Follow || cutoff.Before(now) {
+		return sources, nil
+	}
+
+	liveQuery := query
+	liveQuery.Tail = nil
+	liveQuery.Since = cutoff.Add(time.Nanosecond)
+	live, err := s.streamer.StreamContainerLogs(ctx, liveQuery)
+	if err != nil {
+		history.Close()
+		return nil, err
+	}
+
+	return append(sources, logSource{rc: live}), nil
+}
+
+// writeRecords encodes the records of the sources selected by the filter, in order.
+// It returns the timestamp of the last record read.
+func writeRecords(
+	enc recordEncoder,
+	sources []logSource,
+	filter *recordFilter,
+) (time.Time, error) {
+	// last is the timestamp of the last record read from the previous sources.
+	var last time.Time
+	for _, src := range sources {
+		if src.tail != nil {
+			recs, lastRead, err := tailRecords(src.rc, *src.tail, filter)
+			if err != nil {
+				return last, err
+			}
+			last = maxTime(last, lastRead)
+			for _, rec := range recs {
+				if err := enc.Encode(rec); err != nil {
+					return last, err
+				}
+			}
+			continue
+		}
+
+		var lastRead time.Time
+		dec := json.NewDecoder(src.rc)
 		for {
 			var rec Record
 			if err := dec.Decode(&rec); err != nil {
 				if errors.Is(err, io.EOF) {
-					return
+					break
 				}
-				_ = pw.CloseWithError(err)
-				return
+				return maxTime(last, lastRead), fmt.Errorf("decode log record: %w", err)
 			}
+			lastRead = maxTime(lastRead, rec.Timestamp)
 
-			isIncluded := (rec.Stream == StreamTypeStderr && query.IncludeStderr) ||
-				(rec.Stream == StreamTypeStdout && query.IncludeStdout)
-			if isIncluded {
-				if _, err := pw.Write([]byte(rec.Log)); err != nil {
-					return
-				}
+			if err := filter.filter(rec, enc.Encode); err != nil {
+				return maxTime(last, lastRead), err
 			}
 		}
-	}()
+		last = maxTime(last, lastRead)
+	}
 
-	return pr, nil
+	return last, nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// tailRecords reads the whole NDJSON stream and returns the last n records
+// selected by the filter, and the timestamp of the last record read.
+func tailRecords(r io.Reader, n int, filter *recordFilter) ([]Record, time.Time, error) {
+	// Ring buffer holding the last selected records.
+	var (
+		recs []Record
+		next int
+	)
+	keep := func(rec Record) error {
+		switch {
+		case len(recs) < n:
+			recs = append(recs, rec)
+		case n > 0:
+			recs[next] = rec
+			next = (next + 1) % n
+		}
+		return nil
+	}
+
+	var last time.Time
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, time.Time{}, fmt.Errorf("decode log record: %w", err)
+		}
+		last = maxTime(last, rec.Timestamp)
+
+		_ = filter.filter(rec, keep)
+	}
+
+	return slices.Concat(recs[next:], recs[:next]), last, nil
 }
@@ -13,9 +13,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"regexp"
+	"sync"
 	"testing"
+	"testing/synctest"
 	"time"
 
 	"github.com/matthieugusmini/docker-logproxy/internal/log"
@@ -69,7 +73,7 @@ func TestService_GetContainerLogs(t *testing.T) {
 				storage := &fakeStorageReader{
 					containers: map[string][]log.Record{},
 				}
-				service := log.NewService(streamer, storage, logger)
+				service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
 
 				rc, err := service.GetContainerLogs(context.Background(), log.Query{
 					ContainerName: "test-container",
@@ -130,7 +134,7 @@ func TestService_GetContainerLogs(t *testing.T) {
 						"stopped-container": logs,
 					},
 				}
-				service := log.NewService(streamer, storage, logger)
+				service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
 
 				rc, err := service.GetContainerLogs(context.Background(), log.Query{
 					ContainerName: "stopped-container",
@@ -154,6 +158,776 @@ func TestService_GetContainerLogs(t *testing.T) {
 		}
 	})
 
+	t.Run("storage fallback with time range", func(t *testing.T) {
+		timedLogs := []log.Record{
+			{Timestamp: testTime, Stream: "stderr", Log: "line 1\n"},
+			{Timestamp: testTime.Add(time.Minute), Stream: "stderr", Log: "line 2\n"},
+			{Timestamp: testTime.Add(2 * time.Minute), Stream: "stderr", Log: "line 3\n"},
+			{Timestamp: testTime.Add(3 * time.Minute), Stream: "stderr", Log: "line 4\n"},
+		}
+
+		testCases := []struct {
+			name     string
+			since    time.Time
+			until    time.Time
+			expected string
+		}{
+			{
+				name:     "since only",
+				since:    testTime.Add(2 * time.Minute),
+				expected: "line 3\nline 4\n",
+			},
+			{
+				name:     "until only",
+				until:    testTime.Add(time.Minute),
+				expected: "line 1\nline 2\n",
+			},
+			{
+				name:     "since and until",
+				since:    testTime.Add(time.Minute),
+				until:    testTime.Add(2 * time.Minute),
+				expected: "line 2\nline 3\n",
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				streamer := &fakeContainerLogStreamer{
+					containers: map[string][]log.Record{},
+				}
+				storage := &fakeStorageReader{
+					containers: map[string][]log.Record{
+						"stopped-container": timedLogs,
+					},
+				}
+				service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+				rc, err := service.GetContainerLogs(context.Background(), log.Query{
+					ContainerName: "stopped-container",
+					IncludeStderr: true,
+					Since:         tc.since,
+					Until:         tc.until,
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer rc.Close()
+
+				data, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("failed to read logs: %v", err)
+				}
+
+				if string(data) != tc.expected {
+					t.Errorf("expected %q, got %q", tc.expected, string(data))
+				}
+			})
+		}
+	})
+
+	t.Run("tail returns the last matching records", func(t *testing.T) {
+		testCases := []struct {
+			name          string
+			tail          int
+			includeStdout bool
+			includeStderr bool
+			expected      string
+		}{
+			{
+				name:          "both streams",
+				tail:          3,
+				includeStdout: true,
+				includeStderr: true,
+				expected:      "stderr line 1\nstdout line 2\nstderr line 2\n",
+			},
+			{
+				name:          "stdout only",
+				tail:          1,
+				includeStdout: true,
+				expected:      "stdout line 2\n",
+			},
+			{
+				name:          "stderr only",
+				tail:          2,
+				includeStderr: true,
+				expected:      "stderr line 1\nstderr line 2\n",
+			},
+			{
+				name:          "more than available",
+				tail:          10,
+				includeStderr: true,
+				expected:      "stderr line 1\nstderr line 2\n",
+			},
+			{
+				name:          "none",
+				tail:          0,
+				includeStdout: true,
+				includeStderr: true,
+				expected:      "",
+			},
+			{
+				name:          "none of stderr",
+				tail:          0,
+				includeStderr: true,
+				expected:      "",
+			},
+		}
+
+		for _, tc := range testCases {
+			for _, source := range []string{"docker", "storage"} {
+				t.Run(tc.name+" from "+source, func(t *testing.T) {
+					streamer := &fakeContainerLogStreamer{
+						containers: map[string][]log.Record{},
+					}
+					storage := &fakeStorageReader{
+						containers: map[string][]log.Record{},
+					}
+					if source == "docker" {
+						streamer.containers["test-container"] = logs
+					} else {
+						storage.containers["test-container"] = logs
+					}
+					service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+					rc, err := service.GetContainerLogs(context.Background(), log.Query{
+						ContainerName: "test-container",
+						IncludeStdout: tc.includeStdout,
+						IncludeStderr: tc.includeStderr,
+						Tail:          &tc.tail,
+					})
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					defer rc.Close()
+
+					data, err := io.ReadAll(rc)
+					if err != nil {
+						t.Fatalf("failed to read logs: %v", err)
+					}
+
+					if string(data) != tc.expected {
+						t.Errorf("expected %q, got %q", tc.expected, string(data))
+					}
+				})
+			}
+		}
+	})
+
+	t.Run("structured formats", func(t *testing.T) {
+		testCases := []struct {
+			name     string
+			format   log.Format
+			expected string
+		}{
+			{
+				name:   "ndjson",
+				format: log.FormatNDJSON,
+				expected: `{"timestamp":"2024-01-01T12:00:00Z","stream":"stderr","output":"stderr line 1\n"}
+{"timestamp":"2024-01-01T12:00:00Z","stream":"stderr","output":"stderr line 2\n"}
+`,
+			},
+			{
+				name:   "json",
+				format: log.FormatJSON,
+				expected: `[
+{"timestamp":"2024-01-01T12:00:00Z","stream":"stderr","output":"stderr line 1\n"},
+{"timestamp":"2024-01-01T12:00:00Z","stream":"stderr","output":"stderr line 2\n"}
+]
+`,
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				streamer := &fakeContainerLogStreamer{
+					containers: map[string][]log.Record{
+						"test-container": logs,
+					},
+				}
+				storage := &fakeStorageReader{
+					containers: map[string][]log.Record{},
+				}
+				service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+				rc, err := service.GetContainerLogs(context.Background(), log.Query{
+					ContainerName: "test-container",
+					IncludeStderr: true,
+					Format:        tc.format,
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer rc.Close()
+
+				data, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("failed to read logs: %v", err)
+				}
+
+				if string(data) != tc.expected {
+					t.Errorf("expected %q, got %q", tc.expected, string(data))
+				}
+			})
+		}
+	})
+
+	t.Run("content filtering", func(t *testing.T) {
+		grepLogs := []log.Record{
+			{Timestamp: testTime, Stream: "stderr", Log: "starting\n"},
+			{Timestamp: testTime, Stream: "stderr", Log: "request 1\n"},
+			{Timestamp: testTime, Stream: "stderr", Log: "ERROR: request 1 failed\n"},
+			{Timestamp: testTime, Stream: "stderr", Log: "request 2\n"},
+			{Timestamp: testTime, Stream: "stderr", Log: "request 3\n"},
+			{Timestamp: testTime, Stream: "stderr", Log: "request 4\n"},
+			{Timestamp: testTime, Stream: "stderr", Log: "ERROR: request 4 failed\n"},
+			{Timestamp: testTime, Stream: "stderr", Log: "stopping\n"},
+		}
+
+		testCases := []struct {
+			name     string
+			query    log.Query
+			expected string
+		}{
+			{
+				name:     "substring",
+				query:    log.Query{Grep: "ERROR"},
+				expected: "ERROR: request 1 failed\nERROR: request 4 failed\n",
+			},
+			{
+				name:     "regex",
+				query:    log.Query{Regex: regexp.MustCompile(`^request [12]$`)},
+				expected: "request 1\nrequest 2\n",
+			},
+			{
+				name:     "inverted",
+				query:    log.Query{Grep: "request", Invert: true},
+				expected: "starting\nstopping\n",
+			},
+			{
+				name:  "context",
+				query: log.Query{Grep: "ERROR", Context: 1},
+				expected: "request 1\nERROR: request 1 failed\nrequest 2\n" +
+					"request 4\nERROR: request 4 failed\nstopping\n",
+			},
+			{
+				name:     "context with tail",
+				query:    log.Query{Grep: "ERROR", Context: 1, Tail: ptr(2)},
+				expected: "ERROR: request 4 failed\nstopping\n",
+			},
+			{
+				name:     "tail",
+				query:    log.Query{Grep: "request", Tail: ptr(2)},
+				expected: "request 4\nERROR: request 4 failed\n",
+			},
+		}
+
+		for _, tc := range testCases {
+			for _, source := range []string{"docker", "storage"} {
+				t.Run(tc.name+" from "+source, func(t *testing.T) {
+					streamer := &fakeContainerLogStreamer{
+						containers: map[string][]log.Record{},
+					}
+					storage := &fakeStorageReader{
+						containers: map[string][]log.Record{},
+					}
+					if source == "docker" {
+						streamer.containers["test-container"] = grepLogs
+					} else {
+						storage.containers["test-container"] = grepLogs
+					}
+					service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+					query := tc.query
+					query.ContainerName = "test-container"
+					query.IncludeStderr = true
+					rc, err := service.GetContainerLogs(context.Background(), query)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					defer rc.Close()
+
+					data, err := io.ReadAll(rc)
+					if err != nil {
+						t.Fatalf("failed to read logs: %v", err)
+					}
+
+					if string(data) != tc.expected {
+						t.Errorf("expected %q, got %q", tc.expected, string(data))
+					}
+				})
+			}
+		}
+	})
+
+	t.Run("field filtering", func(t *testing.T) {
+		structuredLogs := []log.Record{
+			{Timestamp: testTime, Stream: "stderr", Log: "starting\n"},
+			{
+				Timestamp: testTime,
+				Stream:    "stderr",
+				Log:       "level=info msg=login user_id=42\n",
+			},
+			{
+				Timestamp: testTime,
+				Stream:    "stderr",
+				Log:       `{"level":"warn","msg":"slow","user_id":7}` + "\n",
+				Fields:    map[string]string{"level": "warn", "msg": "slow", "user_id": "7"},
+			},
+			{Timestamp: testTime, Stream: "stderr", Log: "level=error msg=failed user_id=42\n"},
+		}
+
+		testCases := []struct {
+			name     string
+			query    log.Query
+			expected string
+		}{
+			{
+				name:     "field",
+				query:    log.Query{Fields: map[string]string{"user_id": "42"}},
+				expected: "level=info msg=login user_id=42\nlevel=error msg=failed user_id=42\n",
+			},
+			{
+				name:  "minimum level",
+				query: log.Query{MinLevel: log.LevelWarn},
+				expected: `{"level":"warn","msg":"slow","user_id":7}` + "\n" +
+					"level=error msg=failed user_id=42\n",
+			},
+			{
+				name:     "level range",
+				query:    log.Query{MinLevel: log.LevelWarn, MaxLevel: log.LevelWarn},
+				expected: `{"level":"warn","msg":"slow","user_id":7}` + "\n",
+			},
+			{
+				name: "field and level with tail",
+				query: log.Query{
+					Fields:   map[string]string{"user_id": "42"},
+					MaxLevel: log.LevelInfo,
+					Tail:     ptr(1),
+				},
+				expected: "level=info msg=login user_id=42\n",
+			},
+		}
+
+		for _, tc := range testCases {
+			for _, source := range []string{"docker", "storage"} {
+				t.Run(tc.name+" from "+source, func(t *testing.T) {
+					streamer := &fakeContainerLogStreamer{
+						containers: map[string][]log.Record{},
+					}
+					storage := &fakeStorageReader{
+						containers: map[string][]log.Record{},
+					}
+					if source == "docker" {
+						streamer.containers["test-container"] = structuredLogs
+					} else {
+						storage.containers["test-container"] = structuredLogs
+					}
+					service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+					query := tc.query
+					query.ContainerName = "test-container"
+					query.IncludeStderr = true
+					rc, err := service.GetContainerLogs(context.Background(), query)
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					defer rc.Close()
+
+					data, err := io.ReadAll(rc)
+					if err != nil {
+						t.Fatalf("failed to read logs: %v", err)
+					}
+
+					if string(data) != tc.expected {
+						t.Errorf("expected %q, got %q", tc.expected, string(data))
+					}
+				})
+			}
+		}
+	})
+
+	t.Run("run selection", func(t *testing.T) {
+		runLogs := []log.Record{
+			{Timestamp: testTime, Stream: "stderr", Log: "run 0\n"},
+			{Timestamp: testTime.Add(time.Minute), Stream: "stderr", Log: "run 0 crashed\n"},
+			{Timestamp: testTime.Add(2 * time.Minute), Stream: "stderr", Log: "run 1\n"},
+			{Timestamp: testTime.Add(4 * time.Minute), Stream: "stderr", Log: "run 2\n"},
+		}
+		runs := []log.Run{
+			{StartedAt: testTime, FinishedAt: testTime.Add(time.Minute), ExitCode: 1},
+			{StartedAt: testTime.Add(2 * time.Minute), FinishedAt: testTime.Add(3 * time.Minute)},
+			{StartedAt: testTime.Add(4 * time.Minute)},
+		}
+		run := func(i int) *int { return &i }
+
+		testCases := []struct {
+			name     string
+			run      *int
+			expected string
+		}{
+			{
+				name:     "all runs",
+				expected: "run 0\nrun 0 crashed\nrun 1\nrun 2\n",
+			},
+			{
+				name:     "first run",
+				run:      run(0),
+				expected: "run 0\nrun 0 crashed\n",
+			},
+			{
+				name:     "latest run",
+				run:      run(-1),
+				expected: "run 2\n",
+			},
+			{
+				name:     "previous run",
+				run:      run(-2),
+				expected: "run 1\n",
+			},
+		}
+
+		for _, tc := range testCases {
+			for _, source := range []string{"docker", "storage"} {
+				t.Run(tc.name+" from "+source, func(t *testing.T) {
+					streamer := &fakeContainerLogStreamer{containers: map[string][]log.Record{}}
+					storage := &fakeStorageReader{
+						containers: map[string][]log.Record{"test-container": runLogs},
+						runs:       map[string][]log.Run{"test-container": runs},
+					}
+					if source == "docker" {
+						streamer.containers["test-container"] = runLogs
+					}
+					service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+					rc, err := service.GetContainerLogs(context.Background(), log.Query{
+						ContainerName: "test-container",
+						IncludeStderr: true,
+						Run:           tc.run,
+					})
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					defer rc.Close()
+
+					got, err := io.ReadAll(rc)
+					if err != nil {
+						t.Fatalf("failed to read logs: %v", err)
+					}
+
+					if string(got) != tc.expected {
+						t.Errorf("expected %q, got %q", tc.expected, string(got))
+					}
+				})
+			}
+		}
+
+		t.Run("unknown run", func(t *testing.T) {
+			storage := &fakeStorageReader{
+				containers: map[string][]log.Record{"test-container": runLogs},
+				runs:       map[string][]log.Run{"test-container": runs},
+			}
+			service := log.NewService(
+				&fakeContainerLogStreamer{},
+				storage,
+				logger,
+				log.ServiceOptions{},
+			)
+
+			_, err := service.GetContainerLogs(context.Background(), log.Query{
+				ContainerName: "test-container",
+				IncludeStderr: true,
+				Run:           run(3),
+			})
+
+			var runNotFoundErr *log.RunNotFoundError
+			if !errors.As(err, &runNotFoundErr) {
+				t.Fatalf("expected *log.RunNotFoundError, got %v", err)
+			}
+		})
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		dockerLogs := []log.Record{{Timestamp: testTime, Stream: "stdout", Log: "from docker\n"}}
+		storedLogs := []log.Record{{Timestamp: testTime, Stream: "stdout", Log: "stored\n"}}
+		streamer := &fakeContainerLogStreamer{
+			containers: map[string][]log.Record{"web": dockerLogs},
+		}
+
+		t.Run("reads the stored logs of a collected container", func(t *testing.T) {
+			live, collect := io.Pipe()
+			storage := &fakeStorageReader{
+				containers: map[string][]log.Record{"web": storedLogs},
+				live:       map[string]io.ReadCloser{"web": live},
+			}
+			service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+			rc, err := service.GetContainerLogs(context.Background(), log.Query{
+				ContainerName: "web",
+				IncludeStdout: true,
+				Follow:        true,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			go func() {
+				rec := log.Record{Timestamp: testTime, Stream: "stdout", Log: "collected\n"}
+				_ = json.NewEncoder(collect).Encode(rec)
+				// The stored logs are followed until the collection stops.
+				collect.Close()
+			}()
+
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if want := "stored\ncollected\n"; string(data) != want {
+				t.Errorf("expected %q, got %q", want, string(data))
+			}
+		})
+
+		t.Run("follows the stored logs after the context of the matches", func(t *testing.T) {
+			live, collect := io.Pipe()
+			storage := &fakeStorageReader{
+				containers: map[string][]log.Record{"web": {
+					{Timestamp: testTime, Stream: "stdout", Log: "request 1\n"},
+					{Timestamp: testTime, Stream: "stdout", Log: "ERROR: request 1 failed\n"},
+					{Timestamp: testTime, Stream: "stdout", Log: "request 2\n"},
+				}},
+				live: map[string]io.ReadCloser{"web": live},
+			}
+			service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+			rc, err := service.GetContainerLogs(context.Background(), log.Query{
+				ContainerName: "web",
+				IncludeStdout: true,
+				Follow:        true,
+				Grep:          "ERROR",
+				Context:       1,
+				Tail:          ptr(2),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			go func() {
+				// The collected record shares the timestamp of the stored ones.
+				rec := log.Record{
+					Timestamp: testTime,
+					Stream:    "stdout",
+					Log:       "ERROR: request 3 failed\n",
+				}
+				_ = json.NewEncoder(collect).Encode(rec)
+				collect.Close()
+			}()
+
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			want := "ERROR: request 1 failed\nrequest 2\nERROR: request 3 failed\n"
+			if string(data) != want {
+				t.Errorf("expected %q, got %q", want, string(data))
+			}
+		})
+
+		t.Run("receives the collected records from the hub", func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				stored := &fakeStoredLogReader{}
+				caughtUp := log.Record{Timestamp: testTime, Stream: "stdout", Log: "caught up\n"}
+				caughtUpPos := stored.store(caughtUp)
+				storage := &fakeStorageReader{
+					containers: map[string][]log.Record{"web": storedLogs},
+					stored:     map[string]*fakeStoredLogReader{"web": stored},
+				}
+				hub := log.NewHub(log.HubOptions{})
+				service := log.NewService(streamer, storage, logger, log.ServiceOptions{Hub: hub})
+
+				rc, err := service.GetContainerLogs(context.Background(), log.Query{
+					ContainerName: "web",
+					IncludeStdout: true,
+					Follow:        true,
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer rc.Close()
+				data := readAllAsync(rc)
+
+				// Wait for the stored records to be read.
+				synctest.Wait()
+
+				container := log.Container{ID: "abc123", Name: "web"}
+				// The records read from the storage are skipped.
+				hub.Publish(container, caughtUp, caughtUpPos)
+				collected := log.Record{
+					Timestamp: testTime.Add(time.Second),
+					Stream:    "stdout",
+					Log:       "collected\n",
+				}
+				hub.Publish(container, collected, stored.store(collected))
+				// The collection stops.
+				hub.EndSubscriptions(container)
+
+				want := "stored\ncaught up\ncollected\n"
+				if got := <-data; got != want {
+					t.Errorf("expected %q, got %q", want, got)
+				}
+			})
+		})
+
+		t.Run("reads the storage when the hub overflows while catching up", func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				container := log.Container{ID: "abc123", Name: "web"}
+				hub := log.NewHub(log.HubOptions{BufferSize: 1})
+				collect := func(stored *fakeStoredLogReader, i int) {
+					rec := log.Record{
+						Timestamp: testTime.Add(time.Duration(i) * time.Second),
+						Stream:    "stdout",
+						Log:       fmt.Sprintf("collected %d\n", i),
+					}
+					hub.Publish(container, rec, stored.store(rec))
+				}
+
+				stored := &fakeStoredLogReader{}
+				var eofs int
+				stored.onEOF = func() {
+					eofs++
+					// Collect more records than the subscription holds once subscribed.
+					if eofs == 2 {
+						collect(stored, 1)
+						collect(stored, 2)
+					}
+				}
+				storage := &fakeStorageReader{
+					containers: map[string][]log.Record{"web": storedLogs},
+					stored:     map[string]*fakeStoredLogReader{"web": stored},
+				}
+				service := log.NewService(streamer, storage, logger, log.ServiceOptions{Hub: hub})
+
+				rc, err := service.GetContainerLogs(context.Background(), log.Query{
+					ContainerName: "web",
+					IncludeStdout: true,
+					Follow:        true,
+				})
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				defer rc.Close()
+				data := readAllAsync(rc)
+
+				synctest.Wait()
+				collect(stored, 3)
+				hub.EndSubscriptions(container)
+
+				want := "stored\ncollected 1\ncollected 2\ncollected 3\n"
+				if got := <-data; got != want {
+					t.Errorf("expected %q, got %q", want, got)
+				}
+			})
+		})
+
+		for _, closeAt := range []int{1, 2} {
+			name := fmt.Sprintf("stops catching up once closed at end of storage %d", closeAt)
+			t.Run(name, func(t *testing.T) {
+				synctest.Test(t, func(t *testing.T) {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+
+					stored := &fakeStoredLogReader{}
+					var eofs int
+					stored.onEOF = func() {
+						eofs++
+						// The client disconnects while the stored logs are read,
+						// before and after subscribing to the hub.
+						if eofs == closeAt {
+							cancel()
+							synctest.Wait()
+						}
+					}
+					storage := &fakeStorageReader{
+						containers: map[string][]log.Record{"web": storedLogs},
+						stored:     map[string]*fakeStoredLogReader{"web": stored},
+					}
+					hub := log.NewHub(log.HubOptions{})
+					service := log.NewService(streamer, storage, logger, log.ServiceOptions{
+						Hub: hub,
+					})
+
+					rc, err := service.GetContainerLogs(ctx, log.Query{
+						ContainerName: "web",
+						IncludeStdout: true,
+						Follow:        true,
+					})
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					defer rc.Close()
+
+					if want, got := "stored\n", <-readAllAsync(rc); got != want {
+						t.Errorf("expected %q, got %q", want, got)
+					}
+				})
+			})
+		}
+
+		t.Run("reads the stored logs of a stopped container", func(t *testing.T) {
+			storage := &fakeStorageReader{
+				containers: map[string][]log.Record{"web": storedLogs},
+			}
+			watcher := newFakeContainerWatcher()
+			watcher.states = []log.Container{{ID: "abc123", Name: "web", State: "exited"}}
+			service := log.NewService(streamer, storage, logger, log.ServiceOptions{
+				Watcher: watcher,
+			})
+
+			rc, err := service.GetContainerLogs(context.Background(), log.Query{
+				ContainerName: "web",
+				IncludeStdout: true,
+				Follow:        true,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if want := "stored\n"; string(data) != want {
+				t.Errorf("expected %q, got %q", want, string(data))
+			}
+		})
+
+		t.Run("streams the logs of other containers from Docker", func(t *testing.T) {
+			storage := &fakeStorageReader{
+				containers: map[string][]log.Record{"web": storedLogs},
+			}
+			service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
+
+			rc, err := service.GetContainerLogs(context.Background(), log.Query{
+				ContainerName: "web",
+				IncludeStdout: true,
+				Follow:        true,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if want := "from docker\n"; string(data) != want {
+				t.Errorf("expected %q, got %q", want, string(data))
+			}
+		})
+	})
+
 	t.Run("container does not exist", func(t *testing.T) {
 		streamer := &fakeContainerLogStreamer{
 			containers: map[string][]log.Record{},
@@ -162,7 +936,7 @@ func TestService_GetContainerLogs(t *testing.T) {
 			containers: map[string][]log.Record{},
 		}
 
-		service := log.NewService(streamer, storage, logger)
+		service := log.NewService(streamer, storage, logger, log.ServiceOptions{})
 
 		_, err := service.GetContainerLogs(context.Background(), log.Query{
 			ContainerName: "nonexistent-container",
@@ -203,6 +977,11 @@ func (f *fakeContainerLogStreamer) StreamContainerLogs(
 		}
 	}
 
+	// Like Docker, the tail is applied before filtering the logs.
+	if query.Tail != nil && len(logs) > *query.Tail {
+		logs = logs[len(logs)-*query.Tail:]
+	}
+
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
 	for _, rec := range logs {
@@ -215,13 +994,31 @@ func (f *fakeContainerLogStreamer) StreamContainerLogs(
 
 type fakeStorageReader struct {
 	containers map[string][]log.Record
+	runs       map[string][]log.Run
+	// live are the records collected after the stored ones, read when following.
+	live map[string]io.ReadCloser
+	// stored are the records stored after the stored ones, read after the history.
+	stored map[string]*fakeStoredLogReader
+}
+
+func (f *fakeStorageReader) IsCollecting(query log.Query) bool {
+	_, ok := f.live[query.ContainerName]
+	_, stored := f.stored[query.ContainerName]
+	return ok || stored
+}
+
+func (f *fakeStorageReader) ListRuns(containerNameOrID string) ([]log.Run, error) {
+	if _, exists := f.containers[containerNameOrID]; !exists {
+		return nil, &log.ContainerNotFoundError{Name: containerNameOrID}
+	}
+	return f.runs[containerNameOrID], nil
 }
 
-func (f *fakeStorageReader) Open(containerName string) (io.ReadCloser, error) {
-	logs, exists := f.containers[containerName]
+func (f *fakeStorageReader) Open(query log.Query) (io.ReadCloser, error) {
+	logs, exists := f.containers[query.ContainerName]
 	if !exists {
 		return nil, &log.ContainerNotFoundError{
-			Name: containerName,
+			Name: query.ContainerName,
 		}
 	}
 
@@ -232,5 +1029,100 @@ func (f *fakeStorageReader) Open(containerName string) (io.ReadCloser, error) {
 			return nil, err
 		}
 	}
+	if live, ok := f.live[query.ContainerName]; ok && query.Follow {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, live), live}, nil
+	}
 	return io.NopCloser(&buf), nil
 }
+
+func (f *fakeStorageReader) OpenHistory(
+	query log.Query,
+) (io.ReadCloser, log.StoredLogReader, error) {
+	historyQuery := query
+	historyQuery.Follow = false
+	history, err := f.Open(historyQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	if live, ok := f.live[query.ContainerName]; ok && query.Follow {
+		return history, fakeLiveLogReader{live}, nil
+	}
+	stored, ok := f.stored[query.ContainerName]
+	if !ok {
+		stored = &fakeStoredLogReader{}
+	}
+	return history, stored, nil
+}
+
+// fakeLiveLogReader reads the records collected after the stored ones.
+type fakeLiveLogReader struct {
+	io.ReadCloser
+}
+
+func (f fakeLiveLogReader) Position() log.Position {
+	return log.Position{}
+}
+
+// fakeStoredLogReader reads the records stored after the history, returning io.EOF
+// once it read them all.
+type fakeStoredLogReader struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	read int64
+	// onEOF is called each time all the stored records are read, before returning io.EOF.
+	onEOF func()
+}
+
+// store appends the record and returns the position following it.
+func (f *fakeStoredLogReader) store(rec log.Record) log.Position {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_ = json.NewEncoder(&f.buf).Encode(rec)
+	return log.Position{Segment: 1, Offset: f.read + int64(f.buf.Len())}
+}
+
+func (f *fakeStoredLogReader) Read(p []byte) (int, error) {
+	if f.onEOF != nil && f.len() == 0 {
+		f.onEOF()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.buf.Read(p)
+	f.read += int64(n)
+	return n, err
+}
+
+func (f *fakeStoredLogReader) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buf.Len()
+}
+
+func (f *fakeStoredLogReader) Position() log.Position {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return log.Position{Segment: 1, Offset: f.read}
+}
+
+func (f *fakeStoredLogReader) Close() error {
+	return nil
+}
+
+// ptr returns a pointer to v.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// readAllAsync reads r entirely in the background, sending what it read once done.
+func readAllAsync(r io.Reader) <-chan string {
+	data := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(r)
+		data <- string(b)
+	}()
+	return data
+}
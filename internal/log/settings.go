@@ -0,0 +1,204 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LabelPrefix is the prefix of the container labels configuring the collection of their logs.
+const LabelPrefix = "logproxy."
+
+// Labels configuring the collection of the container logs.
+const (
+	// LabelEnable set to false disables the collection of the container logs.
+	LabelEnable = LabelPrefix + "enable"
+	// LabelRetention is the duration for which the container logs are kept (e.g. "7d").
+	LabelRetention = LabelPrefix + "retention"
+	// LabelStream restricts the collection to a single stream (stdout or stderr).
+	LabelStream = LabelPrefix + "stream"
+	// LabelMultilinePattern is a regular expression matching the first line of
+	// multiline records (e.g. a Java stack trace). It is an alias of [LabelMultilineStart].
+	LabelMultilinePattern = LabelPrefix + "multiline.pattern"
+	// LabelMultilineStart is a regular expression matching the first line of multiline records.
+	LabelMultilineStart = LabelPrefix + "multiline.start"
+	// LabelMultilineContinuation is a regular expression matching the lines appended
+	// to multiline records.
+	LabelMultilineContinuation = LabelPrefix + "multiline.continuation"
+	// LabelMultilinePreset joins the stack traces of a language: java, python or go.
+	// The patterns set by the other labels take precedence.
+	LabelMultilinePreset = LabelPrefix + "multiline.preset"
+	// LabelMultilineMaxLines is the maximum number of lines joined into a record.
+	LabelMultilineMaxLines = LabelPrefix + "multiline.max-lines"
+	// LabelMultilineFlushTimeout is the time after which a multiline record is written
+	// if no other line was appended to it (e.g. "500ms").
+	LabelMultilineFlushTimeout = LabelPrefix + "multiline.flush-timeout"
+	// LabelRedact is a regular expression matching the secrets to redact from the logs.
+	LabelRedact = LabelPrefix + "redact"
+	// LabelParseFields is the format of the structured logs whose fields are extracted:
+	// none, auto, json or logfmt.
+	LabelParseFields = LabelPrefix + "parse-fields"
+)
+
+// RedactedText replaces the text redacted from the logs.
+const RedactedText = "[REDACTED]"
+
+// ContainerSettings configure the collection of a container's logs.
+// They are set by the container labels prefixed with [LabelPrefix].
+type ContainerSettings struct {
+	// Disabled indicates whether the collection of the container logs is disabled.
+	Disabled bool
+
+	// Retention, if positive, is the duration for which the container logs are kept.
+	Retention time.Duration
+
+	// Stream, if not empty, is the only stream collected.
+	Stream StreamType
+
+	// Multiline configures how the lines of multiline records are joined. If it does not
+	// set any pattern, the default configuration of the collector applies.
+	Multiline MultilineConfig
+
+	// Redact, if not nil, matches the text to redact from the logs.
+	Redact *regexp.Regexp
+
+	// ParseFields, if not empty, is the format of the structured logs whose fields are
+	// extracted. Otherwise the default format of the collector applies.
+	ParseFields FieldsFormat
+}
+
+// ParseContainerSettings reads the settings from the container labels.
+//
+// Invalid or unknown labels are ignored and reported in the returned error
+// while the settings set by the other labels are still returned.
+func ParseContainerSettings(labels map[string]string) (ContainerSettings, error) {
+	var (
+		settings ContainerSettings
+		errs     []error
+	)
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		if !strings.HasPrefix(key, LabelPrefix) {
+			continue
+		}
+
+		if err := settings.set(key, labels[key]); err != nil {
+			errs = append(errs, fmt.Errorf("label %s: %w", key, err))
+		}
+	}
+	return settings, errors.Join(errs...)
+}
+
+func (s *ContainerSettings) set(key, value string) error {
+	switch key {
+	case LabelEnable:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		s.Disabled = !enabled
+
+	case LabelRetention:
+		d, err := ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("%q is not a positive duration", value)
+		}
+		s.Retention = d
+
+	case LabelStream:
+		switch stream := StreamType(value); stream {
+		case StreamTypeStdout, StreamTypeStderr:
+			s.Stream = stream
+		default:
+			return fmt.Errorf("%q is neither stdout nor stderr", value)
+		}
+
+	case LabelMultilinePattern, LabelMultilineStart:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		s.Multiline.Start = re
+
+	case LabelMultilineContinuation:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		s.Multiline.Continuation = re
+
+	case LabelMultilinePreset:
+		preset, err := MultilinePreset(value)
+		if err != nil {
+			return err
+		}
+		s.Multiline.ApplyPreset(preset)
+
+	case LabelMultilineMaxLines:
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%q is not a positive integer", value)
+		}
+		s.Multiline.MaxLines = n
+
+	case LabelMultilineFlushTimeout:
+		d, err := ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("%q is not a positive duration", value)
+		}
+		s.Multiline.FlushTimeout = d
+
+	case LabelRedact:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		s.Redact = re
+
+	case LabelParseFields:
+		format, err := ParseFieldsFormat(value)
+		if err != nil {
+			return err
+		}
+		s.ParseFields = format
+
+	default:
+		return errors.New("unknown label")
+	}
+
+	return nil
+}
+
+// IncludesStream reports whether the logs of the stream are collected.
+func (s ContainerSettings) IncludesStream(stream StreamType) bool {
+	return s.Stream == "" || s.Stream == stream
+}
+
+// ParseDuration parses a duration such as "90m" or "7d".
+// In addition to the units accepted by [time.ParseDuration], it accepts
+// days ("d") as a whole number of days.
+func ParseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
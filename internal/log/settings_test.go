@@ -0,0 +1,199 @@
+package log_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestParseContainerSettings(t *testing.T) {
+	t.Run("reads the logproxy labels", func(t *testing.T) {
+		settings, err := log.ParseContainerSettings(map[string]string{
+			"com.docker.compose.project": "shop",
+			"logproxy.enable":            "false",
+			"logproxy.retention":         "7d",
+			"logproxy.stream":            "stderr",
+			"logproxy.multiline.pattern": `^\S`,
+			"logproxy.redact":            `password=\S+`,
+			"logproxy.parse-fields":      "logfmt",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !settings.Disabled {
+			t.Error("expected collection to be disabled")
+		}
+		if want := 7 * 24 * time.Hour; settings.Retention != want {
+			t.Errorf("expected retention %v, got %v", want, settings.Retention)
+		}
+		if settings.Stream != log.StreamTypeStderr {
+			t.Errorf("expected stream %q, got %q", log.StreamTypeStderr, settings.Stream)
+		}
+		if start := settings.Multiline.Start; start == nil || start.String() != `^\S` {
+			t.Errorf("expected multiline start pattern %q, got %v", `^\S`, start)
+		}
+		if settings.Redact == nil || settings.Redact.String() != `password=\S+` {
+			t.Errorf("expected redact pattern %q, got %v", `password=\S+`, settings.Redact)
+		}
+		if settings.ParseFields != log.FieldsFormatLogfmt {
+			t.Errorf(
+				"expected fields format %q, got %q",
+				log.FieldsFormatLogfmt,
+				settings.ParseFields,
+			)
+		}
+	})
+
+	t.Run("defaults without labels", func(t *testing.T) {
+		settings, err := log.ParseContainerSettings(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if settings.Disabled || settings.Retention != 0 || settings.Stream != "" ||
+			settings.Multiline.Enabled() || settings.Redact != nil {
+			t.Errorf("expected default settings, got %+v", settings)
+		}
+		for _, stream := range []log.StreamType{log.StreamTypeStdout, log.StreamTypeStderr} {
+			if !settings.IncludesStream(stream) {
+				t.Errorf("expected %s to be collected", stream)
+			}
+		}
+	})
+
+	t.Run("ignores invalid labels", func(t *testing.T) {
+		settings, err := log.ParseContainerSettings(map[string]string{
+			"logproxy.enable":            "nope",
+			"logproxy.retention":         "-1h",
+			"logproxy.stream":            "stdin",
+			"logproxy.redact":            "(",
+			"logproxy.parse-fields":      "xml",
+			"logproxy.unknown":           "value",
+			"logproxy.multiline.pattern": `^\S`,
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+
+		for _, label := range []string{
+			"logproxy.enable",
+			"logproxy.retention",
+			"logproxy.stream",
+			"logproxy.redact",
+			"logproxy.parse-fields",
+			"logproxy.unknown",
+		} {
+			if !strings.Contains(err.Error(), label) {
+				t.Errorf("expected error to report %s, got %q", label, err)
+			}
+		}
+
+		if settings.Disabled || settings.Retention != 0 || settings.Stream != "" ||
+			settings.Redact != nil || settings.ParseFields != "" {
+			t.Errorf("expected invalid labels to be ignored, got %+v", settings)
+		}
+		if settings.Multiline.Start == nil {
+			t.Error("expected valid labels to be applied")
+		}
+	})
+
+	t.Run("reads the multiline labels", func(t *testing.T) {
+		settings, err := log.ParseContainerSettings(map[string]string{
+			"logproxy.multiline.preset":        "python",
+			"logproxy.multiline.start":         `^ERROR`,
+			"logproxy.multiline.max-lines":     "50",
+			"logproxy.multiline.flush-timeout": "500ms",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		preset, err := log.MultilinePreset("python")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if start := settings.Multiline.Start; start == nil || start.String() != `^ERROR` {
+			t.Errorf("expected multiline start pattern %q, got %v", `^ERROR`, start)
+		}
+		if got := settings.Multiline.Continuation; got != preset.Continuation {
+			t.Errorf("expected the continuation pattern of the preset, got %v", got)
+		}
+		if settings.Multiline.MaxLines != 50 {
+			t.Errorf("expected max lines %d, got %d", 50, settings.Multiline.MaxLines)
+		}
+		if want := 500 * time.Millisecond; settings.Multiline.FlushTimeout != want {
+			t.Errorf("expected flush timeout %v, got %v", want, settings.Multiline.FlushTimeout)
+		}
+	})
+
+	t.Run("ignores invalid multiline labels", func(t *testing.T) {
+		labels := map[string]string{
+			"logproxy.multiline.start":         "(",
+			"logproxy.multiline.continuation":  "(",
+			"logproxy.multiline.preset":        "cobol",
+			"logproxy.multiline.max-lines":     "0",
+			"logproxy.multiline.flush-timeout": "-1s",
+		}
+		settings, err := log.ParseContainerSettings(labels)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+
+		for label := range labels {
+			if !strings.Contains(err.Error(), label) {
+				t.Errorf("expected error to report %s, got %q", label, err)
+			}
+		}
+		if settings.Multiline != (log.MultilineConfig{}) {
+			t.Errorf("expected invalid labels to be ignored, got %+v", settings.Multiline)
+		}
+	})
+}
+
+func TestMultilinePreset(t *testing.T) {
+	for _, name := range []string{"java", "python", "go"} {
+		preset, err := log.MultilinePreset(name)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", name, err)
+		}
+		if !preset.Enabled() {
+			t.Errorf("expected preset %q to set a pattern", name)
+		}
+	}
+
+	if _, err := log.MultilinePreset("cobol"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "90m", expected: 90 * time.Minute},
+		{value: "1h30m", expected: 90 * time.Minute},
+		{value: "7d", expected: 7 * 24 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := log.ParseDuration(tc.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	for _, value := range []string{"", "d", "1.5d", "week"} {
+		if _, err := log.ParseDuration(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
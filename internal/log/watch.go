@@ -0,0 +1,326 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// watchContainerLogs returns the logs of the container, waiting for it to start if it
+// does not exist yet and, if persisting, following its next runs once it stops.
+func (s *Service) watchContainerLogs(ctx context.Context, query Query) (io.ReadCloser, error) {
+	if s.options.Watcher == nil {
+		return nil, errors.New("waiting for containers is not supported")
+	}
+	if query.Persist {
+		query.Follow = true
+	}
+
+	var notFoundErr *ContainerNotFoundError
+	current, err := s.options.Watcher.InspectContainer(ctx, query.ContainerName)
+	if err != nil && !errors.As(err, &notFoundErr) {
+		return nil, fmt.Errorf("inspect container: %w", err)
+	}
+
+	sources, err := s.openContainerLogs(ctx, query)
+	if errors.As(err, &notFoundErr) && query.Wait {
+		// The logs are read once the container starts.
+		sources = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer cancel()
+
+		enc := newRecordEncoder(pw, query.Format)
+		err := s.writeRuns(ctx, enc, query, current, sources)
+		if err == nil {
+			err = enc.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	// Stop waiting for the container as soon as the stream is closed.
+	return &cancelReadCloser{ReadCloser: pr, cancel: cancel}, nil
+}
+
+// writeRuns encodes the logs of the successive runs of the container, starting with the
+// given sources if the container exists. It waits for the container to start otherwise,
+// and for its next run once it stops if persisting, separating the runs by lifecycle records.
+// The lifecycle records are filtered by the query like the logs.
+func (s *Service) writeRuns(
+	ctx context.Context,
+	enc recordEncoder,
+	query Query,
+	current Container,
+	sources []logSource,
+) error {
+	var (
+		runQuery = query
+		bo       = newReconnectBackoff()
+		last     time.Time
+	)
+	for {
+		if sources != nil {
+			lastRead, err := copyRecords(ctx, enc, sources, newRecordFilter(runQuery))
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !query.Persist {
+				return nil
+			}
+			if lastRead.After(last) {
+				last = lastRead
+				bo.reset()
+			}
+
+			stopped, err := s.writeStopRecord(ctx, enc, query, current)
+			if err != nil {
+				return err
+			}
+			if !stopped {
+				// The log stream was interrupted while the container is still running.
+				if !sleep(ctx, bo.next()) {
+					return nil
+				}
+				runQuery = nextRunQuery(query, last)
+				sources, err = s.openNextRun(ctx, runQuery)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		next, err := s.waitContainerStart(ctx, query.ContainerName, current.StartedAt)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		current = next
+
+		if query.Persist {
+			startedAt := current.StartedAt
+			if startedAt.IsZero() {
+				startedAt = time.Now()
+			}
+			err := encodeLifecycleRecord(enc, query, lifecycleRecord(
+				startedAt,
+				"container %s started (%s)",
+				query.ContainerName,
+				shortID(current.ID),
+			))
+			if err != nil {
+				return err
+			}
+		}
+
+		runQuery = nextRunQuery(query, last)
+		sources, err = s.openNextRun(ctx, runQuery)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextRunQuery returns the query selecting the logs following the last record read, if any.
+// The tail only applies to the first run.
+func nextRunQuery(query Query, last time.Time) Query {
+	if !last.IsZero() {
+		query.Tail = nil
+		if since := last.Add(time.Nanosecond); since.After(query.Since) {
+			query.Since = since
+		}
+	}
+	return query
+}
+
+// openNextRun opens the logs of the next run of the container, or returns nil if the
+// container was removed meanwhile.
+func (s *Service) openNextRun(ctx context.Context, query Query) ([]logSource, error) {
+	sources, err := s.openContainerLogs(ctx, query)
+	var notFoundErr *ContainerNotFoundError
+	if errors.As(err, &notFoundErr) {
+		// The container was removed meanwhile, wait for the next one.
+		return nil, nil
+	}
+	return sources, err
+}
+
+// writeStopRecord encodes a lifecycle record reporting that the container stopped or was
+// removed, if included by the query. It returns false if the container is still running.
+func (s *Service) writeStopRecord(
+	ctx context.Context,
+	enc recordEncoder,
+	query Query,
+	current Container,
+) (bool, error) {
+	containerName := query.ContainerName
+	nameOrID := current.ID
+	if nameOrID == "" {
+		nameOrID = containerName
+	}
+
+	var rec Record
+	ctr, err := s.options.Watcher.InspectContainer(ctx, nameOrID)
+	var notFoundErr *ContainerNotFoundError
+	switch {
+	case errors.As(err, &notFoundErr):
+		rec = lifecycleRecord(time.Now(), "container %s removed", containerName)
+
+	case err != nil:
+		return false, fmt.Errorf("inspect container: %w", err)
+
+	case ctr.State == "running" && ctr.StartedAt.Equal(current.StartedAt):
+		return false, nil
+
+	default:
+		finishedAt := ctr.FinishedAt
+		if finishedAt.IsZero() || ctr.State == "running" {
+			// The container was restarted meanwhile.
+			finishedAt = time.Now()
+		}
+		rec = lifecycleRecord(
+			finishedAt,
+			"container %s exited with code %d",
+			containerName,
+			ctr.ExitCode,
+		)
+	}
+
+	return true, encodeLifecycleRecord(enc, query, rec)
+}
+
+// waitContainerStart waits for the container to be running in a run started after the
+// given time, and returns it.
+func (s *Service) waitContainerStart(
+	ctx context.Context,
+	containerNameOrID string,
+	after time.Time,
+) (Container, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Watch the starts before inspecting the container so that a start in between is not missed.
+	starts, errs := s.watchContainerStarts(ctx, containerNameOrID)
+
+	ctr, err := s.options.Watcher.InspectContainer(ctx, containerNameOrID)
+	var notFoundErr *ContainerNotFoundError
+	if err == nil && ctr.State == "running" && ctr.StartedAt.After(after) {
+		return ctr, nil
+	} else if err != nil && !errors.As(err, &notFoundErr) {
+		return Container{}, fmt.Errorf("inspect container: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return Container{}, ctx.Err()
+
+		case ctr, ok := <-starts:
+			if !ok {
+				return Container{}, errors.New("events stream closed")
+			}
+			// The hub also notifies the containers found running after the events
+			// stream was interrupted, which may be the run which already stopped.
+			if ctr.StartedAt.IsZero() || ctr.StartedAt.After(after) {
+				return ctr, nil
+			}
+
+		case err, ok := <-errs:
+			if !ok {
+				return Container{}, errors.New("events stream closed")
+			}
+			return Container{}, fmt.Errorf("watch containers: %w", err)
+		}
+	}
+}
+
+// watchContainerStarts returns a channel receiving the container with the given name
+// or ID each time it starts, until the context is canceled. The starts are received
+// from the hub if set, and from the Docker events otherwise.
+func (s *Service) watchContainerStarts(
+	ctx context.Context,
+	containerNameOrID string,
+) (<-chan Container, <-chan error) {
+	if s.options.Hub != nil {
+		// The collector publishes the starts, reconnecting its events stream if interrupted.
+		return s.options.Hub.SubscribeStarts(ctx, containerNameOrID), nil
+	}
+
+	events, errs := s.options.Watcher.WatchContainers(ctx, time.Time{})
+	starts := make(chan Container)
+	go func() {
+		defer close(starts)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				ctr := event.Container
+				if event.Type != EventTypeStarted ||
+					(ctr.Name != containerNameOrID && ctr.ID != containerNameOrID) {
+					continue
+				}
+				select {
+				case starts <- ctr:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return starts, errs
+}
+
+// lifecycleRecord returns a record reporting a change in the lifecycle of a container,
+// inserted between the logs of its runs.
+func lifecycleRecord(ts time.Time, format string, args ...any) Record {
+	return Record{
+		Timestamp: ts,
+		Stream:    StreamTypeStderr,
+		Log:       fmt.Sprintf("[docker-logproxy: "+format+"]\n", args...),
+	}
+}
+
+// encodeLifecycleRecord encodes the lifecycle record if it is included by the query,
+// e.g. not if the query excludes stderr or only includes the logs matching a pattern.
+func encodeLifecycleRecord(enc recordEncoder, query Query, rec Record) error {
+	if !query.Includes(rec) {
+		return nil
+	}
+	return enc.Encode(rec)
+}
+
+// shortID returns the short form of a container ID, as displayed by Docker.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// cancelReadCloser cancels a context when closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (rc *cancelReadCloser) Close() error {
+	rc.cancel()
+	return rc.ReadCloser.Close()
+}
@@ -0,0 +1,263 @@
+package log_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/log"
+)
+
+func TestService_WatchContainerLogs(t *testing.T) {
+	testTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	logger := slog.New(slog.DiscardHandler)
+
+	t.Run("waits for the container to start", func(t *testing.T) {
+		streamer := &fakeRunStreamer{}
+		watcher := newFakeContainerWatcher()
+		service := log.NewService(streamer, &fakeStorageReader{}, logger, log.ServiceOptions{
+			Watcher: watcher,
+		})
+
+		rc, err := service.GetContainerLogs(context.Background(), log.Query{
+			ContainerName: "web",
+			IncludeStdout: true,
+			Wait:          true,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer rc.Close()
+
+		streamer.addRun(log.Record{Timestamp: testTime, Stream: "stdout", Log: "hello\n"})
+		watcher.events <- log.ContainerEvent{
+			Type:      log.EventTypeStarted,
+			Container: log.Container{ID: "abc123", Name: "web", State: "running"},
+		}
+
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		if want := "hello\n"; string(data) != want {
+			t.Errorf("expected %q, got %q", want, string(data))
+		}
+	})
+
+	t.Run("waits for the container to start through the hub", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			streamer := &fakeRunStreamer{}
+			// The Docker events are only watched by the collector.
+			watcher := &fakeContainerWatcher{}
+			hub := log.NewHub(log.HubOptions{})
+			service := log.NewService(streamer, &fakeStorageReader{}, logger, log.ServiceOptions{
+				Hub:     hub,
+				Watcher: watcher,
+			})
+
+			rc, err := service.GetContainerLogs(context.Background(), log.Query{
+				ContainerName: "web",
+				IncludeStdout: true,
+				Wait:          true,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			// Wait for the client to subscribe to the starts of the container.
+			synctest.Wait()
+			streamer.addRun(log.Record{Timestamp: testTime, Stream: "stdout", Log: "hello\n"})
+			hub.PublishStart(log.Container{ID: "abc123", Name: "web", State: "running"})
+
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read logs: %v", err)
+			}
+			if want := "hello\n"; string(data) != want {
+				t.Errorf("expected %q, got %q", want, string(data))
+			}
+			if watcher.isWatched() {
+				t.Error("expected the Docker events not to be watched")
+			}
+		})
+	})
+
+	testCases := []struct {
+		name          string
+		includeStderr bool
+		want          []string
+	}{
+		{
+			name:          "keeps following the logs across runs",
+			includeStderr: true,
+			want: []string{
+				"first run",
+				"[docker-logproxy: container web exited with code 1]",
+				"[docker-logproxy: container web started (def4567890ab)]",
+				"second run",
+			},
+		},
+		{
+			// The lifecycle records are written to stderr.
+			name: "filters the lifecycle records like the logs",
+			want: []string{"first run", "second run"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			streamer := &fakeRunStreamer{}
+			streamer.addRun(log.Record{Timestamp: testTime, Stream: "stdout", Log: "first run\n"})
+			watcher := newFakeContainerWatcher()
+			watcher.states = []log.Container{
+				{ID: "abc123", Name: "web", State: "running", StartedAt: testTime},
+				{
+					ID:         "abc123",
+					Name:       "web",
+					State:      "exited",
+					StartedAt:  testTime,
+					FinishedAt: testTime.Add(time.Second),
+					ExitCode:   1,
+				},
+			}
+			service := log.NewService(streamer, &fakeStorageReader{}, logger, log.ServiceOptions{
+				Watcher: watcher,
+			})
+
+			rc, err := service.GetContainerLogs(context.Background(), log.Query{
+				ContainerName: "web",
+				IncludeStdout: true,
+				IncludeStderr: tc.includeStderr,
+				Persist:       true,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer rc.Close()
+
+			// The container is re-created under the same name.
+			streamer.addRun(
+				log.Record{Timestamp: testTime, Stream: "stdout", Log: "first run\n"},
+				log.Record{
+					Timestamp: testTime.Add(time.Minute),
+					Stream:    "stdout",
+					Log:       "second run\n",
+				},
+			)
+			go func() {
+				watcher.events <- log.ContainerEvent{
+					Type: log.EventTypeStarted,
+					Container: log.Container{
+						ID:        "def4567890abcdef",
+						Name:      "web",
+						State:     "running",
+						StartedAt: testTime.Add(time.Minute),
+					},
+				}
+			}()
+
+			scanner := bufio.NewScanner(rc)
+			for _, line := range tc.want {
+				if !scanner.Scan() {
+					t.Fatalf("failed to read logs: %v", scanner.Err())
+				}
+				if got := scanner.Text(); got != line {
+					t.Errorf("expected %q, got %q", line, got)
+				}
+			}
+		})
+	}
+}
+
+// fakeRunStreamer returns the logs of the next run of the container on each call,
+// the last one being repeated.
+type fakeRunStreamer struct {
+	mu    sync.Mutex
+	runs  [][]log.Record
+	calls int
+}
+
+func (f *fakeRunStreamer) addRun(logs ...log.Record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs = append(f.runs, logs)
+}
+
+func (f *fakeRunStreamer) StreamContainerLogs(
+	ctx context.Context,
+	query log.Query,
+) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.runs) == 0 {
+		return nil, &log.ContainerNotFoundError{Name: query.ContainerName}
+	}
+	logs := f.runs[min(f.calls, len(f.runs)-1)]
+	f.calls++
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range logs {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// fakeContainerWatcher returns the successive states of the container when inspected,
+// the last one being repeated, and the events sent by the test.
+type fakeContainerWatcher struct {
+	fakeContainerInspector
+
+	mu     sync.Mutex
+	states []log.Container
+	events chan log.ContainerEvent
+	// watched reports whether the events were watched.
+	watched bool
+}
+
+func newFakeContainerWatcher() *fakeContainerWatcher {
+	return &fakeContainerWatcher{events: make(chan log.ContainerEvent)}
+}
+
+func (f *fakeContainerWatcher) InspectContainer(
+	ctx context.Context,
+	containerNameOrID string,
+) (log.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.states) == 0 {
+		return log.Container{}, &log.ContainerNotFoundError{Name: containerNameOrID}
+	}
+	ctr := f.states[0]
+	if len(f.states) > 1 {
+		f.states = f.states[1:]
+	}
+	return ctr, nil
+}
+
+func (f *fakeContainerWatcher) WatchContainers(
+	ctx context.Context,
+	since time.Time,
+) (<-chan log.ContainerEvent, <-chan error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.watched = true
+	return f.events, make(chan error)
+}
+
+func (f *fakeContainerWatcher) isWatched() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.watched
+}
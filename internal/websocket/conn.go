@@ -0,0 +1,303 @@
+// Package websocket implements the subset of the WebSocket protocol (RFC 6455)
+// needed to stream logs to clients: the server handshake, message framing,
+// fragmentation and control frames. Extensions and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MessageType is the type of a WebSocket message.
+type MessageType byte
+
+const (
+	// TextMessage denotes a UTF-8 encoded text message.
+	TextMessage MessageType = 0x1
+	// BinaryMessage denotes a binary data message.
+	BinaryMessage MessageType = 0x2
+)
+
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+// Close status codes defined by RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseMessageTooBig   = 1009
+	closeNoStatusPresent = 1005
+)
+
+// maxMessageSize is the maximum size of a message read from the peer.
+// Clients are only expected to send small control messages.
+const maxMessageSize = 1 << 20
+
+// closeTimeout is the time given to the peer to acknowledge a close frame.
+const closeTimeout = 5 * time.Second
+
+// CloseError is returned by [Conn.ReadMessage] when the peer closed the connection.
+type CloseError struct {
+	// Code is the close status code sent by the peer.
+	Code int
+
+	// Reason is the optional close reason sent by the peer.
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("websocket closed: %d", e.Code)
+}
+
+// Conn represents a WebSocket connection.
+//
+// Only one goroutine may read from the connection at a time but
+// writes are safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// isClient indicates whether this is the client side of the connection,
+	// in which case the frames sent must be masked.
+	isClient bool
+
+	wmu        sync.Mutex
+	closeSent  bool
+	closeOnce  sync.Once
+	closeError error
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isClient bool) *Conn {
+	return &Conn{
+		conn:     conn,
+		br:       br,
+		isClient: isClient,
+	}
+}
+
+// ReadMessage reads the next data message sent by the peer.
+//
+// Ping frames are answered automatically. When the peer closes the connection,
+// the close frame is acknowledged and a [*CloseError] is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		msgType MessageType
+		msg     []byte
+	)
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case opPong:
+			continue
+
+		case opClose:
+			closeErr := &CloseError{Code: closeNoStatusPresent}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			// Echo the status code to acknowledge the close.
+			_ = c.WriteClose(CloseNormalClosure, "")
+			return 0, nil, closeErr
+
+		case opText, opBinary:
+			if msgType != 0 {
+				return 0, nil, c.protocolError("new message before end of fragmented message")
+			}
+			msgType = MessageType(opcode)
+
+		case opContinuation:
+			if msgType == 0 {
+				return 0, nil, c.protocolError("continuation frame without message")
+			}
+
+		default:
+			return 0, nil, c.protocolError(fmt.Sprintf("unknown opcode %#x", opcode))
+		}
+
+		if len(msg)+len(payload) > maxMessageSize {
+			_ = c.WriteClose(CloseMessageTooBig, "")
+			return 0, nil, errors.New("websocket message too big")
+		}
+		msg = append(msg, payload...)
+
+		if fin {
+			return msgType, msg, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.protocolError("reserved bits set without extension")
+	}
+	opcode = header[0] & 0x0F
+
+	masked := header[1]&0x80 != 0
+	if masked == c.isClient {
+		// Clients must mask their frames and servers must not.
+		return false, 0, nil, c.protocolError("invalid frame masking")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	isControl := opcode&0x8 != 0
+	if isControl && (length > 125 || !fin) {
+		return false, 0, nil, c.protocolError("invalid control frame")
+	}
+	if length > maxMessageSize {
+		_ = c.WriteClose(CloseMessageTooBig, "")
+		return false, 0, nil, errors.New("websocket frame too big")
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, maskKey[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(maskKey, payload)
+	}
+
+	return fin, opcode, payload, nil
+}
+
+func (c *Conn) protocolError(msg string) error {
+	_ = c.WriteClose(CloseProtocolError, msg)
+	return fmt.Errorf("websocket protocol error: %s", msg)
+}
+
+// WriteMessage sends a single frame data message to the peer.
+func (c *Conn) WriteMessage(msgType MessageType, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("invalid message type %d", msgType)
+	}
+	return c.writeFrame(byte(msgType), data)
+}
+
+// WriteClose sends a close frame with the given status code and reason to the peer.
+// No data message can be sent afterwards.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	return c.writeFrame(opClose, payload)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return errors.New("websocket close already sent")
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.isClient {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return fmt.Errorf("generate mask key: %w", err)
+		}
+		frame = append(frame, maskKey[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(maskKey, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close closes the underlying network connection, sending a close frame
+// first if none was sent yet.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		_ = c.WriteClose(CloseNormalClosure, "")
+		c.closeError = c.conn.Close()
+	})
+	return c.closeError
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
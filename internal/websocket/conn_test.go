@@ -0,0 +1,96 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matthieugusmini/docker-logproxy/internal/websocket"
+)
+
+func TestConn(t *testing.T) {
+	// Echo server
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	t.Run("echoes messages of various sizes", func(t *testing.T) {
+		conn, err := websocket.Dial(t.Context(), wsURL)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+
+		for _, size := range []int{0, 125, 126, 65535, 65536} {
+			want := bytes.Repeat([]byte("x"), size)
+			if err := conn.WriteMessage(websocket.TextMessage, want); err != nil {
+				t.Fatalf("failed to write message: %v", err)
+			}
+
+			msgType, got, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+			if msgType != websocket.TextMessage {
+				t.Errorf("expected text message, got %d", msgType)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("expected message of %d bytes, got %d bytes", len(want), len(got))
+			}
+		}
+	})
+
+	t.Run("acknowledges close", func(t *testing.T) {
+		conn, err := websocket.Dial(t.Context(), wsURL)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+
+		if err := conn.WriteClose(websocket.CloseGoingAway, "bye"); err != nil {
+			t.Fatalf("failed to write close: %v", err)
+		}
+
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("expected *websocket.CloseError, got %v", err)
+		}
+		if closeErr.Code != websocket.CloseNormalClosure {
+			t.Errorf("expected close code %d, got %d", websocket.CloseNormalClosure, closeErr.Code)
+		}
+	})
+
+	t.Run("rejects plain HTTP requests", func(t *testing.T) {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("failed to make HTTP request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // Mandated by RFC 6455, not used for security.
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// acceptGUID is the GUID concatenated to the client key to compute the
+// Sec-WebSocket-Accept header as defined in RFC 6455 section 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// HandshakeError describes an invalid WebSocket opening handshake request.
+type HandshakeError struct {
+	msg string
+}
+
+func (e *HandshakeError) Error() string {
+	return "websocket handshake: " + e.msg
+}
+
+// Upgrade upgrades the HTTP server connection to the WebSocket protocol.
+//
+// If the request is not a valid WebSocket opening handshake, it returns a [*HandshakeError]
+// and the caller is responsible for replying to the client.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, &HandshakeError{"method is not GET"}
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return nil, &HandshakeError{"'Connection' header does not contain 'upgrade'"}
+	}
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, &HandshakeError{"'Upgrade' header does not contain 'websocket'"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, &HandshakeError{"unsupported 'Sec-WebSocket-Version'"}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, &HandshakeError{"missing 'Sec-WebSocket-Key' header"}
+	}
+
+	netConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack connection: %w", err)
+	}
+	// Clear the deadlines possibly set by the HTTP server.
+	if err := netConn.SetDeadline(time.Time{}); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("clear connection deadline: %w", err)
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n\r\n"
+	if _, err := brw.WriteString(resp); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("write handshake response: %w", err)
+	}
+	if err := brw.Flush(); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("write handshake response: %w", err)
+	}
+
+	return newConn(netConn, brw.Reader, false), nil
+}
+
+// Dial opens a client WebSocket connection to the given ws:// URL.
+// It is mostly useful for tests.
+func Dial(ctx context.Context, rawURL string) (*Conn, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	if req.URL.Scheme != "ws" {
+		return nil, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	var rawKey [16]byte
+	_, _ = rand.Read(rawKey[:])
+	key := base64.StdEncoding.EncodeToString(rawKey[:])
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("write handshake request: %w", err)
+	}
+
+	br := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("read handshake response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		netConn.Close()
+		return nil, fmt.Errorf("unexpected handshake response status: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != computeAcceptKey(key) {
+		netConn.Close()
+		return nil, errors.New("invalid 'Sec-WebSocket-Accept' header")
+	}
+
+	return newConn(netConn, br, true), nil
+}
+
+func computeAcceptKey(key string) string {
+	h := sha1.New() //nolint:gosec // Mandated by RFC 6455, not used for security.
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken reports whether the comma-separated list of tokens
+// of the header contains the given token, ignoring case.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for t := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -51,6 +53,30 @@ func run(ctx context.Context, args []string) error {
 		port       string
 		logDir     string
 		containers stringSliceFlag
+		includes   repeatedFlag
+		excludes   repeatedFlag
+
+		maxSegmentSize  byteSizeFlag
+		maxSegments     int
+		compress        bool
+		compressRemoved bool
+
+		retentionMaxAge        durationFlag
+		retentionMaxAgeRemoved durationFlag
+		retentionMaxSize       byteSizeFlag
+		gcInterval             durationFlag
+		gcDryRun               bool
+
+		followBufferSize   int
+		followSlowConsumer string
+
+		multilinePreset       string
+		multilineStart        string
+		multilineContinuation string
+		multilineMaxLines     int
+		multilineFlushTimeout durationFlag
+
+		parseFields string
 	)
 	fs := flag.NewFlagSet("docker-logproxy", flag.ExitOnError)
 	fs.Var(
@@ -58,6 +84,17 @@ func run(ctx context.Context, args []string) error {
 		"containers",
 		"Comma-separated list of container names to watch (default: watch all containers)",
 	)
+	fs.Var(
+		&includes,
+		"include",
+		"Watch the containers matching this selector: name glob, name=<glob>, regex=<regexp>, "+
+			"label=<key>[=<value>] or image=<glob> (repeatable)",
+	)
+	fs.Var(
+		&excludes,
+		"exclude",
+		"Do not watch the containers matching this selector, same syntax as -include (repeatable)",
+	)
 	fs.BoolVar(&verbose, "v", false, "Enable debug logging (default: disabled)")
 	fs.StringVar(
 		&port,
@@ -71,10 +108,131 @@ func run(ctx context.Context, args []string) error {
 		defaultLogDir,
 		"Directory where container logs are stored (default: logs)",
 	)
+	fs.Var(
+		&maxSegmentSize,
+		"max-segment-size",
+		"Size from which the log file of a container is rotated, e.g. 100MB (default: no rotation)",
+	)
+	fs.IntVar(
+		&maxSegments,
+		"max-segments",
+		0,
+		"Maximum number of log segments kept per container (default: unlimited)",
+	)
+	fs.BoolVar(
+		&compress,
+		"compress",
+		false,
+		"Compress the log segments with gzip once rotated (default: disabled)",
+	)
+	fs.BoolVar(
+		&compressRemoved,
+		"compress-removed",
+		false,
+		"Compress the logs of the containers removed from Docker with gzip (default: disabled)",
+	)
+	fs.Var(
+		&retentionMaxAge,
+		"retention-max-age",
+		"Delete the logs of a container not written for this long, e.g. 30d (default: never)",
+	)
+	fs.Var(
+		&retentionMaxAgeRemoved,
+		"retention-max-age-removed",
+		"Delete the logs of a container removed from Docker for this long, e.g. 7d (default: never)",
+	)
+	fs.Var(
+		&retentionMaxSize,
+		"retention-max-size",
+		"Total size of the stored logs, the oldest are deleted first, e.g. 10GB (default: unlimited)",
+	)
+	fs.Var(
+		&gcInterval,
+		"gc-interval",
+		"Interval between two deletions of the logs exceeding the retention limits (default: 10m)",
+	)
+	fs.BoolVar(
+		&gcDryRun,
+		"gc-dry-run",
+		false,
+		"Only log the logs which would be deleted by the retention limits (default: disabled)",
+	)
+	fs.IntVar(
+		&followBufferSize,
+		"follow-buffer-size",
+		1024,
+		"Number of log records buffered per client following the logs (default: 1024)",
+	)
+	fs.StringVar(
+		&followSlowConsumer,
+		"follow-slow-consumer",
+		string(log.SlowConsumerDrop),
+		"What to do once the buffer of a client following the logs is full: "+
+			"drop the records or disconnect the client (default: drop)",
+	)
+	fs.StringVar(
+		&multilinePreset,
+		"multiline-preset",
+		"",
+		"Join the stack traces of a language into single records: java, python or go, "+
+			"unless configured by the container labels (default: disabled)",
+	)
+	fs.StringVar(
+		&multilineStart,
+		"multiline-start",
+		"",
+		"Regular expression matching the first line of multiline records (default: none)",
+	)
+	fs.StringVar(
+		&multilineContinuation,
+		"multiline-continuation",
+		"",
+		"Regular expression matching the lines appended to multiline records (default: none)",
+	)
+	fs.IntVar(
+		&multilineMaxLines,
+		"multiline-max-lines",
+		0,
+		"Maximum number of lines joined into a multiline record (default: 1000)",
+	)
+	fs.Var(
+		&multilineFlushTimeout,
+		"multiline-flush-timeout",
+		"Time after which a multiline record is stored if no line is appended to it (default: 1s)",
+	)
+	fs.StringVar(
+		&parseFields,
+		"parse-fields",
+		string(log.FieldsFormatNone),
+		"Extract the fields of the structured logs written in this format: none, auto, json or "+
+			"logfmt, unless configured by the container labels (default: none)",
+	)
 	if err := fs.Parse(args); err != nil {
 		return fmt.Errorf("parse flags: %w", err)
 	}
 
+	selector, err := parseContainerSelector(append(containers, includes...), excludes)
+	if err != nil {
+		return err
+	}
+
+	slowConsumerPolicy, err := log.ParseSlowConsumerPolicy(followSlowConsumer)
+	if err != nil {
+		return fmt.Errorf("invalid slow consumer policy: %w", err)
+	}
+
+	multiline, err := parseMultilineConfig(multilinePreset, multilineStart, multilineContinuation)
+	if err != nil {
+		return err
+	}
+	multiline.MaxLines = multilineMaxLines
+	multiline.FlushTimeout = time.Duration(multilineFlushTimeout)
+
+	fieldsFormat, err := log.ParseFieldsFormat(parseFields)
+	if err != nil {
+		return fmt.Errorf("invalid fields format: %w", err)
+	}
+
 	lvl := slog.LevelInfo
 	if verbose {
 		lvl = slog.LevelDebug
@@ -83,30 +241,56 @@ func run(ctx context.Context, args []string) error {
 		Level: lvl,
 	}))
 
-	storage := filesystem.NewLogStorage(logDir)
+	storage := filesystem.NewLogStorage(logDir, filesystem.LogStorageOptions{
+		MaxSegmentSize:  int64(maxSegmentSize),
+		MaxSegments:     maxSegments,
+		Compress:        compress,
+		CompressRemoved: compressRemoved,
+	})
 	if err := storage.LoadExistingMappings(); err != nil {
 		return fmt.Errorf("load existing log mappings: %w", err)
 	}
 
+	garbageCollector := filesystem.NewGarbageCollector(storage, logger, filesystem.RetentionOptions{
+		MaxAge:             time.Duration(retentionMaxAge),
+		MaxAgeAfterRemoval: time.Duration(retentionMaxAgeRemoved),
+		MaxTotalSize:       int64(retentionMaxSize),
+		Interval:           time.Duration(gcInterval),
+		DryRun:             gcDryRun,
+	})
+
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf("new Docker Engine API client: %w", err)
 	}
 	defer cli.Close()
-	dockerClient := docker.NewClient(cli)
+	dockerClient := docker.NewClient(cli, logger)
+
+	// The collected records are broadcast to the clients following the logs.
+	hub := log.NewHub(log.HubOptions{
+		BufferSize:         followBufferSize,
+		SlowConsumerPolicy: slowConsumerPolicy,
+	})
 
 	logCollector := log.NewCollector(
 		dockerClient,
 		storage,
 		logger,
 		log.CollectorOptions{
-			Containers: containers,
+			Selector:    selector,
+			Multiline:   multiline,
+			ParseFields: fieldsFormat,
+			Hub:         hub,
 		},
 	)
 
-	logSvc := log.NewService(dockerClient, storage, logger)
+	logSvc := log.NewService(dockerClient, storage, logger, log.ServiceOptions{
+		Hub:     hub,
+		Watcher: dockerClient,
+	})
+	containerSvc := log.NewContainerService(dockerClient, storage)
 	addr := net.JoinHostPort("", port)
-	handler := api.NewHandler(ctx, addr, logSvc)
+	handler := api.NewHandler(ctx, addr, logSvc, containerSvc, logCollector)
 	srv := &http.Server{
 		Addr:              addr,
 		Handler:           handler,
@@ -127,6 +311,14 @@ func run(ctx context.Context, args []string) error {
 		return nil
 	})
 
+	g.Go(func() error {
+		logger.Info("Start collecting stored logs garbage")
+		if err := garbageCollector.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("garbage collector run: %w", err)
+		}
+		return nil
+	})
+
 	g.Go(func() error {
 		<-ctx.Done()
 		logger.Info("Server shutting down...")
@@ -161,3 +353,119 @@ func (c *stringSliceFlag) Set(value string) error {
 	*c = strings.Split(value, ",")
 	return nil
 }
+
+// repeatedFlag collects the values of a flag given several times.
+type repeatedFlag []string
+
+func (c *repeatedFlag) String() string {
+	return fmt.Sprintf("%v", *c)
+}
+
+func (c *repeatedFlag) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// byteSizeFlag is a size in bytes given with an optional unit (e.g. 512KB, 100MB, 1GB).
+// Units are powers of 1024.
+type byteSizeFlag int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *byteSizeFlag) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSizeFlag) Set(value string) error {
+	number, unit := value, int64(1)
+	for _, u := range byteSizeUnits {
+		if v, ok := strings.CutSuffix(strings.ToUpper(value), u.suffix); ok {
+			number, unit = v, u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%q is not a size", value)
+	}
+	*b = byteSizeFlag(n * unit)
+	return nil
+}
+
+// durationFlag is a duration which also accepts days (e.g. 7d), see [log.ParseDuration].
+type durationFlag time.Duration
+
+func (d *durationFlag) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationFlag) Set(value string) error {
+	v, err := log.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("%q is a negative duration", value)
+	}
+	*d = durationFlag(v)
+	return nil
+}
+
+func parseContainerSelector(includes, excludes []string) (log.ContainerSelector, error) {
+	var selector log.ContainerSelector
+	for _, v := range includes {
+		m, err := log.ParseContainerMatcher(v)
+		if err != nil {
+			return log.ContainerSelector{}, fmt.Errorf("invalid include selector: %w", err)
+		}
+		selector.Include = append(selector.Include, m)
+	}
+	for _, v := range excludes {
+		m, err := log.ParseContainerMatcher(v)
+		if err != nil {
+			return log.ContainerSelector{}, fmt.Errorf("invalid exclude selector: %w", err)
+		}
+		selector.Exclude = append(selector.Exclude, m)
+	}
+	return selector, nil
+}
+
+// parseMultilineConfig returns the default multiline configuration of the collector.
+// The given patterns take precedence over the ones of the preset.
+func parseMultilineConfig(preset, start, continuation string) (log.MultilineConfig, error) {
+	var config log.MultilineConfig
+	if start != "" {
+		re, err := regexp.Compile(start)
+		if err != nil {
+			return log.MultilineConfig{}, fmt.Errorf("invalid multiline start pattern: %w", err)
+		}
+		config.Start = re
+	}
+	if continuation != "" {
+		re, err := regexp.Compile(continuation)
+		if err != nil {
+			return log.MultilineConfig{}, fmt.Errorf(
+				"invalid multiline continuation pattern: %w",
+				err,
+			)
+		}
+		config.Continuation = re
+	}
+	if preset != "" {
+		p, err := log.MultilinePreset(preset)
+		if err != nil {
+			return log.MultilineConfig{}, fmt.Errorf("invalid multiline preset: %w", err)
+		}
+		config.ApplyPreset(p)
+	}
+	return config, nil
+}
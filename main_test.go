@@ -334,6 +334,49 @@ func TestGetContainerLogs(t *testing.T) {
 		}
 	})
 
+	t.Run("follow=1 with Accept text/event-stream streams events", func(t *testing.T) {
+		t.Parallel()
+
+		cmd := "for i in 1 2; do echo \"log-$i\"; sleep 1; done"
+		containerName := mustSetupTestContainer(t, t.Context(), cmd, false)
+
+		reqURL := fmt.Sprintf("%s/logs/%s?stdout=1&follow=1", baseURL, containerName)
+		req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to create new HTTP request: %v", err)
+		}
+		req.Header.Set("Accept", "text/event-stream")
+
+		httpClient := &http.Client{Timeout: 10 * time.Second}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make HTTP request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Errorf("Expected content type text/event-stream, got %s", ct)
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read response body: %v", err)
+		}
+		body := string(b)
+
+		if got := strings.Count(body, "event: stdout\n"); got != 2 {
+			t.Errorf("Expected 2 stdout events, got %d:\n%s", got, body)
+		}
+		if got := strings.Count(body, "id: "); got != 2 {
+			t.Errorf("Expected 2 event IDs, got %d:\n%s", got, body)
+		}
+		for _, line := range []string{`"output":"log-1\n"`, `"output":"log-2\n"`} {
+			if !strings.Contains(body, line) {
+				t.Errorf("Expected contains %s, got %s", line, body)
+			}
+		}
+	})
+
 	t.Run("container does not exist returns 404", func(t *testing.T) {
 		t.Parallel()
 